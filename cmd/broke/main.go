@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/mxcd/broke/internal/clients"
 	"github.com/mxcd/broke/internal/planner"
+	"github.com/mxcd/broke/internal/scim"
+	"github.com/mxcd/broke/internal/server"
 	"github.com/mxcd/broke/internal/util"
+	"github.com/mxcd/broke/pkg/config"
 	"github.com/urfave/cli/v2"
 )
 
@@ -45,17 +54,41 @@ func main() {
 						Usage:    "*.broke.yml file to be used",
 						EnvVars:  []string{"BROKE_CONFIG_FILE"},
 					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Value:   string(planner.OutputFormatTable),
+						Usage:   "format the plan is printed in (table, json, yaml, markdown)",
+						EnvVars: []string{"BROKE_OUTPUT"},
+					},
+					&cli.StringFlag{
+						Name:    "output-file",
+						Usage:   "write the printed plan to this file instead of stdout",
+						EnvVars: []string{"BROKE_OUTPUT_FILE"},
+					},
+					&cli.BoolFlag{
+						Name:    "fail-fast",
+						Usage:   "stop at the first failing action instead of executing all remaining actions",
+						EnvVars: []string{"BROKE_FAIL_FAST"},
+					},
 				},
 				Action: func(c *cli.Context) error {
 					initApplication(c)
+					outputFormat, err := planner.ParseOutputFormat(c.String("output"))
+					if err != nil {
+						return err
+					}
 					plannerInstance, err := planner.NewPlanner(&planner.PlannerOptions{
 						ConfigFileName: c.String("config"),
+						OutputFormat:   outputFormat,
+						OutputFile:     c.String("output-file"),
+						FailFast:       c.Bool("fail-fast"),
 					})
 					if err != nil {
 						return err
 					}
 					if c.Bool("verbose") || c.Bool("very-verbose") {
-						plannerInstance.Print()
+						plannerInstance.Print(util.GetLogWriter(c))
 					}
 					err = plannerInstance.Run()
 					if err != nil {
@@ -76,19 +109,92 @@ func main() {
 						Usage:    "*.broke.yml file to be used",
 						EnvVars:  []string{"BROKE_CONFIG_FILE"},
 					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "save the computed plan to this file so that it can be applied later with 'broke apply'",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Value:   string(planner.OutputFormatTable),
+						Usage:   "format the plan is printed in (table, json, yaml, markdown)",
+						EnvVars: []string{"BROKE_OUTPUT"},
+					},
+					&cli.StringFlag{
+						Name:    "output-file",
+						Usage:   "write the printed plan to this file instead of stdout",
+						EnvVars: []string{"BROKE_OUTPUT_FILE"},
+					},
 				},
 				Action: func(c *cli.Context) error {
 					initApplication(c)
+					outputFormat, err := planner.ParseOutputFormat(c.String("output"))
+					if err != nil {
+						return err
+					}
 					plannerInstance, err := planner.NewPlanner(&planner.PlannerOptions{
 						ConfigFileName: c.String("config"),
+						OutputFormat:   outputFormat,
+						OutputFile:     c.String("output-file"),
 					})
 					if err != nil {
 						return err
 					}
 					if c.Bool("verbose") || c.Bool("very-verbose") {
-						plannerInstance.Print()
+						plannerInstance.Print(util.GetLogWriter(c))
+					}
+					plan, err := plannerInstance.Plan()
+					if err != nil {
+						return err
+					}
+
+					if c.String("out") != "" {
+						err = plan.Save(c.String("out"))
+						if err != nil {
+							return err
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "apply",
+				Usage:     "Apply a plan saved with 'broke plan --out'",
+				ArgsUsage: "<plan file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "config",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "*.broke.yml file to be used",
+						EnvVars:  []string{"BROKE_CONFIG_FILE"},
+					},
+					&cli.BoolFlag{
+						Name:    "fail-fast",
+						Usage:   "stop at the first failing action instead of executing all remaining actions",
+						EnvVars: []string{"BROKE_FAIL_FAST"},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					initApplication(c)
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("exactly one plan file must be given")
+					}
+
+					plan, err := planner.LoadPlan(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					plannerInstance, err := planner.NewPlanner(&planner.PlannerOptions{
+						ConfigFileName: c.String("config"),
+						FailFast:       c.Bool("fail-fast"),
+					})
+					if err != nil {
+						return err
 					}
-					err = plannerInstance.Plan()
+					err = plannerInstance.Apply(plan)
 					if err != nil {
 						return err
 					}
@@ -96,22 +202,130 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "serve",
+				Usage: "Run identity broker as a daemon that reconciles on an interval, on SIGHUP and on webhook events",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "config",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "*.broke.yml file to be used",
+						EnvVars:  []string{"BROKE_CONFIG_FILE"},
+					},
+					&cli.DurationFlag{
+						Name:    "interval",
+						Aliases: []string{"i"},
+						Value:   15 * time.Minute,
+						Usage:   "time between two scheduled runs",
+						EnvVars: []string{"BROKE_INTERVAL"},
+					},
+					&cli.BoolFlag{
+						Name:    "fail-fast",
+						Usage:   "stop at the first failing action instead of executing all remaining actions",
+						EnvVars: []string{"BROKE_FAIL_FAST"},
+					},
+					&cli.StringFlag{
+						Name:    "listen",
+						Usage:   "address the HTTP server listens on, e.g. :8080. No server is started if empty",
+						EnvVars: []string{"BROKE_LISTEN"},
+					},
+					&cli.StringFlag{
+						Name:    "webhook-secret",
+						Usage:   "shared secret of the Keycloak event webhook at /webhook/keycloak. The webhook is disabled if empty",
+						EnvVars: []string{"BROKE_WEBHOOK_SECRET"},
+					},
+					&cli.BoolFlag{
+						Name:    "webhook-require-timestamp",
+						Usage:   "reject webhook signatures without the X-Keycloak-Timestamp header, so that requests cannot be replayed",
+						EnvVars: []string{"BROKE_WEBHOOK_REQUIRE_TIMESTAMP"},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					initApplication(c)
+					if c.String("webhook-secret") != "" && c.String("listen") == "" {
+						return fmt.Errorf("the webhook requires --listen")
+					}
+
+					plannerInstance, err := planner.NewPlanner(&planner.PlannerOptions{
+						ConfigFileName: c.String("config"),
+						FailFast:       c.Bool("fail-fast"),
+					})
+					if err != nil {
+						return err
+					}
+					if c.Bool("verbose") || c.Bool("very-verbose") {
+						plannerInstance.Print(util.GetLogWriter(c))
+					}
+
+					ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					var userEvents chan *planner.UserEvent
+					serverErrors := make(chan error, 1)
+					if c.String("listen") != "" {
+						userEvents = make(chan *planner.UserEvent, 100)
+						httpServer := server.NewServer(&server.ServerOptions{Listen: c.String("listen")})
+						if c.String("webhook-secret") != "" {
+							httpServer.RegisterWebhook(&server.WebhookOptions{
+								Secret:           c.String("webhook-secret"),
+								RequireTimestamp: c.Bool("webhook-require-timestamp"),
+								Events:           userEvents,
+							})
+						}
+						err = registerScimSources(httpServer, plannerInstance.Config, userEvents)
+						if err != nil {
+							return err
+						}
+						go func() {
+							err := httpServer.Run(ctx)
+							if err != nil {
+								serverErrors <- err
+								stop()
+							}
+						}()
+					}
+
+					err = plannerInstance.Serve(ctx, &planner.ServeOptions{
+						Interval:   c.Duration("interval"),
+						Trigger:    notifyTrigger(syscall.SIGHUP),
+						UserEvents: userEvents,
+					})
+					if err != nil {
+						return err
+					}
+
+					select {
+					case err := <-serverErrors:
+						return err
+					default:
+						return nil
+					}
+				},
+			},
 			{
 				Name:  "test",
 				Usage: "test the connection to all configured APIs",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:    "config",
-						Aliases: []string{"c"},
-						Value:   "",
-						Usage:   "*.broke.yml file to be used",
-						EnvVars: []string{"BROKE_CONFIG_FILE"},
+						Name:     "config",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "*.broke.yml file to be used",
+						EnvVars:  []string{"BROKE_CONFIG_FILE"},
 					},
 				},
 				Action: func(c *cli.Context) error {
 					initApplication(c)
-					// TODO
-					return nil
+					brokeConfig, err := config.LoadConfig(&config.LoadConfigOptions{
+						ConfigFile: c.String("config"),
+					})
+					if err != nil {
+						return err
+					}
+
+					results := clients.TestConfiguredConnections(brokeConfig)
+					return clients.PrintConnectionTestResults(os.Stdout, results)
 				},
 			},
 		},
@@ -123,6 +337,48 @@ func main() {
 	}
 }
 
+// registerScimSources serves the SCIM endpoint of every scim user source
+func registerScimSources(httpServer *server.Server, brokeConfig *config.BrokeConfig, events chan<- *planner.UserEvent) error {
+	for _, userSource := range brokeConfig.UserSources {
+		if userSource.Scim == nil {
+			continue
+		}
+		token := os.Getenv(userSource.Scim.TokenEnvironmentVariable)
+		if token == "" {
+			return fmt.Errorf("environment variable '%s' with the SCIM token of user source '%s' is empty", userSource.Scim.TokenEnvironmentVariable, userSource.Name)
+		}
+		store, err := scim.NewStore(userSource.Scim.StoreFile)
+		if err != nil {
+			return err
+		}
+		httpServer.RegisterScim(&server.ScimOptions{
+			Name:   userSource.Name,
+			Store:  store,
+			Token:  token,
+			Events: events,
+		})
+	}
+	return nil
+}
+
+// notifyTrigger returns a channel that receives whenever one of the signals arrives.
+// Signals arriving while a previous one has not been consumed yet are coalesced.
+func notifyTrigger(signals ...os.Signal) <-chan struct{} {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, signals...)
+
+	trigger := make(chan struct{}, 1)
+	go func() {
+		for range signalChannel {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return trigger
+}
+
 func initApplication(c *cli.Context) error {
 	util.PrintLogo(c)
 	util.SetLogLevel(c)
@@ -0,0 +1,335 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mxcd/broke/internal/user"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultAuthentikPageSize = 100
+
+// user types of Authentik that are no persons
+var authentikServiceAccountTypes = []string{"service_account", "internal_service_account"}
+
+type AuthentikClient struct {
+	Options    *AuthentikClientOptions
+	httpClient *http.Client
+}
+
+type AuthentikClientOptions struct {
+	Name     string
+	Url      string
+	Token    string
+	PageSize int
+	// users are members of all parent groups of their groups
+	InheritParentGroups bool
+	// retries, rate limiting and timeouts of the http client. Defaults apply if nil
+	Http *HttpClientOptions
+}
+
+type authentikPagination struct {
+	Next       int `json:"next"`
+	Count      int `json:"count"`
+	TotalPages int `json:"total_pages"`
+}
+
+type authentikPage[T any] struct {
+	Pagination authentikPagination `json:"pagination"`
+	Results    []T                 `json:"results"`
+}
+
+type AuthentikUser struct {
+	Pk       int    `json:"pk"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	IsActive bool   `json:"is_active"`
+	Type     string `json:"type"`
+	// primary keys of the groups the user is a direct member of
+	Groups     []string               `json:"groups"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type AuthentikGroup struct {
+	Pk   string `json:"pk"`
+	Name string `json:"name"`
+	// primary key of the parent group or nil for top level groups
+	Parent *string `json:"parent"`
+}
+
+func NewAuthentikClient(options *AuthentikClientOptions) (*AuthentikClient, error) {
+	options.Url = strings.TrimRight(options.Url, "/")
+	if options.Url == "" {
+		return nil, fmt.Errorf("AuthentikClientOptions.Url is empty")
+	}
+	if options.Token == "" {
+		return nil, fmt.Errorf("AuthentikClientOptions.Token is empty")
+	}
+	if options.PageSize <= 0 {
+		options.PageSize = defaultAuthentikPageSize
+	}
+	if options.Http == nil {
+		options.Http = &HttpClientOptions{}
+	}
+	return &AuthentikClient{
+		Options:    options,
+		httpClient: NewHttpClient(options.Http),
+	}, nil
+}
+
+func (c AuthentikClient) GetName() string {
+	return c.Options.Name
+}
+func (c AuthentikClient) GetBaseUrl() string {
+	return c.Options.Url
+}
+func (c AuthentikClient) GetAuthorizationType() AuthorizationType {
+	return AuthorizationTypeBearer
+}
+func (c AuthentikClient) GetAuthorization() string {
+	return c.Options.Token
+}
+func (c AuthentikClient) GetHttpClient() *http.Client {
+	return c.httpClient
+}
+
+func (c *AuthentikClient) TestConnection() error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Testing connection to Authentik API at '%s'", c.Options.Url)
+	_, err := DoHttpRequest(*c, &HttpRequestOptions{
+		Method:             GET,
+		ContextPath:        "/api/v3/core/users/me/",
+		ExpectedStatusCode: 200,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to test Authentik API connection for user source '%s'", c.Options.Name)
+		return err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully connected to Authentik API at '%s'", c.Options.Url)
+	return nil
+}
+
+// getAllPages follows the pagination of a list endpoint until the last page. The query is added to every request.
+func getAllPages[T any](c *AuthentikClient, contextPath string, query string) ([]T, error) {
+	results := []T{}
+	for page := 1; page > 0; {
+		response := &authentikPage[T]{}
+		_, err := DoHttpRequestWithResult(*c, &HttpRequestOptions{
+			Method:             GET,
+			ContextPath:        fmt.Sprintf("%s?%spage=%d&page_size=%d", contextPath, query, page, c.Options.PageSize),
+			ExpectedStatusCode: 200,
+		}, response)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, response.Results...)
+		// next is 0 on the last page
+		page = response.Pagination.Next
+	}
+	return results, nil
+}
+
+func (c *AuthentikClient) GetUsers() ([]AuthentikUser, error) {
+	users, err := getAllPages[AuthentikUser](c, "/api/v3/core/users/", "")
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Got %d users from Authentik", len(users))
+	return users, nil
+}
+
+func (c *AuthentikClient) GetGroups() ([]AuthentikGroup, error) {
+	// the members of groups are known from the users and would only bloat the response
+	groups, err := getAllPages[AuthentikGroup](c, "/api/v3/core/groups/", "include_users=false&")
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Got %d groups from Authentik", len(groups))
+	return groups, nil
+}
+
+// getUser returns nil if the user does not exist
+func (c *AuthentikClient) getUser(ctx context.Context, pk int) (*AuthentikUser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/v3/core/users/%d/", c.Options.Url, pk), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.Options.Token)
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request GET %s failed with status %s", request.URL, response.Status)
+	}
+
+	authentikUser := &AuthentikUser{}
+	err = json.NewDecoder(response.Body).Decode(authentikUser)
+	if err != nil {
+		return nil, err
+	}
+	return authentikUser, nil
+}
+
+func (c *AuthentikClient) GetBrokeUserList(ctx context.Context) ([]*user.User, error) {
+	groups, err := c.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	users, err := c.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	return c.getBrokeUsers(users, groups), nil
+}
+
+// GetPartialBrokeUserList loads all users and keeps the ones that are selected by group, username or attribute.
+// Roles do not exist in Authentik.
+func (c *AuthentikClient) GetPartialBrokeUserList(ctx context.Context, selection *user.MappingSet) ([]*user.User, error) {
+	users, err := c.GetBrokeUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*user.User{}
+	for _, brokeUser := range users {
+		if brokeUser.IsMappingSatisfied(selection) {
+			result = append(result, brokeUser)
+		}
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Selected %d of %d Authentik users", len(result), len(users))
+	return result, nil
+}
+
+// GetBrokeUsersByIds loads the users with the given ids, which are the numeric primary keys of Authentik
+func (c *AuthentikClient) GetBrokeUsersByIds(ctx context.Context, ids []string) ([]*user.User, error) {
+	users := []AuthentikUser{}
+	for _, id := range ids {
+		pk, err := strconv.Atoi(id)
+		if err != nil {
+			// ids of other sources are no primary keys
+			continue
+		}
+		authentikUser, err := c.getUser(ctx, pk)
+		if err != nil {
+			return nil, err
+		}
+		if authentikUser == nil {
+			log.Debug().Str("client", c.Options.Name).Msgf("User %s no longer exists", id)
+			continue
+		}
+		users = append(users, *authentikUser)
+	}
+	if len(users) == 0 {
+		return []*user.User{}, nil
+	}
+
+	groups, err := c.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	return c.getBrokeUsers(users, groups), nil
+}
+
+func (c *AuthentikClient) getBrokeUsers(users []AuthentikUser, groups []AuthentikGroup) []*user.User {
+	groupPaths := getAuthentikGroupPaths(groups)
+
+	brokeUsers := []*user.User{}
+	for _, authentikUser := range users {
+		if slices.Contains(authentikServiceAccountTypes, authentikUser.Type) {
+			continue
+		}
+
+		// Authentik only knows a full name
+		firstName, lastName, _ := strings.Cut(strings.TrimSpace(authentikUser.Name), " ")
+		brokeUser := &user.User{
+			Id:         strconv.Itoa(authentikUser.Pk),
+			Source:     c.Options.Name,
+			Username:   authentikUser.Username,
+			Email:      authentikUser.Email,
+			FirstName:  firstName,
+			LastName:   strings.TrimSpace(lastName),
+			Groups:     []string{},
+			GroupPaths: []string{},
+			Roles:      []string{},
+			Enabled:    authentikUser.IsActive,
+			// Authentik does not track the verification of addresses
+			EmailVerified: authentikUser.Email != "",
+			Attributes:    getAuthentikAttributes(authentikUser.Attributes),
+		}
+		for _, groupPk := range authentikUser.Groups {
+			path, ok := groupPaths[groupPk]
+			if !ok {
+				continue
+			}
+			brokeUser.AddGroup(path[strings.LastIndex(path, "/")+1:], path, c.Options.InheritParentGroups)
+		}
+		brokeUsers = append(brokeUsers, brokeUser)
+	}
+	return brokeUsers
+}
+
+// getAuthentikGroupPaths returns the paths like /engineering/backend of all groups by primary key
+func getAuthentikGroupPaths(groups []AuthentikGroup) map[string]string {
+	groupsByPk := map[string]AuthentikGroup{}
+	for _, group := range groups {
+		groupsByPk[group.Pk] = group
+	}
+
+	paths := map[string]string{}
+	for _, group := range groups {
+		path := "/" + group.Name
+		visited := map[string]bool{group.Pk: true}
+		for parent := group.Parent; parent != nil; {
+			parentGroup, ok := groupsByPk[*parent]
+			// guard against cycles, which Authentik does not prevent
+			if !ok || visited[parentGroup.Pk] {
+				break
+			}
+			visited[parentGroup.Pk] = true
+			path = "/" + parentGroup.Name + path
+			parent = parentGroup.Parent
+		}
+		paths[group.Pk] = path
+	}
+	return paths
+}
+
+// getAuthentikAttributes converts the JSON attributes of a user. Strings, numbers, booleans and lists of them are
+// kept, nested objects are skipped.
+func getAuthentikAttributes(attributes map[string]interface{}) map[string][]string {
+	result := map[string][]string{}
+	for name, value := range attributes {
+		values := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			values = list
+		}
+
+		converted := []string{}
+		for _, value := range values {
+			switch value := value.(type) {
+			case string:
+				converted = append(converted, value)
+			case float64, bool:
+				converted = append(converted, fmt.Sprint(value))
+			}
+		}
+		if len(converted) > 0 {
+			result[name] = converted
+		}
+	}
+	return result
+}
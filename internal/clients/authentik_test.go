@@ -0,0 +1,85 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAuthentikTestServer(t *testing.T) *httptest.Server {
+	engineering := "engineering"
+	backend := "backend"
+	groups := []AuthentikGroup{
+		{Pk: engineering, Name: "engineering"},
+		{Pk: backend, Name: "backend", Parent: &engineering},
+		{Pk: "developers", Name: "developers", Parent: &backend},
+	}
+	users := []map[string]interface{}{
+		{"pk": 1, "username": "alice", "name": "Alice van Doe", "email": "alice@example.com", "is_active": true, "type": "internal",
+			"groups": []string{"developers"}, "attributes": map[string]interface{}{"department": "sales", "level": 3, "tags": []interface{}{"a", "b"}, "nested": map[string]interface{}{"x": 1}}},
+		{"pk": 2, "username": "bob", "name": "Bob", "is_active": false, "type": "external", "groups": []string{}},
+		{"pk": 3, "username": "ak-outpost", "is_active": true, "type": "internal_service_account", "groups": []string{}},
+	}
+
+	// serves one item per page to exercise the pagination
+	page := func(w http.ResponseWriter, r *http.Request, count int, item func(int) interface{}) {
+		number, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		next := number + 1
+		if next > count {
+			next = 0
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"pagination": map[string]interface{}{"next": next, "count": count, "total_pages": count},
+			"results":    []interface{}{item(number - 1)},
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/core/groups/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "false", r.URL.Query().Get("include_users"), "Groups should be loaded without their users")
+		page(w, r, len(groups), func(i int) interface{} { return groups[i] })
+	})
+	mux.HandleFunc("/api/v3/core/users/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		if r.URL.Path != "/api/v3/core/users/" {
+			http.NotFound(w, r)
+			return
+		}
+		page(w, r, len(users), func(i int) interface{} { return users[i] })
+	})
+	mux.HandleFunc("/api/v3/core/users/1/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(users[0])
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestAuthentikClient(t *testing.T) {
+	server := newAuthentikTestServer(t)
+	defer server.Close()
+
+	client, err := NewAuthentikClient(&AuthentikClientOptions{Name: "authentik", Url: server.URL, Token: "token", PageSize: 1, InheritParentGroups: true})
+	assert.NoError(t, err)
+
+	users, err := client.GetBrokeUserList(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 2, "Service accounts should be skipped")
+
+	alice := users[0]
+	assert.Equal(t, "1", alice.Id)
+	assert.Equal(t, "Alice", alice.FirstName)
+	assert.Equal(t, "van Doe", alice.LastName)
+	assert.ElementsMatch(t, []string{"developers", "backend", "engineering"}, alice.Groups, "Parent groups should be inherited")
+	assert.Contains(t, alice.GroupPaths, "/engineering/backend/developers")
+	assert.Equal(t, map[string][]string{"department": {"sales"}, "level": {"3"}, "tags": {"a", "b"}}, alice.Attributes)
+	assert.False(t, users[1].Enabled)
+
+	users, err = client.GetBrokeUsersByIds(context.Background(), []string{"1", "4", "not-a-pk"})
+	assert.NoError(t, err)
+	assert.Len(t, users, 1, "Missing users and foreign ids should be skipped")
+	assert.Equal(t, "alice", users[0].Username)
+}
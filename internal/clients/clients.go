@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mxcd/broke/internal/user"
 	"github.com/mxcd/broke/pkg/config"
 	"github.com/rs/zerolog/log"
 )
@@ -13,11 +16,25 @@ type Client interface {
 	TestConnection() error
 }
 
+// UserSource is a client that loads users from a user source
+type UserSource interface {
+	Client
+	GetBrokeUserList(ctx context.Context) ([]*user.User, error)
+	// GetPartialBrokeUserList loads the users selected by group, role, username or attribute
+	GetPartialBrokeUserList(ctx context.Context, selection *user.MappingSet) ([]*user.User, error)
+	// GetBrokeUsersByIds loads the users with the given ids. Users that no longer exist are skipped.
+	GetBrokeUsersByIds(ctx context.Context, ids []string) ([]*user.User, error)
+}
+
 type ClientSet struct {
-	KeycloakClients map[string]*KeycloakClient
-	MailcowClients  map[string]*MailcowClient
-	OutlineClients  map[string]*OutlineClient
-	GitLabClients   map[string]*GitLabClient
+	KeycloakClients  map[string]*KeycloakClient
+	LdapClients      map[string]*LdapClient
+	FileClients      map[string]*FileClient
+	ScimClients      map[string]*ScimClient
+	AuthentikClients map[string]*AuthentikClient
+	MailcowClients   map[string]*MailcowClient
+	OutlineClients   map[string]*OutlineClient
+	GitLabClients    map[string]*GitLabClient
 }
 
 func GetClientSet(config *config.BrokeConfig) (*ClientSet, error) {
@@ -25,21 +42,57 @@ func GetClientSet(config *config.BrokeConfig) (*ClientSet, error) {
 	ctx := context.Background()
 
 	clientSet := &ClientSet{
-		KeycloakClients: make(map[string]*KeycloakClient),
-		MailcowClients:  make(map[string]*MailcowClient),
-		OutlineClients:  make(map[string]*OutlineClient),
-		GitLabClients:   make(map[string]*GitLabClient),
+		KeycloakClients:  make(map[string]*KeycloakClient),
+		LdapClients:      make(map[string]*LdapClient),
+		FileClients:      make(map[string]*FileClient),
+		ScimClients:      make(map[string]*ScimClient),
+		AuthentikClients: make(map[string]*AuthentikClient),
+		MailcowClients:   make(map[string]*MailcowClient),
+		OutlineClients:   make(map[string]*OutlineClient),
+		GitLabClients:    make(map[string]*GitLabClient),
 	}
 
 	for _, userSourceConfig := range config.UserSources {
 		if userSourceConfig.Keycloak != nil {
-			client, err := getKeycloakClient(ctx, &userSourceConfig)
+			client, err := getKeycloakClient(ctx, &userSourceConfig, config.GetClientRoleClients())
 			if err != nil {
 				return nil, err
 			}
 			clientSet.KeycloakClients[userSourceConfig.Name] = client
 			continue
 		}
+		if userSourceConfig.Ldap != nil {
+			client, err := getLdapClient(&userSourceConfig)
+			if err != nil {
+				return nil, err
+			}
+			clientSet.LdapClients[userSourceConfig.Name] = client
+			continue
+		}
+		if userSourceConfig.File != nil {
+			client, err := getFileClient(&userSourceConfig)
+			if err != nil {
+				return nil, err
+			}
+			clientSet.FileClients[userSourceConfig.Name] = client
+			continue
+		}
+		if userSourceConfig.Scim != nil {
+			client, err := getScimClient(&userSourceConfig)
+			if err != nil {
+				return nil, err
+			}
+			clientSet.ScimClients[userSourceConfig.Name] = client
+			continue
+		}
+		if userSourceConfig.Authentik != nil {
+			client, err := getAuthentikClient(&userSourceConfig)
+			if err != nil {
+				return nil, err
+			}
+			clientSet.AuthentikClients[userSourceConfig.Name] = client
+			continue
+		}
 	}
 
 	for _, userTargetConfig := range config.UserTargets {
@@ -80,6 +133,34 @@ func (c *ClientSet) TestConnections() error {
 		}
 	}
 
+	for _, client := range c.LdapClients {
+		err := client.TestConnection()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, client := range c.FileClients {
+		err := client.TestConnection()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, client := range c.ScimClients {
+		err := client.TestConnection()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, client := range c.AuthentikClients {
+		err := client.TestConnection()
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, client := range c.MailcowClients {
 		err := client.TestConnection()
 		if err != nil {
@@ -104,33 +185,159 @@ func (c *ClientSet) TestConnections() error {
 	return nil
 }
 
-func getKeycloakClient(ctx context.Context, userSourceConfig *config.UserSourceConfig) (*KeycloakClient, error) {
+// ClearCaches drops everything the clients cached so that the next run sees the current state of all targets
+func (c *ClientSet) ClearCaches() {
+	for _, client := range c.MailcowClients {
+		client.ClearCache()
+	}
+	for _, client := range c.OutlineClients {
+		client.ClearCache()
+	}
+	for _, client := range c.GitLabClients {
+		client.ClearCache()
+	}
+}
+
+func getFileClient(userSourceConfig *config.UserSourceConfig) (*FileClient, error) {
+	log.Debug().Msgf("creating file client for user source '%s'", userSourceConfig.Name)
+	return NewFileClient(&FileClientOptions{
+		Name:                userSourceConfig.Name,
+		Path:                userSourceConfig.File.Path,
+		Format:              userSourceConfig.File.GetFormat(),
+		InheritParentGroups: userSourceConfig.InheritParentGroups,
+	})
+}
+
+func getScimClient(userSourceConfig *config.UserSourceConfig) (*ScimClient, error) {
+	log.Debug().Msgf("creating scim client for user source '%s'", userSourceConfig.Name)
+	return NewScimClient(&ScimClientOptions{
+		Name:      userSourceConfig.Name,
+		StoreFile: userSourceConfig.Scim.StoreFile,
+	})
+}
+
+func getAuthentikClient(userSourceConfig *config.UserSourceConfig) (*AuthentikClient, error) {
 	userSourceConfigName := userSourceConfig.Name
-	keycloakConfig := userSourceConfig.Keycloak
-	log.Debug().Msgf("creating keycloak client for user source '%s'", userSourceConfigName)
+	authentikConfig := userSourceConfig.Authentik
+	log.Debug().Msgf("creating authentik client for user source '%s'", userSourceConfigName)
+
+	tokenVariable := authentikConfig.TokenEnvironmentVariable
+	token := os.Getenv(tokenVariable)
+	if token == "" {
+		return nil, fmt.Errorf("authentik token for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, tokenVariable)
+	}
+
+	httpClientOptions, err := getHttpClientOptions(authentikConfig.Http, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http configuration for user source '%s': %w", userSourceConfigName, err)
+	}
 
-	usernameVariable := keycloakConfig.AdminUsernameEnvironmentVariable
-	passwordVariable := keycloakConfig.AdminPasswordEnvironmentVariable
-	url := keycloakConfig.Url
+	return NewAuthentikClient(&AuthentikClientOptions{
+		Name:                userSourceConfigName,
+		Url:                 authentikConfig.Url,
+		Token:               token,
+		PageSize:            authentikConfig.PageSize,
+		InheritParentGroups: userSourceConfig.InheritParentGroups,
+		Http:                httpClientOptions,
+	})
+}
 
-	username := os.Getenv(usernameVariable)
-	password := os.Getenv(passwordVariable)
+func getLdapClient(userSourceConfig *config.UserSourceConfig) (*LdapClient, error) {
+	userSourceConfigName := userSourceConfig.Name
+	ldapConfig := userSourceConfig.Ldap
+	log.Debug().Msgf("creating ldap client for user source '%s'", userSourceConfigName)
 
-	if username == "" {
-		return nil, fmt.Errorf("keycloak admin username for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, usernameVariable)
+	bindDnVariable := ldapConfig.BindDnEnvironmentVariable
+	bindDn := os.Getenv(bindDnVariable)
+	if bindDn == "" {
+		return nil, fmt.Errorf("ldap bind DN for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, bindDnVariable)
 	}
 
-	if password == "" {
-		return nil, fmt.Errorf("keycloak admin password for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, passwordVariable)
+	bindPasswordVariable := ldapConfig.BindPasswordEnvironmentVariable
+	bindPassword := os.Getenv(bindPasswordVariable)
+	if bindPassword == "" {
+		return nil, fmt.Errorf("ldap bind password for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, bindPasswordVariable)
+	}
+
+	var timeout time.Duration
+	if ldapConfig.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(ldapConfig.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ldap timeout for user source '%s': %w", userSourceConfigName, err)
+		}
 	}
 
-	client, err := NewKeycloakClient(ctx, &KeycloakClientOptions{
-		Name:     userSourceConfigName,
-		Url:      url,
-		Realm:    keycloakConfig.Realm,
-		Username: username,
-		Password: password,
+	return NewLdapClient(&LdapClientOptions{
+		Name:            userSourceConfigName,
+		Url:             ldapConfig.Url,
+		StartTls:        ldapConfig.StartTls,
+		Insecure:        ldapConfig.Insecure,
+		BindDn:          bindDn,
+		BindPassword:    bindPassword,
+		BaseDn:          ldapConfig.BaseDn,
+		GroupBaseDn:     ldapConfig.GroupBaseDn,
+		UserFilter:      ldapConfig.UserFilter,
+		GroupFilter:     ldapConfig.GroupFilter,
+		Membership:      ldapConfig.GetMembership(),
+		PageSize:        ldapConfig.PageSize,
+		Attributes:      ldapConfig.Attributes,
+		ExtraAttributes: ldapConfig.ExtraAttributes,
+		Timeout:         timeout,
 	})
+}
+
+func getKeycloakClient(ctx context.Context, userSourceConfig *config.UserSourceConfig, clientRoleClients []string) (*KeycloakClient, error) {
+	userSourceConfigName := userSourceConfig.Name
+	keycloakConfig := userSourceConfig.Keycloak
+	log.Debug().Msgf("creating keycloak client for user source '%s'", userSourceConfigName)
+
+	options := &KeycloakClientOptions{
+		Name:      userSourceConfigName,
+		Url:       keycloakConfig.Url,
+		Realm:     keycloakConfig.GetRealms()[0],
+		Realms:    keycloakConfig.GetRealms(),
+		AuthRealm: keycloakConfig.GetAuthRealm(),
+		AuthType:  keycloakConfig.GetAuthType(),
+		ClientId:  keycloakConfig.ClientId,
+
+		InheritParentGroups: userSourceConfig.InheritParentGroups,
+		ClientRoleClients:   clientRoleClients,
+	}
+
+	switch options.AuthType {
+	case config.KeycloakAuthTypeClientCredentials:
+		secretVariable := keycloakConfig.ClientSecretEnvironmentVariable
+		options.ClientSecret = os.Getenv(secretVariable)
+		if options.ClientSecret == "" {
+			return nil, fmt.Errorf("keycloak client secret for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, secretVariable)
+		}
+
+	case config.KeycloakAuthTypeClientJwt:
+		privateKey, signingMethod, err := loadKeycloakClientKey(keycloakConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keycloak client key for user source '%s': %w", userSourceConfigName, err)
+		}
+		options.ClientPrivateKey = privateKey
+		options.ClientSigningMethod = signingMethod
+
+	default:
+		usernameVariable := keycloakConfig.AdminUsernameEnvironmentVariable
+		passwordVariable := keycloakConfig.AdminPasswordEnvironmentVariable
+
+		options.Username = os.Getenv(usernameVariable)
+		options.Password = os.Getenv(passwordVariable)
+
+		if options.Username == "" {
+			return nil, fmt.Errorf("keycloak admin username for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, usernameVariable)
+		}
+
+		if options.Password == "" {
+			return nil, fmt.Errorf("keycloak admin password for user source '%s' is not set in configured environment variable '%s'", userSourceConfigName, passwordVariable)
+		}
+	}
+
+	client, err := NewKeycloakClient(ctx, options)
 	if err != nil {
 		return nil, err
 	}
@@ -138,6 +345,37 @@ func getKeycloakClient(ctx context.Context, userSourceConfig *config.UserSourceC
 	return client, nil
 }
 
+// loadKeycloakClientKey reads the PEM encoded private key the client assertion is signed with
+func loadKeycloakClientKey(keycloakConfig *config.KeycloakConfig) (interface{}, jwt.SigningMethod, error) {
+	algorithm := keycloakConfig.ClientSigningAlgorithm
+	if algorithm == "" {
+		algorithm = jwt.SigningMethodRS256.Alg()
+	}
+	signingMethod := jwt.GetSigningMethod(algorithm)
+	if signingMethod == nil {
+		return nil, nil, fmt.Errorf("unknown signing algorithm '%s'", algorithm)
+	}
+
+	if keycloakConfig.ClientPrivateKeyFile == "" {
+		return nil, nil, fmt.Errorf("no private key file configured")
+	}
+	pemData, err := os.ReadFile(keycloakConfig.ClientPrivateKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch signingMethod.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+		return privateKey, signingMethod, err
+	case *jwt.SigningMethodECDSA:
+		privateKey, err := jwt.ParseECPrivateKeyFromPEM(pemData)
+		return privateKey, signingMethod, err
+	default:
+		return nil, nil, fmt.Errorf("signing algorithm '%s' is not supported for client assertions", algorithm)
+	}
+}
+
 func getMailcowClient(ctx context.Context, userTargetConfig *config.UserTargetConfig) (*MailcowClient, error) {
 	_ = ctx
 	userTargetConfigName := userTargetConfig.Name
@@ -150,6 +388,11 @@ func getMailcowClient(ctx context.Context, userTargetConfig *config.UserTargetCo
 
 	apiKey := os.Getenv(apiKeyVariable)
 
+	httpClientOptions, err := GetHttpClientOptions(userTargetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http configuration for user target '%s': %w", userTargetConfigName, err)
+	}
+
 	if apiKey == "" {
 		return nil, fmt.Errorf("mailcow api key for user target '%s' is not set in configured environment variable '%s'", userTargetConfigName, apiKeyVariable)
 	}
@@ -158,6 +401,7 @@ func getMailcowClient(ctx context.Context, userTargetConfig *config.UserTargetCo
 		Name:   userTargetConfigName,
 		Url:    url,
 		ApiKey: apiKey,
+		Http:   httpClientOptions,
 	})
 	if err != nil {
 		return nil, err
@@ -178,6 +422,11 @@ func getOutlineClient(ctx context.Context, userTargetConfig *config.UserTargetCo
 
 	apiKey := os.Getenv(apiKeyVarialbe)
 
+	httpClientOptions, err := GetHttpClientOptions(userTargetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http configuration for user target '%s': %w", userTargetConfigName, err)
+	}
+
 	if apiKey == "" {
 		return nil, fmt.Errorf("outline api key for user target '%s' is not set in configured environment variable '%s'", userTargetConfigName, apiKeyVarialbe)
 	}
@@ -186,6 +435,7 @@ func getOutlineClient(ctx context.Context, userTargetConfig *config.UserTargetCo
 		Name:  userTargetConfigName,
 		Url:   url,
 		Token: apiKey,
+		Http:  httpClientOptions,
 	})
 	if err != nil {
 		return nil, err
@@ -206,6 +456,11 @@ func getGitLabClient(ctx context.Context, userTargetConfig *config.UserTargetCon
 
 	apiKey := os.Getenv(apiKeyVarialbe)
 
+	httpClientOptions, err := GetHttpClientOptions(userTargetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http configuration for user target '%s': %w", userTargetConfigName, err)
+	}
+
 	if apiKey == "" {
 		return nil, fmt.Errorf("gitlab api key for user target '%s' is not set in configured environment variable '%s'", userTargetConfigName, apiKeyVarialbe)
 	}
@@ -214,6 +469,7 @@ func getGitLabClient(ctx context.Context, userTargetConfig *config.UserTargetCon
 		Name:  userTargetConfigName,
 		Url:   url,
 		Token: apiKey,
+		Http:  httpClientOptions,
 	})
 	if err != nil {
 		return nil, err
@@ -222,14 +478,56 @@ func getGitLabClient(ctx context.Context, userTargetConfig *config.UserTargetCon
 	return client, nil
 }
 
-func (c *ClientSet) GetUserSourceClient(userSource config.UserSourceConfig) (*KeycloakClient, error) {
+// GetUserSourceClients returns the clients of a user source, which are one for each realm of a Keycloak source
+func (c *ClientSet) GetUserSourceClients(userSource config.UserSourceConfig) ([]UserSource, error) {
 	if userSource.Keycloak != nil {
-		return c.KeycloakClients[userSource.Name], nil
+		realmClients, err := c.GetKeycloakRealmClients(userSource)
+		if err != nil {
+			return nil, err
+		}
+		userSourceClients := []UserSource{}
+		for _, realmClient := range realmClients {
+			userSourceClients = append(userSourceClients, realmClient)
+		}
+		return userSourceClients, nil
+	}
+	if userSource.Ldap != nil {
+		if client, ok := c.LdapClients[userSource.Name]; ok {
+			return []UserSource{client}, nil
+		}
+	}
+	if userSource.File != nil {
+		if client, ok := c.FileClients[userSource.Name]; ok {
+			return []UserSource{client}, nil
+		}
+	}
+	if userSource.Scim != nil {
+		if client, ok := c.ScimClients[userSource.Name]; ok {
+			return []UserSource{client}, nil
+		}
+	}
+	if userSource.Authentik != nil {
+		if client, ok := c.AuthentikClients[userSource.Name]; ok {
+			return []UserSource{client}, nil
+		}
 	}
 
 	return nil, fmt.Errorf("no client found for user source '%s'", userSource.Name)
 }
 
+// GetKeycloakRealmClients returns a client for each realm of a Keycloak user source
+func (c *ClientSet) GetKeycloakRealmClients(userSource config.UserSourceConfig) ([]*KeycloakClient, error) {
+	if userSource.Keycloak == nil {
+		return nil, fmt.Errorf("user source '%s' is not a keycloak source", userSource.Name)
+	}
+
+	client, ok := c.KeycloakClients[userSource.Name]
+	if !ok {
+		return nil, fmt.Errorf("no client found for user source '%s'", userSource.Name)
+	}
+	return client.RealmClients(), nil
+}
+
 func (c *ClientSet) GetUserTargetMailcowClient(userTarget *config.UserTargetConfig) (*MailcowClient, error) {
 	if userTarget.Mailcow == nil {
 		return nil, fmt.Errorf("user target '%s' is not a mailcow target", userTarget.Name)
@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+type ConnectionTestResult struct {
+	Name    string
+	Type    string
+	Url     string
+	Latency time.Duration
+	Error   error
+}
+
+func (r *ConnectionTestResult) Succeeded() bool {
+	return r.Error == nil
+}
+
+// TestConfiguredConnections builds a client for every user source and target and tests its connection.
+// Sources and targets are tested independently, so a failing one does not prevent testing the others.
+func TestConfiguredConnections(brokeConfig *config.BrokeConfig) []*ConnectionTestResult {
+	ctx := context.Background()
+	results := []*ConnectionTestResult{}
+
+	for _, userSourceConfig := range brokeConfig.UserSources {
+		if userSourceConfig.Keycloak != nil {
+			results = append(results, testConnection(userSourceConfig.Name, "keycloak", userSourceConfig.Keycloak.Url, func() (Client, error) {
+				return getKeycloakClient(ctx, &userSourceConfig, brokeConfig.GetClientRoleClients())
+			}))
+		}
+		if userSourceConfig.Ldap != nil {
+			results = append(results, testConnection(userSourceConfig.Name, "ldap", userSourceConfig.Ldap.Url, func() (Client, error) {
+				return getLdapClient(&userSourceConfig)
+			}))
+		}
+		if userSourceConfig.File != nil {
+			results = append(results, testConnection(userSourceConfig.Name, "file", userSourceConfig.File.Path, func() (Client, error) {
+				return getFileClient(&userSourceConfig)
+			}))
+		}
+		if userSourceConfig.Scim != nil {
+			results = append(results, testConnection(userSourceConfig.Name, "scim", userSourceConfig.Scim.StoreFile, func() (Client, error) {
+				return getScimClient(&userSourceConfig)
+			}))
+		}
+		if userSourceConfig.Authentik != nil {
+			results = append(results, testConnection(userSourceConfig.Name, "authentik", userSourceConfig.Authentik.Url, func() (Client, error) {
+				return getAuthentikClient(&userSourceConfig)
+			}))
+		}
+	}
+
+	for _, userTargetConfig := range brokeConfig.UserTargets {
+		if userTargetConfig.Mailcow != nil {
+			results = append(results, testConnection(userTargetConfig.Name, "mailcow", userTargetConfig.Mailcow.Url, func() (Client, error) {
+				return getMailcowClient(ctx, &userTargetConfig)
+			}))
+		}
+		if userTargetConfig.Outline != nil {
+			results = append(results, testConnection(userTargetConfig.Name, "outline", userTargetConfig.Outline.Url, func() (Client, error) {
+				return getOutlineClient(ctx, &userTargetConfig)
+			}))
+		}
+		if userTargetConfig.GitLab != nil {
+			results = append(results, testConnection(userTargetConfig.Name, "gitlab", userTargetConfig.GitLab.Url, func() (Client, error) {
+				return getGitLabClient(ctx, &userTargetConfig)
+			}))
+		}
+	}
+
+	return results
+}
+
+// testConnection measures the time it takes to create the client, which includes logging in for some clients, and to test its connection
+func testConnection(name string, clientType string, url string, createClient func() (Client, error)) *ConnectionTestResult {
+	result := &ConnectionTestResult{
+		Name: name,
+		Type: clientType,
+		Url:  url,
+	}
+
+	start := time.Now()
+	client, err := createClient()
+	if err == nil {
+		err = client.TestConnection()
+	}
+	result.Latency = time.Since(start)
+	result.Error = err
+
+	if err != nil {
+		log.Debug().Err(err).Str("client", name).Msgf("Connection test for %s '%s' failed", clientType, name)
+	}
+	return result
+}
+
+// PrintConnectionTestResults renders a table of the results and returns an error if any test failed
+func PrintConnectionTestResults(w io.Writer, results []*ConnectionTestResult) error {
+	failed := 0
+
+	resultTable := table.NewWriter()
+	resultTable.SetOutputMirror(w)
+	resultTable.AppendHeader(table.Row{"Name", "Type", "URL", "Status", "Latency", "Error"})
+	for _, result := range results {
+		status := "OK"
+		errorMessage := ""
+		if !result.Succeeded() {
+			failed++
+			status = "FAILED"
+			errorMessage = result.Error.Error()
+		}
+		resultTable.AppendRow(table.Row{result.Name, result.Type, result.Url, status, result.Latency.Round(time.Millisecond), errorMessage})
+	}
+	resultTable.Render()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d connection tests failed", failed, len(results))
+	}
+	return nil
+}
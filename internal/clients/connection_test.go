@@ -0,0 +1,42 @@
+package clients
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient struct {
+	err error
+}
+
+func (c *testClient) TestConnection() error {
+	return c.err
+}
+
+func TestPrintConnectionTestResults(t *testing.T) {
+	results := []*ConnectionTestResult{
+		testConnection("mail", "mailcow", "https://mail.example.com", func() (Client, error) {
+			return &testClient{}, nil
+		}),
+		testConnection("wiki", "outline", "https://wiki.example.com", func() (Client, error) {
+			return nil, errors.New("api key not set")
+		}),
+		testConnection("git", "gitlab", "https://git.example.com", func() (Client, error) {
+			return &testClient{err: errors.New("401 Unauthorized")}, nil
+		}),
+	}
+
+	buffer := &bytes.Buffer{}
+	err := PrintConnectionTestResults(buffer, results)
+	assert.EqualError(t, err, "2 of 3 connection tests failed")
+	assert.Contains(t, buffer.String(), "api key not set", "Errors creating a client should be reported")
+	assert.Contains(t, buffer.String(), "401 Unauthorized", "Errors testing a connection should be reported")
+
+	buffer = &bytes.Buffer{}
+	err = PrintConnectionTestResults(buffer, results[:1])
+	assert.NoError(t, err, "All connection tests succeeded")
+	assert.Contains(t, buffer.String(), "https://mail.example.com")
+}
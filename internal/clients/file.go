@@ -0,0 +1,374 @@
+package clients
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// prefix of CSV columns holding user attributes like attribute:department
+const fileAttributeColumnPrefix = "attribute:"
+
+// separator of several groups, roles or attribute values in a CSV cell
+const fileValueSeparator = ";"
+
+// fields of a user in a YAML file
+var fileUserFields = []string{"username", "email", "firstName", "lastName", "enabled", "groups", "roles", "attributes"}
+
+// columns of a CSV file besides the attribute columns
+var fileCsvColumns = []string{"username", "email", "firstName", "lastName", "enabled", "groups", "roles"}
+
+// FileClient reads the users of a static YAML or CSV file. The file is read again on every load.
+type FileClient struct {
+	Options *FileClientOptions
+}
+
+type FileClientOptions struct {
+	Name   string
+	Path   string
+	Format config.FileFormat
+	// users are members of all parent groups of groups given as paths like /engineering/backend
+	InheritParentGroups bool
+}
+
+// fileUser is a user as declared in a YAML file or a CSV row
+type fileUser struct {
+	Username  string `yaml:"username"`
+	Email     string `yaml:"email"`
+	FirstName string `yaml:"firstName"`
+	LastName  string `yaml:"lastName"`
+	// defaults to true
+	Enabled    *bool               `yaml:"enabled"`
+	Groups     []string            `yaml:"groups"`
+	Roles      []string            `yaml:"roles"`
+	Attributes map[string][]string `yaml:"attributes"`
+}
+
+func NewFileClient(options *FileClientOptions) (*FileClient, error) {
+	if options.Path == "" {
+		return nil, fmt.Errorf("FileClientOptions.Path is empty")
+	}
+	if options.Format == "" {
+		options.Format = (&config.FileConfig{Path: options.Path}).GetFormat()
+	}
+	if options.Format != config.FileFormatYaml && options.Format != config.FileFormatCsv {
+		return nil, fmt.Errorf("FileClientOptions.Format '%s' is not supported", options.Format)
+	}
+	return &FileClient{Options: options}, nil
+}
+
+// TestConnection reads and validates the file
+func (c *FileClient) TestConnection() error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Reading user file '%s'", c.Options.Path)
+	_, err := c.GetBrokeUserList(context.Background())
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to read user file '%s'", c.Options.Path)
+		return err
+	}
+	return nil
+}
+
+func (c *FileClient) GetBrokeUserList(ctx context.Context) ([]*user.User, error) {
+	file, err := os.Open(c.Options.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var users []*user.User
+	if c.Options.Format == config.FileFormatCsv {
+		users, err = c.parseCsv(file)
+	} else {
+		users, err = c.parseYaml(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Read %d users from '%s'", len(users), c.Options.Path)
+	return users, nil
+}
+
+// GetPartialBrokeUserList reads all users and keeps the ones that are selected by group, role, username or attribute
+func (c *FileClient) GetPartialBrokeUserList(ctx context.Context, selection *user.MappingSet) ([]*user.User, error) {
+	users, err := c.GetBrokeUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*user.User{}
+	for _, brokeUser := range users {
+		if brokeUser.IsMappingSatisfied(selection) {
+			result = append(result, brokeUser)
+		}
+	}
+	return result, nil
+}
+
+// GetBrokeUsersByIds returns the users with the given ids, which are the usernames
+func (c *FileClient) GetBrokeUsersByIds(ctx context.Context, ids []string) ([]*user.User, error) {
+	users, err := c.GetBrokeUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*user.User{}
+	for _, brokeUser := range users {
+		if slices.Contains(ids, brokeUser.Id) {
+			result = append(result, brokeUser)
+		}
+	}
+	return result, nil
+}
+
+// fileUserCollector validates the users of a file and collects all errors with their line numbers
+type fileUserCollector struct {
+	client    *FileClient
+	users     []*user.User
+	usernames map[string]int
+	errs      []error
+}
+
+func (c *FileClient) newCollector() *fileUserCollector {
+	return &fileUserCollector{
+		client:    c,
+		users:     []*user.User{},
+		usernames: map[string]int{},
+		errs:      []error{},
+	}
+}
+
+func (u *fileUserCollector) fail(line int, format string, args ...interface{}) {
+	u.errs = append(u.errs, fmt.Errorf("%s:%d: %s", u.client.Options.Path, line, fmt.Sprintf(format, args...)))
+}
+
+func (u *fileUserCollector) add(line int, declared *fileUser) {
+	if declared.Username == "" {
+		u.fail(line, "username is empty")
+		return
+	}
+	key := strings.ToLower(declared.Username)
+	if previousLine, ok := u.usernames[key]; ok {
+		u.fail(line, "username '%s' is already declared in line %d", declared.Username, previousLine)
+		return
+	}
+	u.usernames[key] = line
+
+	if declared.Email != "" {
+		if _, err := mail.ParseAddress(declared.Email); err != nil {
+			u.fail(line, "invalid email '%s'", declared.Email)
+			return
+		}
+	}
+
+	brokeUser := &user.User{
+		Id:         declared.Username,
+		Source:     u.client.Options.Name,
+		Username:   declared.Username,
+		Email:      declared.Email,
+		FirstName:  declared.FirstName,
+		LastName:   declared.LastName,
+		Groups:     []string{},
+		GroupPaths: []string{},
+		Roles:      []string{},
+		Enabled:    declared.Enabled == nil || *declared.Enabled,
+		// addresses in the file are maintained by administrators
+		EmailVerified: declared.Email != "",
+		Attributes:    map[string][]string{},
+	}
+	for _, group := range declared.Groups {
+		if strings.HasPrefix(group, "/") {
+			brokeUser.AddGroup(group[strings.LastIndex(group, "/")+1:], group, u.client.Options.InheritParentGroups)
+		} else {
+			brokeUser.AddGroup(group, "", false)
+		}
+	}
+	for _, role := range declared.Roles {
+		if !slices.Contains(brokeUser.Roles, role) {
+			brokeUser.Roles = append(brokeUser.Roles, role)
+		}
+	}
+	for name, values := range declared.Attributes {
+		brokeUser.Attributes[name] = values
+	}
+
+	u.users = append(u.users, brokeUser)
+}
+
+func (u *fileUserCollector) result() ([]*user.User, error) {
+	if len(u.errs) > 0 {
+		return nil, errors.Join(u.errs...)
+	}
+	return u.users, nil
+}
+
+// parseYaml reads a document with a list of users under the key users
+func (c *FileClient) parseYaml(reader io.Reader) ([]*user.User, error) {
+	document := &yaml.Node{}
+	err := yaml.NewDecoder(reader).Decode(document)
+	if errors.Is(err, io.EOF) {
+		return []*user.User{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Options.Path, err)
+	}
+
+	collector := c.newCollector()
+	root := document
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		collector.fail(root.Line, "expected a mapping with the key users")
+		return collector.result()
+	}
+
+	var usersNode *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "users" {
+			usersNode = root.Content[i+1]
+		} else {
+			collector.fail(root.Content[i].Line, "unknown key '%s'", root.Content[i].Value)
+		}
+	}
+	if usersNode == nil {
+		return collector.result()
+	}
+	if usersNode.Kind != yaml.SequenceNode {
+		collector.fail(usersNode.Line, "users must be a list")
+		return collector.result()
+	}
+
+	for _, userNode := range usersNode.Content {
+		if userNode.Kind != yaml.MappingNode {
+			collector.fail(userNode.Line, "user must be a mapping")
+			continue
+		}
+
+		valid := true
+		for i := 0; i+1 < len(userNode.Content); i += 2 {
+			if !slices.Contains(fileUserFields, userNode.Content[i].Value) {
+				collector.fail(userNode.Content[i].Line, "unknown user field '%s'", userNode.Content[i].Value)
+				valid = false
+			}
+		}
+
+		declared := &fileUser{}
+		err := userNode.Decode(declared)
+		if err != nil {
+			collector.fail(userNode.Line, "%s", err.Error())
+			continue
+		}
+		if valid {
+			collector.add(userNode.Line, declared)
+		}
+	}
+
+	return collector.result()
+}
+
+// parseCsv reads a header row naming the columns followed by one user per row. Groups, roles and attribute values
+// are separated by semicolons. Attributes are read from columns named like attribute:department.
+func (c *FileClient) parseCsv(reader io.Reader) ([]*user.User, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+	csvReader.Comment = '#'
+
+	header, err := csvReader.Read()
+	if errors.Is(err, io.EOF) {
+		return []*user.User{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Options.Path, err)
+	}
+
+	collector := c.newCollector()
+	headerLine, _ := csvReader.FieldPos(0)
+	for _, column := range header {
+		if !strings.HasPrefix(column, fileAttributeColumnPrefix) && !slices.Contains(fileCsvColumns, column) {
+			collector.fail(headerLine, "unknown column '%s'", column)
+		}
+	}
+	if !slices.Contains(header, "username") {
+		collector.fail(headerLine, "column 'username' is missing")
+	}
+	if len(collector.errs) > 0 {
+		return collector.result()
+	}
+
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// the error of the csv package already contains the line
+			collector.errs = append(collector.errs, fmt.Errorf("%s: %w", c.Options.Path, err))
+			break
+		}
+		line, _ := csvReader.FieldPos(0)
+
+		declared := &fileUser{Attributes: map[string][]string{}}
+		valid := true
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch {
+			case column == "username":
+				declared.Username = value
+			case column == "email":
+				declared.Email = value
+			case column == "firstName":
+				declared.FirstName = value
+			case column == "lastName":
+				declared.LastName = value
+			case column == "enabled":
+				if value == "" {
+					continue
+				}
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					collector.fail(line, "invalid value '%s' of column enabled", value)
+					valid = false
+					continue
+				}
+				declared.Enabled = &enabled
+			case column == "groups":
+				declared.Groups = splitFileValues(value)
+			case column == "roles":
+				declared.Roles = splitFileValues(value)
+			default:
+				if values := splitFileValues(value); len(values) > 0 {
+					declared.Attributes[strings.TrimPrefix(column, fileAttributeColumnPrefix)] = values
+				}
+			}
+		}
+		if valid {
+			collector.add(line, declared)
+		}
+	}
+
+	return collector.result()
+}
+
+func splitFileValues(value string) []string {
+	values := []string{}
+	for _, part := range strings.Split(value, fileValueSeparator) {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
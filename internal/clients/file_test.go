@@ -0,0 +1,95 @@
+package clients
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeUserFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestFileClientYaml(t *testing.T) {
+	path := writeUserFile(t, "users.yml", `users:
+  - username: alice
+    email: alice@example.com
+    firstName: Alice
+    groups: [developers, /engineering/backend]
+    roles: [admin]
+    attributes:
+      department: [sales]
+  - username: bob
+    enabled: false
+`)
+	client, err := NewFileClient(&FileClientOptions{Name: "contractors", Path: path, InheritParentGroups: true})
+	assert.NoError(t, err)
+
+	users, err := client.GetBrokeUserList(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	alice := users[0]
+	assert.Equal(t, "alice", alice.Id)
+	assert.Equal(t, "contractors", alice.Source)
+	assert.True(t, alice.Enabled, "Users should be enabled by default")
+	assert.True(t, alice.EmailVerified)
+	assert.True(t, alice.HasGroup("developers"))
+	assert.True(t, alice.HasGroup("/engineering/backend"))
+	assert.True(t, alice.HasGroup("/engineering"), "Parent groups of paths should be inherited")
+	assert.True(t, alice.HasRole("admin"))
+	assert.True(t, alice.HasAttribute("department", "sales"))
+	assert.False(t, users[1].Enabled)
+}
+
+func TestFileClientYamlValidation(t *testing.T) {
+	path := writeUserFile(t, "users.yml", `users:
+  - username: alice
+    email: not-an-email
+  - email: bob@example.com
+  - username: Carol
+  - username: carol
+    team: backend
+`)
+	client, err := NewFileClient(&FileClientOptions{Name: "contractors", Path: path})
+	assert.NoError(t, err)
+
+	_, err = client.GetBrokeUserList(context.Background())
+	assert.ErrorContains(t, err, path+":2: invalid email 'not-an-email'")
+	assert.ErrorContains(t, err, path+":4: username is empty")
+	assert.ErrorContains(t, err, path+":7: unknown user field 'team'")
+}
+
+func TestFileClientCsv(t *testing.T) {
+	path := writeUserFile(t, "users.csv", `username,email,groups,roles,enabled,attribute:department
+# contractors
+alice,alice@example.com,developers;designers,,,sales
+bob,bob@example.com,,admin,false,
+`)
+	client, err := NewFileClient(&FileClientOptions{Name: "contractors", Path: path})
+	assert.NoError(t, err)
+
+	users, err := client.GetBrokeUserList(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, []string{"developers", "designers"}, users[0].Groups)
+	assert.True(t, users[0].HasAttribute("department", "sales"))
+	assert.True(t, users[1].HasRole("admin"))
+	assert.False(t, users[1].Enabled)
+
+	path = writeUserFile(t, "invalid.csv", `username,email,enabled
+alice,alice@example.com,yes please
+alice,alice@example.org,
+`)
+	client, err = NewFileClient(&FileClientOptions{Name: "contractors", Path: path})
+	assert.NoError(t, err)
+
+	_, err = client.GetBrokeUserList(context.Background())
+	assert.ErrorContains(t, err, path+":2: invalid value 'yes please' of column enabled")
+	assert.NotContains(t, err.Error(), ":3:", "A user with an invalid row should not count as declared")
+}
@@ -2,7 +2,10 @@ package clients
 
 import (
 	"fmt"
+	"net/http"
+	"sync"
 
+	"github.com/mxcd/broke/pkg/config"
 	"github.com/rs/zerolog/log"
 	"github.com/xanzy/go-gitlab"
 )
@@ -10,32 +13,59 @@ import (
 type GitLabClient struct {
 	Client  *gitlab.Client
 	Options *GitLabClientOptions
+
+	cacheMutex       *sync.Mutex
+	groupCache       map[string]*gitlab.Group
+	groupMemberCache map[int][]*gitlab.GroupMember
+	currentUsername  string
 }
 
 type GitLabClientOptions struct {
 	Name  string `yaml:"name"`
 	Url   string `yaml:"url"`
 	Token string `yaml:"token"`
+	// retries, rate limiting and timeouts of the http client. Defaults apply if nil
+	Http *HttpClientOptions `yaml:"-"`
 }
 
-var AccessToValueMap = map[string]gitlab.AccessLevelValue{
-	"Guest":      gitlab.GuestPermissions,
-	"Reporter":   gitlab.ReporterPermissions,
-	"Developer":  gitlab.DeveloperPermissions,
-	"Maintainer": gitlab.MaintainerPermissions,
-	"Owner":      gitlab.OwnerPermissions,
+var AccessToValueMap = map[config.GitlabGroupPermission]gitlab.AccessLevelValue{
+	config.GitlabGroupPermissionGuest:      gitlab.GuestPermissions,
+	config.GitlabGroupPermissionReporter:   gitlab.ReporterPermissions,
+	config.GitlabGroupPermissionDeveloper:  gitlab.DeveloperPermissions,
+	config.GitlabGroupPermissionMaintainer: gitlab.MaintainerPermissions,
+	config.GitlabGroupPermissionOwner:      gitlab.OwnerPermissions,
 }
 
 func NewGitLabClient(config *GitLabClientOptions) (*GitLabClient, error) {
-	gitlabApiClient, err := gitlab.NewClient(config.Token, gitlab.WithBaseURL(config.Url))
+	if config.Http == nil {
+		config.Http = &HttpClientOptions{}
+	}
+
+	// go-gitlab brings its own retries and rate limiting, so they are configured there instead of in the http client
+	clientOptions := []gitlab.ClientOptionFunc{
+		gitlab.WithBaseURL(config.Url),
+		gitlab.WithHTTPClient(NewHttpClientWithoutRetries(config.Http)),
+		gitlab.WithCustomRetryMax(config.Http.MaxRetries),
+	}
+	if config.Http.RetryWaitMin > 0 && config.Http.RetryWaitMax > 0 {
+		clientOptions = append(clientOptions, gitlab.WithCustomRetryWaitMinMax(config.Http.RetryWaitMin, config.Http.RetryWaitMax))
+	}
+	if limiter := config.Http.NewRateLimiter(); limiter != nil {
+		clientOptions = append(clientOptions, gitlab.WithCustomLimiter(limiter))
+	}
+
+	gitlabApiClient, err := gitlab.NewClient(config.Token, clientOptions...)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create client")
 		return nil, err
 	}
 
 	return &GitLabClient{
-		Client:  gitlabApiClient,
-		Options: config,
+		Client:           gitlabApiClient,
+		Options:          config,
+		cacheMutex:       &sync.Mutex{},
+		groupCache:       map[string]*gitlab.Group{},
+		groupMemberCache: map[int][]*gitlab.GroupMember{},
 	}, nil
 }
 
@@ -50,35 +80,60 @@ func (c *GitLabClient) TestConnection() error {
 	return nil
 }
 
-func (c *GitLabClient) getUserIdByName(username *string) (*int, error) {
-	users, res, err := c.Client.Users.ListUsers(&gitlab.ListUsersOptions{Username: username})
+// GetAccessLevelValue translates a configured group permission into the GitLab access level.
+func GetAccessLevelValue(permission config.GitlabGroupPermission) (gitlab.AccessLevelValue, error) {
+	gitlabAccessValue, ok := AccessToValueMap[permission]
+	if !ok {
+		errorMessage := fmt.Sprintf("Invalid permission %s", permission)
+		log.Error().Msg(errorMessage)
+		return gitlab.NoPermissions, fmt.Errorf(errorMessage)
+	}
+	return gitlabAccessValue, nil
+}
+
+// GetUserByName returns the GitLab user with the given username or nil if there is none.
+func (c *GitLabClient) GetUserByName(username string) (*gitlab.User, error) {
+	users, _, err := c.Client.Users.ListUsers(&gitlab.ListUsersOptions{Username: &username})
 	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to look up GitLab user %s", username)
 		return nil, err
 	}
 
-	if res.TotalItems == 0 {
-		errorMessage := fmt.Sprintf("User %s not found", *username)
-		log.Error().Msg(errorMessage)
-		return nil, fmt.Errorf(errorMessage)
-	} else if res.TotalItems > 1 {
-		errorMessage := fmt.Sprintf("Found more than one user with username %s", *username)
+	if len(users) == 0 {
+		return nil, nil
+	} else if len(users) > 1 {
+		errorMessage := fmt.Sprintf("Found more than one user with username %s", username)
 		log.Error().Msg(errorMessage)
 		return nil, fmt.Errorf(errorMessage)
 	}
 
-	return &users[0].ID, nil
+	return users[0], nil
 }
 
-func (c *GitLabClient) addUserToGroup(userId *int, groupId int, permissions string) error {
-	gitlabAccessValue, ok := AccessToValueMap[permissions]
-	if !ok {
-		errorMessage := fmt.Sprintf("Invalid permission %s", permissions)
+// GetUserIdByName returns the id of the GitLab user with the given username or an error if there is none.
+func (c *GitLabClient) GetUserIdByName(username string) (int, error) {
+	gitlabUser, err := c.GetUserByName(username)
+	if err != nil {
+		return 0, err
+	}
+
+	if gitlabUser == nil {
+		errorMessage := fmt.Sprintf("User %s not found", username)
 		log.Error().Msg(errorMessage)
-		return fmt.Errorf(errorMessage)
+		return 0, fmt.Errorf(errorMessage)
+	}
+
+	return gitlabUser.ID, nil
+}
+
+func (c *GitLabClient) AddUserToGroup(userId int, groupId int, permission config.GitlabGroupPermission) error {
+	gitlabAccessValue, err := GetAccessLevelValue(permission)
+	if err != nil {
+		return err
 	}
 
-	_, _, err := c.Client.GroupMembers.AddGroupMember(groupId, &gitlab.AddGroupMemberOptions{
-		UserID:      userId,
+	_, _, err = c.Client.GroupMembers.AddGroupMember(groupId, &gitlab.AddGroupMemberOptions{
+		UserID:      &userId,
 		AccessLevel: &gitlabAccessValue,
 	})
 
@@ -90,21 +145,179 @@ func (c *GitLabClient) addUserToGroup(userId *int, groupId int, permissions stri
 	return nil
 }
 
-func (c *GitLabClient) getGroupIdByName(groupName string) (*int, error) {
-	groups, r, err := c.Client.Groups.ListGroups(&gitlab.ListGroupsOptions{Search: &groupName})
+func (c *GitLabClient) UpdateGroupMember(userId int, groupId int, permission config.GitlabGroupPermission) error {
+	gitlabAccessValue, err := GetAccessLevelValue(permission)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.Client.GroupMembers.EditGroupMember(groupId, userId, &gitlab.EditGroupMemberOptions{
+		AccessLevel: &gitlabAccessValue,
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update group member")
+		return err
+	}
+
+	return nil
+}
+
+// GetGroupMembers loads all direct members of the group. The result is cached on the client until ClearCache is called.
+func (c *GitLabClient) GetGroupMembers(groupId int) ([]*gitlab.GroupMember, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if members, ok := c.groupMemberCache[groupId]; ok {
+		return members, nil
+	}
+
+	result := []*gitlab.GroupMember{}
+	options := &gitlab.ListGroupMembersOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100, Page: 1},
+	}
+	for {
+		members, response, err := c.Client.Groups.ListGroupMembers(groupId, options)
+		if err != nil {
+			log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to list members of group %d", groupId)
+			return nil, err
+		}
+		result = append(result, members...)
+
+		if response.NextPage == 0 {
+			break
+		}
+		options.Page = response.NextPage
+	}
+
+	c.groupMemberCache[groupId] = result
+	return result, nil
+}
+
+// GetGroupMember returns the direct membership of the user in the group or nil if the user is not a member.
+func (c *GitLabClient) GetGroupMember(groupId int, userId int) (*gitlab.GroupMember, error) {
+	members, err := c.GetGroupMembers(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		if member.ID == userId {
+			return member, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *GitLabClient) RemoveUserFromGroup(userId int, groupId int) error {
+	_, err := c.Client.GroupMembers.RemoveGroupMember(groupId, userId, &gitlab.RemoveGroupMemberOptions{})
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to remove user %d from group %d", userId, groupId)
+		return err
+	}
+	return nil
+}
+
+func (c *GitLabClient) BlockUser(userId int) error {
+	err := c.Client.Users.BlockUser(userId)
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to block user %d", userId)
+		return err
+	}
+	return nil
+}
+
+// GetCurrentUsername returns the username of the user the api token belongs to.
+func (c *GitLabClient) GetCurrentUsername() (string, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if c.currentUsername != "" {
+		return c.currentUsername, nil
+	}
+
+	currentUser, _, err := c.Client.Users.CurrentUser()
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msg("Failed to get current GitLab user")
+		return "", err
+	}
+
+	c.currentUsername = currentUser.Username
+	return c.currentUsername, nil
+}
+
+func (c *GitLabClient) SetAdmin(userId int, admin bool) error {
+	_, _, err := c.Client.Users.ModifyUser(userId, &gitlab.ModifyUserOptions{
+		Admin: &admin,
+	})
 	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to set admin flag of user %d to %t", userId, admin)
+		return err
+	}
+	return nil
+}
+
+// GetGroupByName resolves a group by its full path (e.g. 'engineering/backend') or, if there is no such path, by its exact name.
+// Resolved groups are cached on the client until ClearCache is called.
+func (c *GitLabClient) GetGroupByName(groupName string) (*gitlab.Group, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if group, ok := c.groupCache[groupName]; ok {
+		return group, nil
+	}
+
+	group, response, err := c.Client.Groups.GetGroup(groupName, &gitlab.GetGroupOptions{WithProjects: gitlab.Ptr(false)})
+	if err != nil && (response == nil || response.StatusCode != http.StatusNotFound) {
 		return nil, err
 	}
 
-	if r.TotalItems == 0 {
+	if group == nil || err != nil {
+		// the search also matches names containing the group name, so there may be several pages of candidates
+		options := &gitlab.ListGroupsOptions{
+			ListOptions: gitlab.ListOptions{PerPage: 100, Page: 1},
+			Search:      &groupName,
+		}
+		for {
+			groups, response, err := c.Client.Groups.ListGroups(options)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, candidate := range groups {
+				if candidate.Name != groupName {
+					continue
+				}
+				if group != nil {
+					errorMessage := fmt.Sprintf("Found more than one group with name %s", groupName)
+					log.Error().Msg(errorMessage)
+					return nil, fmt.Errorf(errorMessage)
+				}
+				group = candidate
+			}
+
+			if response.NextPage == 0 {
+				break
+			}
+			options.Page = response.NextPage
+		}
+	}
+
+	if group == nil {
 		errorMessage := fmt.Sprintf("Group %s not found", groupName)
 		log.Error().Msg(errorMessage)
 		return nil, fmt.Errorf(errorMessage)
-	} else if r.TotalItems > 1 {
-		errorMessage := fmt.Sprintf("Found more than one group with name %s", groupName)
-		log.Error().Msg(errorMessage)
-		return nil, fmt.Errorf(errorMessage)
 	}
 
-	return &groups[0].ID, nil
+	c.groupCache[groupName] = group
+	return group, nil
+}
+
+// ClearCache drops all resolved groups and group members so that the next call reloads them from GitLab.
+func (c *GitLabClient) ClearCache() {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	c.groupCache = map[string]*gitlab.Group{}
+	c.groupMemberCache = map[int][]*gitlab.GroupMember{}
 }
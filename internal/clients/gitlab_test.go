@@ -0,0 +1,44 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGroupByNameSearchesAllPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/groups/developers":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"404 Group Not Found"}`))
+		case "/api/v4/groups":
+			assert.Equal(t, "developers", r.URL.Query().Get("search"))
+			// groups whose names only contain the searched name come first
+			groups := []map[string]interface{}{}
+			if r.URL.Query().Get("page") == "2" {
+				groups = append(groups, map[string]interface{}{"id": 42, "name": "developers", "full_path": "engineering/developers"})
+			} else {
+				for i := 0; i < 100; i++ {
+					groups = append(groups, map[string]interface{}{"id": i, "name": fmt.Sprintf("developers-%d", i)})
+				}
+				w.Header().Set("X-Next-Page", "2")
+			}
+			json.NewEncoder(w).Encode(groups)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGitLabClient(&GitLabClientOptions{Name: "git", Url: server.URL, Token: "token"})
+	assert.NoError(t, err)
+
+	group, err := client.GetGroupByName("developers")
+	assert.NoError(t, err)
+	assert.Equal(t, 42, group.ID, "Groups on later pages of the search should be found")
+}
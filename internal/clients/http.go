@@ -3,6 +3,7 @@ package clients
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 
@@ -37,6 +38,7 @@ type ApiClient interface {
 	GetBaseUrl() string
 	GetAuthorizationType() AuthorizationType
 	GetAuthorization() string
+	GetHttpClient() *http.Client
 }
 
 func DoHttpRequest(client ApiClient, options *HttpRequestOptions) (*http.Response, error) {
@@ -78,7 +80,7 @@ func DoHttpRequest(client ApiClient, options *HttpRequestOptions) (*http.Respons
 		request.Header.Set("Authorization", "Bearer "+authorization)
 	}
 
-	clientInstance := &http.Client{}
+	clientInstance := client.GetHttpClient()
 	response, err := clientInstance.Do(request)
 	if err != nil {
 		log.Error().Err(err).Str("client", client.GetName()).Msgf("Failed to send request")
@@ -86,8 +88,9 @@ func DoHttpRequest(client ApiClient, options *HttpRequestOptions) (*http.Respons
 	}
 
 	if response.StatusCode != expectedStatusCode {
+		response.Body.Close()
 		log.Error().Str("client", client.GetName()).Msgf("Request failed with status %s. %d was expected", response.Status, expectedStatusCode)
-		return nil, err
+		return nil, fmt.Errorf("request %s %s failed with status %s. %d was expected", method, requestUrl, response.Status, expectedStatusCode)
 	}
 
 	return response, nil
@@ -100,6 +103,8 @@ func DoHttpRequestWithResult[T any](client ApiClient, options *HttpRequestOption
 		return nil, err
 	}
 
+	defer response.Body.Close()
+
 	err = json.NewDecoder(response.Body).Decode(result)
 	if err != nil {
 		log.Error().Err(err).Str("client", client.GetName()).Msgf("Failed to decode response body")
@@ -3,31 +3,63 @@ package clients
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/mxcd/broke/internal/user"
 	"github.com/mxcd/broke/internal/util"
+	"github.com/mxcd/broke/pkg/config"
 	progressbar "github.com/schollz/progressbar/v3"
 
 	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/rs/zerolog/log"
 )
 
 type KeycloakClient struct {
 	Client  *gocloak.GoCloak
-	Token   *gocloak.JWT
 	Realm   string
 	Options *KeycloakClientOptions
+	tokens  *keycloakTokenManager
+	// client ID -> internal id of the client
+	clientIds      map[string]string
+	clientIdsMutex *sync.Mutex
 }
 
 type KeycloakClientOptions struct {
-	Name     string `yaml:"name"`
-	Url      string `yaml:"url"`
-	Realm    string `yaml:"realm"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Insecure *bool  `yaml:"insecure,omitempty"`
+	Name  string `yaml:"name"`
+	Url   string `yaml:"url"`
+	Realm string `yaml:"realm"`
+	// realms the users are loaded from, see RealmClients. Defaults to Realm
+	Realms []string `yaml:"realms"`
+	// realm the credentials belong to. Defaults to Realm
+	AuthRealm string                  `yaml:"authRealm"`
+	AuthType  config.KeycloakAuthType `yaml:"authType"`
+	Username  string                  `yaml:"username"`
+	Password  string                  `yaml:"password"`
+	ClientId  string                  `yaml:"clientId"`
+	// used with config.KeycloakAuthTypeClientCredentials
+	ClientSecret string `yaml:"clientSecret"`
+	// used with config.KeycloakAuthTypeClientJwt
+	ClientPrivateKey    interface{}       `yaml:"-"`
+	ClientSigningMethod jwt.SigningMethod `yaml:"-"`
+	Insecure            *bool             `yaml:"insecure,omitempty"`
+	// users are members of all parent groups of their groups
+	InheritParentGroups bool `yaml:"inheritParentGroups"`
+	// client IDs whose effective roles are loaded for every user as client:role
+	ClientRoleClients []string `yaml:"clientRoleClients"`
+}
+
+func (o *KeycloakClientOptions) getAuthRealm() string {
+	if o.AuthRealm != "" {
+		return o.AuthRealm
+	}
+	return o.Realm
 }
 
 func NewKeycloakClient(ctx context.Context, options *KeycloakClientOptions) (*KeycloakClient, error) {
@@ -40,11 +72,39 @@ func NewKeycloakClient(ctx context.Context, options *KeycloakClientOptions) (*Ke
 	if options.Realm == "" {
 		return nil, fmt.Errorf("KeycloakClientConfig.Realm is empty")
 	}
-	if options.Username == "" {
-		return nil, fmt.Errorf("KeycloakClientConfig.Username is empty")
+	if len(options.Realms) == 0 {
+		options.Realms = []string{options.Realm}
 	}
-	if options.Password == "" {
-		return nil, fmt.Errorf("KeycloakClientConfig.Password is empty")
+	if options.AuthType == "" {
+		options.AuthType = config.KeycloakAuthTypePassword
+	}
+	switch options.AuthType {
+	case config.KeycloakAuthTypePassword:
+		if options.Username == "" {
+			return nil, fmt.Errorf("KeycloakClientConfig.Username is empty")
+		}
+		if options.Password == "" {
+			return nil, fmt.Errorf("KeycloakClientConfig.Password is empty")
+		}
+	case config.KeycloakAuthTypeClientCredentials:
+		if options.ClientId == "" {
+			return nil, fmt.Errorf("KeycloakClientConfig.ClientId is empty")
+		}
+		if options.ClientSecret == "" {
+			return nil, fmt.Errorf("KeycloakClientConfig.ClientSecret is empty")
+		}
+	case config.KeycloakAuthTypeClientJwt:
+		if options.ClientId == "" {
+			return nil, fmt.Errorf("KeycloakClientConfig.ClientId is empty")
+		}
+		if options.ClientPrivateKey == nil {
+			return nil, fmt.Errorf("KeycloakClientConfig.ClientPrivateKey is empty")
+		}
+		if options.ClientSigningMethod == nil {
+			options.ClientSigningMethod = jwt.SigningMethodRS256
+		}
+	default:
+		return nil, fmt.Errorf("KeycloakClientConfig.AuthType '%s' is not supported", options.AuthType)
 	}
 	if options.Insecure == nil {
 		insecure := false
@@ -58,25 +118,57 @@ func NewKeycloakClient(ctx context.Context, options *KeycloakClientOptions) (*Ke
 		restyClient.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
 	}
 
-	token, err := client.LoginAdmin(ctx, options.Username, options.Password, options.Realm)
+	tokens, err := newKeycloakTokenManager(ctx, client, options)
 	if err != nil {
 		return nil, err
 	}
 
 	return &KeycloakClient{
 		Client:  client,
-		Token:   token,
 		Realm:   options.Realm,
 		Options: options,
+		tokens:  tokens,
+
+		clientIds:      map[string]string{},
+		clientIdsMutex: &sync.Mutex{},
 	}, nil
 }
 
+// ForRealm returns a client for another realm of the same server. It shares the connection and the token of this client.
+func (k *KeycloakClient) ForRealm(realm string) *KeycloakClient {
+	return &KeycloakClient{
+		Client:  k.Client,
+		Realm:   realm,
+		Options: k.Options,
+		tokens:  k.tokens,
+
+		clientIds:      map[string]string{},
+		clientIdsMutex: &sync.Mutex{},
+	}
+}
+
+// RealmClients returns a client for each realm the users are loaded from
+func (k *KeycloakClient) RealmClients() []*KeycloakClient {
+	realmClients := []*KeycloakClient{}
+	for _, realm := range k.Options.Realms {
+		if realm == k.Realm {
+			realmClients = append(realmClients, k)
+			continue
+		}
+		realmClients = append(realmClients, k.ForRealm(realm))
+	}
+	return realmClients
+}
+
 func (c *KeycloakClient) TestConnection() error {
 	log.Debug().Str("client", c.Options.Name).Msgf("Testing connection to Keycloak API at '%s'", c.Options.Url)
-	_, err := c.Client.GetServerInfo(context.Background(), c.Token.AccessToken)
-	if err != nil {
-		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to test Keycloak API connection for user source at '%s'", c.Options.Url)
-		return err
+	// counting users only needs the view-users role, unlike the server info which a least-privilege service account cannot read
+	for _, realmClient := range c.RealmClients() {
+		_, err := realmClient.GetUsersCount(context.Background())
+		if err != nil {
+			log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to test Keycloak API connection for realm '%s' of user source at '%s'", realmClient.Realm, c.Options.Url)
+			return err
+		}
 	}
 
 	log.Debug().Str("client", c.Options.Name).Msgf("Successfully connected to Keycloak API at '%s'", c.Options.Url)
@@ -84,7 +176,11 @@ func (c *KeycloakClient) TestConnection() error {
 }
 
 func (k *KeycloakClient) GetUsersCount(ctx context.Context) (int, error) {
-	return k.Client.GetUserCount(ctx, k.Token.AccessToken, k.Realm, gocloak.GetUsersParams{})
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return k.Client.GetUserCount(ctx, accessToken, k.Realm, gocloak.GetUsersParams{})
 }
 
 func (k *KeycloakClient) GetUsers(ctx context.Context) ([]*gocloak.User, error) {
@@ -97,7 +193,11 @@ func (k *KeycloakClient) GetUsers(ctx context.Context) ([]*gocloak.User, error)
 	result := []*gocloak.User{}
 	currentUserCount := len(result)
 	for {
-		users, err := k.Client.GetUsers(ctx, k.Token.AccessToken, k.Realm, gocloak.GetUsersParams{
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		users, err := k.Client.GetUsers(ctx, accessToken, k.Realm, gocloak.GetUsersParams{
 			Max:   &pageSize,
 			First: &currentUserCount,
 		})
@@ -117,7 +217,11 @@ func (k *KeycloakClient) GetUsers(ctx context.Context) ([]*gocloak.User, error)
 }
 
 func (k *KeycloakClient) GetGroupsCount(ctx context.Context) (int, error) {
-	return k.Client.GetGroupsCount(ctx, k.Token.AccessToken, k.Realm, gocloak.GetGroupsParams{})
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return k.Client.GetGroupsCount(ctx, accessToken, k.Realm, gocloak.GetGroupsParams{})
 }
 
 func (k *KeycloakClient) GetGroups(ctx context.Context) ([]*gocloak.Group, error) {
@@ -130,7 +234,11 @@ func (k *KeycloakClient) GetGroups(ctx context.Context) ([]*gocloak.Group, error
 	result := make([]*gocloak.Group, 0, groupsCount)
 	currentGroupCount := len(result)
 	for {
-		groups, err := k.Client.GetGroups(ctx, k.Token.AccessToken, k.Realm, gocloak.GetGroupsParams{
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := k.Client.GetGroups(ctx, accessToken, k.Realm, gocloak.GetGroupsParams{
 			Max:   &pageSize,
 			First: &currentGroupCount,
 		})
@@ -150,23 +258,344 @@ func (k *KeycloakClient) GetGroups(ctx context.Context) ([]*gocloak.Group, error
 }
 
 func (k *KeycloakClient) GetGroup(ctx context.Context, id string) (*gocloak.Group, error) {
-	return k.Client.GetGroup(ctx, k.Token.AccessToken, k.Realm, id)
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return k.Client.GetGroup(ctx, accessToken, k.Realm, id)
 }
 
 func (k *KeycloakClient) GetGroupUsers(ctx context.Context, id string) ([]*gocloak.User, error) {
-	return k.Client.GetGroupMembers(ctx, k.Token.AccessToken, k.Realm, id, gocloak.GetGroupsParams{})
+	pageSize := 100
+	result := []*gocloak.User{}
+	for {
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		first := len(result)
+		users, err := k.Client.GetGroupMembers(ctx, accessToken, k.Realm, id, gocloak.GetGroupsParams{
+			Max:   &pageSize,
+			First: &first,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("client", k.Options.Name).Msgf("error getting members of group %s", id)
+			return nil, err
+		}
+		result = append(result, users...)
+
+		if len(users) < pageSize {
+			return result, nil
+		}
+	}
 }
 
+// GetRoleUsers returns the users that have the realm role or the client role given as client:role,
+// either directly or through one of their groups. Users having the role only through a composite role are not included.
 func (k *KeycloakClient) GetRoleUsers(ctx context.Context, name string) ([]*gocloak.User, error) {
-	return k.Client.GetUsersByRoleName(ctx, k.Token.AccessToken, k.Realm, name, gocloak.GetUsersByRoleParams{})
+	clientId, roleName := config.SplitClientRole(name)
+	idOfClient := ""
+	if clientId != "" {
+		var err error
+		idOfClient, err = k.getIdOfClient(ctx, clientId)
+		if err != nil {
+			return nil, err
+		}
+		if idOfClient == "" {
+			return []*gocloak.User{}, nil
+		}
+	}
+
+	pageSize := 100
+	result := []*gocloak.User{}
+	for {
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		first := len(result)
+		params := gocloak.GetUsersByRoleParams{
+			Max:   &pageSize,
+			First: &first,
+		}
+		var users []*gocloak.User
+		if idOfClient != "" {
+			users, err = k.Client.GetUsersByClientRoleName(ctx, accessToken, k.Realm, idOfClient, roleName, params)
+		} else {
+			users, err = k.Client.GetUsersByRoleName(ctx, accessToken, k.Realm, roleName, params)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("client", k.Options.Name).Msgf("error getting users with role %s", name)
+			return nil, err
+		}
+		result = append(result, users...)
+
+		if len(users) < pageSize {
+			break
+		}
+	}
+
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*gocloak.Group
+	if idOfClient != "" {
+		groups, err = k.Client.GetGroupsByClientRole(ctx, accessToken, k.Realm, roleName, idOfClient)
+	} else {
+		groups, err = k.Client.GetGroupsByRole(ctx, accessToken, k.Realm, roleName)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("client", k.Options.Name).Msgf("error getting groups with role %s", name)
+		return nil, err
+	}
+	for _, group := range groups {
+		groupIds := []string{*group.ID}
+		// roles of a group are inherited by its subgroups
+		children, err := k.getDescendantGroupIds(ctx, *group.ID)
+		if err != nil {
+			return nil, err
+		}
+		groupIds = append(groupIds, children...)
+
+		for _, groupId := range groupIds {
+			users, err := k.GetGroupUsers(ctx, groupId)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, users...)
+		}
+	}
+	return result, nil
+}
+
+// GetUsersByAttribute returns all users having the value in the attribute. The search query of Keycloak separates
+// terms by spaces and names from values by colons, so names and values containing them cannot be searched.
+func (k *KeycloakClient) GetUsersByAttribute(ctx context.Context, name string, value string) ([]*gocloak.User, error) {
+	if strings.ContainsAny(name, ": \t\n") || strings.ContainsAny(value, ": \t\n") {
+		return nil, fmt.Errorf("cannot search Keycloak users by attribute %s with value '%s': spaces and colons are not supported, use a full load instead", name, value)
+	}
+	pageSize := 100
+	query := name + ":" + value
+	result := []*gocloak.User{}
+	for {
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		first := len(result)
+		users, err := k.Client.GetUsers(ctx, accessToken, k.Realm, gocloak.GetUsersParams{
+			Q:     &query,
+			Max:   &pageSize,
+			First: &first,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("client", k.Options.Name).Msgf("error getting users with attribute %s", query)
+			return nil, err
+		}
+		result = append(result, users...)
+
+		if len(users) < pageSize {
+			return result, nil
+		}
+	}
+}
+
+// GetUserByUsername returns the user with exactly the given username or nil if there is none
+func (k *KeycloakClient) GetUserByUsername(ctx context.Context, username string) (*gocloak.User, error) {
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users, err := k.Client.GetUsers(ctx, accessToken, k.Realm, gocloak.GetUsersParams{
+		Username: &username,
+		Exact:    gocloak.BoolP(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return users[0], nil
+}
+
+// GetGroupByPath returns the group with the full path like /engineering/backend or nil if there is none
+func (k *KeycloakClient) GetGroupByPath(ctx context.Context, path string) (*gocloak.Group, error) {
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group, err := k.Client.GetGroupByPath(ctx, accessToken, k.Realm, path)
+	if err != nil {
+		var apiError *gocloak.APIError
+		if errors.As(err, &apiError) && apiError.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return group, nil
+}
+
+// GetChildGroups returns the direct subgroups of a group. Keycloak before version 23 includes them in the group itself,
+// newer versions only list them on the children endpoint.
+func (k *KeycloakClient) GetChildGroups(ctx context.Context, id string) ([]gocloak.Group, error) {
+	group, err := k.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if group.SubGroups != nil && len(*group.SubGroups) > 0 {
+		return *group.SubGroups, nil
+	}
+
+	// the children endpoint pages its results, by default only 10 per page
+	pageSize := 100
+	result := []gocloak.Group{}
+	for {
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		children := []gocloak.Group{}
+		response, err := k.Client.RestyClient().R().
+			SetContext(ctx).
+			SetAuthToken(accessToken).
+			SetQueryParam("briefRepresentation", "true").
+			SetQueryParam("first", strconv.Itoa(len(result))).
+			SetQueryParam("max", strconv.Itoa(pageSize)).
+			SetResult(&children).
+			Get(fmt.Sprintf("%s/admin/realms/%s/groups/%s/children", strings.TrimRight(k.Options.Url, "/"), k.Realm, id))
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode() == http.StatusNotFound || response.StatusCode() == http.StatusMethodNotAllowed {
+			return []gocloak.Group{}, nil
+		}
+		if response.IsError() {
+			return nil, fmt.Errorf("error getting child groups of group %s: %s", id, response.Status())
+		}
+		result = append(result, children...)
+
+		if len(children) < pageSize {
+			return result, nil
+		}
+	}
+}
+
+// GetGroupIdsByName finds the ids of all groups with the given name, including subgroups
+func (k *KeycloakClient) GetGroupIdsByName(ctx context.Context, name string) ([]string, error) {
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := k.Client.GetGroups(ctx, accessToken, k.Realm, gocloak.GetGroupsParams{
+		Search: &name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	var collect func(groups []gocloak.Group)
+	collect = func(groups []gocloak.Group) {
+		for _, group := range groups {
+			if group.Name != nil && *group.Name == name {
+				ids = append(ids, *group.ID)
+			}
+			if group.SubGroups != nil {
+				collect(*group.SubGroups)
+			}
+		}
+	}
+	for _, group := range groups {
+		collect([]gocloak.Group{*group})
+	}
+	return ids, nil
 }
 
 func (k *KeycloakClient) GetUserRealmRoles(ctx context.Context, id string) (*gocloak.MappingsRepresentation, error) {
-	return k.Client.GetRoleMappingByUserID(ctx, k.Token.AccessToken, k.Realm, id)
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return k.Client.GetRoleMappingByUserID(ctx, accessToken, k.Realm, id)
+}
+
+// GetUserEffectiveRoles returns the realm roles of the user and the roles of the clients in ClientRoleClients as client:role.
+// Composite roles are expanded and roles granted through groups are included.
+func (k *KeycloakClient) GetUserEffectiveRoles(ctx context.Context, id string) ([]string, error) {
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	realmRoles, err := k.Client.GetCompositeRealmRolesByUserID(ctx, accessToken, k.Realm, id)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{}
+	for _, role := range realmRoles {
+		roles = append(roles, *role.Name)
+	}
+
+	for _, clientId := range k.Options.ClientRoleClients {
+		idOfClient, err := k.getIdOfClient(ctx, clientId)
+		if err != nil {
+			return nil, err
+		}
+		if idOfClient == "" {
+			continue
+		}
+
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		clientRoles, err := k.Client.GetCompositeClientRolesByUserID(ctx, accessToken, k.Realm, idOfClient, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range clientRoles {
+			roles = append(roles, clientId+":"+*role.Name)
+		}
+	}
+	return roles, nil
+}
+
+// getIdOfClient looks up the internal id of a client by its client ID. It is empty if the client does not exist.
+func (k *KeycloakClient) getIdOfClient(ctx context.Context, clientId string) (string, error) {
+	k.clientIdsMutex.Lock()
+	defer k.clientIdsMutex.Unlock()
+
+	if idOfClient, ok := k.clientIds[clientId]; ok {
+		return idOfClient, nil
+	}
+
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	clients, err := k.Client.GetClients(ctx, accessToken, k.Realm, gocloak.GetClientsParams{ClientID: &clientId})
+	if err != nil {
+		return "", err
+	}
+
+	idOfClient := ""
+	if len(clients) > 0 && clients[0].ID != nil {
+		idOfClient = *clients[0].ID
+	} else {
+		log.Warn().Str("client", k.Options.Name).Msgf("Client %s does not exist in Keycloak", clientId)
+	}
+	k.clientIds[clientId] = idOfClient
+	return idOfClient, nil
 }
 
 func (k *KeycloakClient) GetUserGroups(ctx context.Context, id string) ([]*gocloak.Group, error) {
-	return k.Client.GetUserGroups(ctx, k.Token.AccessToken, k.Realm, id, gocloak.GetGroupsParams{BriefRepresentation: &[]bool{false}[0]})
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return k.Client.GetUserGroups(ctx, accessToken, k.Realm, id, gocloak.GetGroupsParams{BriefRepresentation: &[]bool{false}[0]})
 }
 
 func (k *KeycloakClient) GetFullGroupList(ctx context.Context) ([]*gocloak.Group, error) {
@@ -197,6 +626,136 @@ func (k *KeycloakClient) GetBrokeUserList(ctx context.Context) ([]*user.User, er
 
 	log.Debug().Str("client", k.Options.Name).Msgf("Got %d users from Keycloak", len(keycloakUsers))
 
+	return k.getBrokeUsers(ctx, keycloakUsers)
+}
+
+// GetPartialBrokeUserList only loads the members of the groups and roles and the users with the attributes or usernames of the selection
+func (k *KeycloakClient) GetPartialBrokeUserList(ctx context.Context, selection *user.MappingSet) ([]*user.User, error) {
+	log.Debug().Str("client", k.Options.Name).Msgf("Getting members of %d groups, %d roles, %d attributes and %d usernames from Keycloak", len(selection.Groups), len(selection.Roles), len(selection.Attributes), len(selection.Usernames))
+
+	keycloakUsers := []*gocloak.User{}
+	seen := map[string]bool{}
+	addUsers := func(users []*gocloak.User) {
+		for _, keycloakUser := range users {
+			if keycloakUser == nil || keycloakUser.ID == nil || seen[*keycloakUser.ID] {
+				continue
+			}
+			seen[*keycloakUser.ID] = true
+			keycloakUsers = append(keycloakUsers, keycloakUser)
+		}
+	}
+
+	for _, groupName := range selection.Groups {
+		groupIds, err := k.resolveGroupIds(ctx, groupName)
+		if err != nil {
+			return nil, err
+		}
+		if len(groupIds) == 0 {
+			log.Warn().Str("client", k.Options.Name).Msgf("Group %s does not exist in Keycloak", groupName)
+		}
+		for _, groupId := range groupIds {
+			users, err := k.GetGroupUsers(ctx, groupId)
+			if err != nil {
+				return nil, err
+			}
+			addUsers(users)
+		}
+	}
+
+	for _, roleName := range selection.Roles {
+		users, err := k.GetRoleUsers(ctx, roleName)
+		if err != nil {
+			return nil, err
+		}
+		addUsers(users)
+	}
+
+	for name, values := range selection.Attributes {
+		for _, value := range values {
+			users, err := k.GetUsersByAttribute(ctx, name, value)
+			if err != nil {
+				return nil, err
+			}
+			addUsers(users)
+		}
+	}
+
+	for _, username := range selection.Usernames {
+		keycloakUser, err := k.GetUserByUsername(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if keycloakUser == nil {
+			log.Warn().Str("client", k.Options.Name).Msgf("User %s does not exist in Keycloak", username)
+			continue
+		}
+		addUsers([]*gocloak.User{keycloakUser})
+	}
+
+	log.Debug().Str("client", k.Options.Name).Msgf("Got %d users from Keycloak", len(keycloakUsers))
+
+	return k.getBrokeUsers(ctx, keycloakUsers)
+}
+
+// resolveGroupIds finds the groups a mapping refers to by full path or by name.
+// With inherited parent groups, the members of all subgroups count as members too, so their ids are included.
+func (k *KeycloakClient) resolveGroupIds(ctx context.Context, group string) ([]string, error) {
+	groupIds := []string{}
+	if strings.HasPrefix(group, "/") {
+		keycloakGroup, err := k.GetGroupByPath(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+		if keycloakGroup != nil {
+			groupIds = append(groupIds, *keycloakGroup.ID)
+		}
+	} else {
+		ids, err := k.GetGroupIdsByName(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+		groupIds = append(groupIds, ids...)
+	}
+
+	if !k.Options.InheritParentGroups {
+		return groupIds, nil
+	}
+
+	result := []string{}
+	for _, groupId := range groupIds {
+		descendants, err := k.getDescendantGroupIds(ctx, groupId)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range append([]string{groupId}, descendants...) {
+			if !slices.Contains(result, id) {
+				result = append(result, id)
+			}
+		}
+	}
+	return result, nil
+}
+
+// getDescendantGroupIds returns the ids of all subgroups of a group, recursively
+func (k *KeycloakClient) getDescendantGroupIds(ctx context.Context, id string) ([]string, error) {
+	result := []string{}
+	queue := []string{id}
+	for len(queue) > 0 {
+		children, err := k.GetChildGroups(ctx, queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		for _, child := range children {
+			result = append(result, *child.ID)
+			queue = append(queue, *child.ID)
+		}
+	}
+	return result, nil
+}
+
+// getBrokeUsers loads the groups and roles of the Keycloak users
+func (k *KeycloakClient) getBrokeUsers(ctx context.Context, keycloakUsers []*gocloak.User) ([]*user.User, error) {
 	result := make([]*user.User, len(keycloakUsers))
 
 	log.Debug().Str("client", k.Options.Name).Msg("Getting groups and roles for users")
@@ -205,6 +764,7 @@ func (k *KeycloakClient) GetBrokeUserList(ctx context.Context) ([]*user.User, er
 	var bar *progressbar.ProgressBar
 	if showProgress {
 		bar = progressbar.NewOptions(len(keycloakUsers),
+			progressbar.OptionSetWriter(util.GetLogWriter(util.GetCliContext())),
 			progressbar.OptionEnableColorCodes(true),
 			progressbar.OptionShowBytes(false),
 			progressbar.OptionSetWidth(50),
@@ -217,12 +777,23 @@ func (k *KeycloakClient) GetBrokeUserList(ctx context.Context) ([]*user.User, er
 
 	for i, keycloakUser := range keycloakUsers {
 		user := &user.User{
-			Id:       *keycloakUser.ID,
-			Source:   k.Options.Name,
-			Username: *keycloakUser.Username,
-			Email:    *keycloakUser.Email,
-			Groups:   []string{},
-			Roles:    []string{},
+			Id:         *keycloakUser.ID,
+			Source:     k.Options.Name,
+			Realm:      k.Realm,
+			Username:   gocloak.PString(keycloakUser.Username),
+			Email:      gocloak.PString(keycloakUser.Email),
+			Groups:     []string{},
+			GroupPaths: []string{},
+			Roles:      []string{},
+
+			FirstName:     gocloak.PString(keycloakUser.FirstName),
+			LastName:      gocloak.PString(keycloakUser.LastName),
+			Enabled:       gocloak.PBool(keycloakUser.Enabled),
+			EmailVerified: gocloak.PBool(keycloakUser.EmailVerified),
+			Attributes:    map[string][]string{},
+		}
+		if keycloakUser.Attributes != nil {
+			user.Attributes = *keycloakUser.Attributes
 		}
 		userGroups, err := k.GetUserGroups(ctx, *keycloakUser.ID)
 		if err != nil {
@@ -230,27 +801,18 @@ func (k *KeycloakClient) GetBrokeUserList(ctx context.Context) ([]*user.User, er
 		}
 
 		for _, group := range userGroups {
-			user.Groups = append(user.Groups, *group.Name)
-			if group.RealmRoles != nil {
-				user.Roles = append(user.Roles, *group.RealmRoles...)
-			}
-			if group.ClientRoles != nil {
-				for _, role := range *group.ClientRoles {
-					user.Roles = append(user.Roles, role...)
-				}
+			path := ""
+			if group.Path != nil {
+				path = *group.Path
 			}
+			user.AddGroup(*group.Name, path, k.Options.InheritParentGroups)
 		}
 
-		realmRoles, err := k.GetUserRealmRoles(ctx, *keycloakUser.ID)
+		roles, err := k.GetUserEffectiveRoles(ctx, *keycloakUser.ID)
 		if err != nil {
 			return nil, err
 		}
-
-		if realmRoles.RealmMappings != nil {
-			for _, role := range *realmRoles.RealmMappings {
-				user.Roles = append(user.Roles, *role.Name)
-			}
-		}
+		user.Roles = append(user.Roles, roles...)
 
 		result[i] = user
 
@@ -261,7 +823,7 @@ func (k *KeycloakClient) GetBrokeUserList(ctx context.Context) ([]*user.User, er
 
 	if showProgress {
 		bar.Finish()
-		fmt.Println()
+		fmt.Fprintln(util.GetLogWriter(util.GetCliContext()))
 	}
 
 	return result, nil
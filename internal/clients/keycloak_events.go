@@ -0,0 +1,161 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/rs/zerolog/log"
+)
+
+// resource types of the admin events that can change the users, groups or roles broke reads
+var keycloakAdminEventResourceTypes = []string{
+	"USER",
+	"GROUP_MEMBERSHIP",
+	"REALM_ROLE_MAPPING",
+	"CLIENT_ROLE_MAPPING",
+	"GROUP",
+	"REALM_ROLE",
+	"CLIENT_ROLE",
+}
+
+type KeycloakAdminEvent struct {
+	// only returned by newer versions of Keycloak
+	Id string `json:"id"`
+	// milliseconds since epoch
+	Time          int64  `json:"time"`
+	RealmId       string `json:"realmId"`
+	OperationType string `json:"operationType"`
+	ResourceType  string `json:"resourceType"`
+	ResourcePath  string `json:"resourcePath"`
+}
+
+// GetKey identifies the event among the events of the same millisecond
+func (e *KeycloakAdminEvent) GetKey() string {
+	if e.Id != "" {
+		return e.Id
+	}
+	return fmt.Sprintf("%s/%d/%s/%s/%s", e.RealmId, e.Time, e.ResourceType, e.OperationType, e.ResourcePath)
+}
+
+// GetUserId returns the id of the user the event is about or an empty string if the resource is not a user
+func (e *KeycloakAdminEvent) GetUserId() string {
+	parts := strings.Split(e.ResourcePath, "/")
+	if len(parts) < 2 || parts[0] != "users" {
+		return ""
+	}
+	return parts[1]
+}
+
+// GetAdminEventsSince returns the admin events that happened at or after the given time in milliseconds since epoch,
+// oldest first. Several events may happen in the same millisecond, so the events of that millisecond that were
+// already processed are passed by their keys and skipped. Saving admin events has to be enabled in the realm.
+func (k *KeycloakClient) GetAdminEventsSince(ctx context.Context, since int64, processedKeys []string) ([]*KeycloakAdminEvent, error) {
+	// dateFrom only has a granularity of days and is interpreted in the time zone of the server
+	dateFrom := time.UnixMilli(since).UTC().AddDate(0, 0, -1).Format("2006-01-02")
+
+	pageSize := 100
+	result := []*KeycloakAdminEvent{}
+	for first := 0; ; first += pageSize {
+		events, err := k.getAdminEvents(ctx, dateFrom, first, pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		// events are returned newest first, so all following pages are older than the cursor once one event is
+		reachedCursor := false
+		for _, event := range events {
+			if event.Time < since {
+				reachedCursor = true
+				break
+			}
+			if event.Time == since && slices.Contains(processedKeys, event.GetKey()) {
+				continue
+			}
+			result = append(result, event)
+		}
+		if reachedCursor || len(events) < pageSize {
+			break
+		}
+	}
+
+	slices.SortStableFunc(result, func(a, b *KeycloakAdminEvent) int {
+		return int(a.Time - b.Time)
+	})
+	log.Debug().Str("client", k.Options.Name).Msgf("Got %d admin events from Keycloak", len(result))
+	return result, nil
+}
+
+// GetLatestAdminEventTime returns the time of the newest admin event in milliseconds since epoch as seen by Keycloak,
+// or 0 if there are no events yet
+func (k *KeycloakClient) GetLatestAdminEventTime(ctx context.Context) (int64, error) {
+	events, err := k.getAdminEvents(ctx, "", 0, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return events[0].Time, nil
+}
+
+// getAdminEvents returns a page of the admin events of the relevant resource types, newest first
+func (k *KeycloakClient) getAdminEvents(ctx context.Context, dateFrom string, first int, max int) ([]*KeycloakAdminEvent, error) {
+	accessToken, err := k.tokens.GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*KeycloakAdminEvent{}
+	request := k.Client.RestyClient().R().
+		SetContext(ctx).
+		SetAuthToken(accessToken).
+		SetQueryParam("first", strconv.Itoa(first)).
+		SetQueryParam("max", strconv.Itoa(max)).
+		SetResult(&events)
+	if dateFrom != "" {
+		request.SetQueryParam("dateFrom", dateFrom)
+	}
+	for _, resourceType := range keycloakAdminEventResourceTypes {
+		request.QueryParam.Add("resourceTypes", resourceType)
+	}
+
+	response, err := request.Get(fmt.Sprintf("%s/admin/realms/%s/admin-events", strings.TrimRight(k.Options.Url, "/"), k.Realm))
+	if err != nil {
+		return nil, err
+	}
+	if response.IsError() {
+		return nil, fmt.Errorf("error getting admin events: %s", response.Status())
+	}
+	return events, nil
+}
+
+// GetBrokeUsersByIds loads the users with the given ids. Users that no longer exist are skipped.
+func (k *KeycloakClient) GetBrokeUsersByIds(ctx context.Context, ids []string) ([]*user.User, error) {
+	keycloakUsers := []*gocloak.User{}
+	for _, id := range ids {
+		accessToken, err := k.tokens.GetAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		keycloakUser, err := k.Client.GetUserByID(ctx, accessToken, k.Realm, id)
+		if err != nil {
+			var apiError *gocloak.APIError
+			if errors.As(err, &apiError) && apiError.Code == http.StatusNotFound {
+				log.Debug().Str("client", k.Options.Name).Msgf("User %s no longer exists", id)
+				continue
+			}
+			return nil, err
+		}
+		keycloakUsers = append(keycloakUsers, keycloakUser)
+	}
+
+	return k.getBrokeUsers(ctx, keycloakUsers)
+}
@@ -241,6 +241,17 @@ func StartMockServer(ctx context.Context, config *KeycloakMockServerConfig) *htt
 			}
 		}
 
+		if c.Query("max") != "" {
+			first, _ := strconv.Atoi(c.Query("first"))
+			max, err := strconv.Atoi(c.Query("max"))
+			if err != nil {
+				log.Error().Err(err).Msgf("invalid max")
+				c.Status(http.StatusBadRequest)
+				return
+			}
+			members = util.ListLimitOffset(members, max, first)
+		}
+
 		c.Header("Content-Type", "application/json")
 		c.JSON(http.StatusOK, members)
 	})
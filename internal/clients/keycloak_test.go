@@ -2,9 +2,14 @@ package clients
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
 
+	"github.com/Nerzal/gocloak/v13"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -174,3 +179,155 @@ func TestGetGroupUsers(t *testing.T) {
 	assert.NoError(t, err, "error getting group users")
 	assert.Equal(t, len(mockServerConfig.Data.Users)%len(mockServerConfig.Data.Groups), len(group2Users), "The group user count should be equal to the number of users in the mock server config")
 }
+
+func TestGetUserEffectiveRoles(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","expires_in":300}`))
+	})
+	mux.HandleFunc("/admin/realms/test/users/user1/role-mappings/realm/composite", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"name":"developer"},{"name":"default-roles-test"}]`))
+	})
+	mux.HandleFunc("/admin/realms/test/clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("clientId") == "gitlab" {
+			w.Write([]byte(`[{"id":"gitlab-id","clientId":"gitlab"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("/admin/realms/test/users/user1/role-mappings/clients/gitlab-id/composite", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"name":"maintainer"}]`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	adapter, err := NewKeycloakClient(ctx, &KeycloakClientOptions{
+		Url:               server.URL,
+		Realm:             "test",
+		Username:          "admin",
+		Password:          "password",
+		ClientRoleClients: []string{"gitlab", "unknown"},
+	})
+	assert.NoError(t, err, "error creating keycloak adapter")
+
+	roles, err := adapter.GetUserEffectiveRoles(ctx, "user1")
+	assert.NoError(t, err, "error getting effective roles")
+	assert.Equal(t, []string{"developer", "default-roles-test", "gitlab:maintainer"}, roles, "Client roles should be qualified with their client ID")
+}
+
+func TestGetChildGroupsPages(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","expires_in":300}`))
+	})
+	mux.HandleFunc("/admin/realms/test/groups/parent", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"parent","name":"parent","subGroupCount":150}`))
+	})
+	mux.HandleFunc("/admin/realms/test/groups/parent/children", func(w http.ResponseWriter, r *http.Request) {
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		children := []gocloak.Group{}
+		for i := first; i < min(first+max, 150); i++ {
+			children = append(children, gocloak.Group{ID: gocloak.StringP(fmt.Sprintf("child%d", i))})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(children)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	adapter, err := NewKeycloakClient(ctx, &KeycloakClientOptions{
+		Url:      server.URL,
+		Realm:    "test",
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err, "error creating keycloak adapter")
+
+	children, err := adapter.GetChildGroups(ctx, "parent")
+	assert.NoError(t, err)
+	assert.Len(t, children, 150, "All pages of child groups should be loaded")
+	assert.Equal(t, "child149", *children[149].ID)
+}
+
+func TestGetUsersByAttributeRejectsUnsearchableValues(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","expires_in":300}`))
+	})
+	mux.HandleFunc("/admin/realms/test/users", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "department:sales", r.URL.Query().Get("q"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":"user1","username":"alice"}]`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	adapter, err := NewKeycloakClient(ctx, &KeycloakClientOptions{
+		Url:      server.URL,
+		Realm:    "test",
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err, "error creating keycloak adapter")
+
+	users, err := adapter.GetUsersByAttribute(ctx, "department", "sales")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	_, err = adapter.GetUsersByAttribute(ctx, "department", "sales north")
+	assert.Error(t, err, "Values with spaces should be rejected")
+	_, err = adapter.GetUsersByAttribute(ctx, "department", "sales:north")
+	assert.Error(t, err, "Values with colons should be rejected")
+}
+
+func TestGetAdminEventsSinceKeepsEventsOfTheSameMillisecond(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","expires_in":300}`))
+	})
+	mux.HandleFunc("/admin/realms/test/admin-events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{"time":2000,"resourceType":"USER","operationType":"UPDATE","resourcePath":"users/carol"},
+			{"time":1000,"resourceType":"USER","operationType":"UPDATE","resourcePath":"users/bob"},
+			{"time":1000,"resourceType":"USER","operationType":"UPDATE","resourcePath":"users/alice"},
+			{"time":500,"resourceType":"USER","operationType":"UPDATE","resourcePath":"users/dave"}
+		]`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	adapter, err := NewKeycloakClient(ctx, &KeycloakClientOptions{
+		Url:      server.URL,
+		Realm:    "test",
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err, "error creating keycloak adapter")
+
+	processed := (&KeycloakAdminEvent{Time: 1000, ResourceType: "USER", OperationType: "UPDATE", ResourcePath: "users/alice"}).GetKey()
+	events, err := adapter.GetAdminEventsSince(ctx, 1000, []string{processed})
+	assert.NoError(t, err)
+	userIds := []string{}
+	for _, event := range events {
+		userIds = append(userIds, event.GetUserId())
+	}
+	assert.Equal(t, []string{"bob", "carol"}, userIds, "Unprocessed events of the cursor millisecond should be returned")
+}
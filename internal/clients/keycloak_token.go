@@ -0,0 +1,111 @@
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// tokens are renewed this long before they expire so that they do not expire in flight
+const keycloakTokenExpiryMargin = 30 * time.Second
+
+// keycloakTokenManager hands out a valid access token, refreshing it with the refresh token
+// or logging in again once it expires. It is safe for concurrent use.
+type keycloakTokenManager struct {
+	client  *gocloak.GoCloak
+	options *KeycloakClientOptions
+
+	mutex            sync.Mutex
+	token            *gocloak.JWT
+	expiresAt        time.Time
+	refreshExpiresAt time.Time
+}
+
+func newKeycloakTokenManager(ctx context.Context, client *gocloak.GoCloak, options *KeycloakClientOptions) (*keycloakTokenManager, error) {
+	manager := &keycloakTokenManager{
+		client:  client,
+		options: options,
+	}
+
+	err := manager.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// GetAccessToken returns the current access token, renewing it first if it is about to expire
+func (m *keycloakTokenManager) GetAccessToken(ctx context.Context) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if now.Add(keycloakTokenExpiryMargin).Before(m.expiresAt) {
+		return m.token.AccessToken, nil
+	}
+
+	// refreshing a token of a client authenticating with a signed JWT would require another client assertion, so it logs in again instead
+	canRefresh := m.options.AuthType != config.KeycloakAuthTypeClientJwt && m.token.RefreshToken != ""
+	if canRefresh && now.Add(keycloakTokenExpiryMargin).Before(m.refreshExpiresAt) {
+		err := m.refresh(ctx)
+		if err == nil {
+			return m.token.AccessToken, nil
+		}
+		log.Warn().Err(err).Str("client", m.options.Name).Msg("Failed to refresh Keycloak token. Logging in again")
+	}
+
+	err := m.login(ctx)
+	if err != nil {
+		return "", err
+	}
+	return m.token.AccessToken, nil
+}
+
+func (m *keycloakTokenManager) login(ctx context.Context) error {
+	log.Debug().Str("client", m.options.Name).Msgf("Logging in to Keycloak with auth type %s", m.options.AuthType)
+	issuedAt := time.Now()
+
+	var token *gocloak.JWT
+	var err error
+	switch m.options.AuthType {
+	case config.KeycloakAuthTypeClientCredentials:
+		token, err = m.client.LoginClient(ctx, m.options.ClientId, m.options.ClientSecret, m.options.getAuthRealm())
+	case config.KeycloakAuthTypeClientJwt:
+		expiresAt := jwt.NewNumericDate(issuedAt.Add(time.Minute))
+		token, err = m.client.LoginClientSignedJWT(ctx, m.options.ClientId, m.options.getAuthRealm(), m.options.ClientPrivateKey, m.options.ClientSigningMethod, expiresAt)
+	default:
+		token, err = m.client.LoginAdmin(ctx, m.options.Username, m.options.Password, m.options.getAuthRealm())
+	}
+	if err != nil {
+		log.Error().Err(err).Str("client", m.options.Name).Msg("Failed to log in to Keycloak")
+		return err
+	}
+	m.setToken(token, issuedAt)
+	return nil
+}
+
+func (m *keycloakTokenManager) refresh(ctx context.Context) error {
+	log.Debug().Str("client", m.options.Name).Msg("Refreshing Keycloak token")
+	issuedAt := time.Now()
+	clientId, clientSecret := "admin-cli", ""
+	if m.options.AuthType == config.KeycloakAuthTypeClientCredentials {
+		clientId, clientSecret = m.options.ClientId, m.options.ClientSecret
+	}
+	token, err := m.client.RefreshToken(ctx, m.token.RefreshToken, clientId, clientSecret, m.options.getAuthRealm())
+	if err != nil {
+		return err
+	}
+	m.setToken(token, issuedAt)
+	return nil
+}
+
+func (m *keycloakTokenManager) setToken(token *gocloak.JWT, issuedAt time.Time) {
+	m.token = token
+	m.expiresAt = issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+	m.refreshExpiresAt = issuedAt.Add(time.Duration(token.RefreshExpiresIn) * time.Second)
+}
@@ -0,0 +1,93 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeycloakTokenRefresh(t *testing.T) {
+	grants := []string{}
+	refreshFails := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/realms/master/protocol/openid-connect/token", r.URL.Path)
+		r.ParseForm()
+		grantType := r.PostForm.Get("grant_type")
+		grants = append(grants, grantType)
+
+		if grantType == "refresh_token" && refreshFails {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		// tokens expire right away so that every call has to renew them
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":       grantType + "-token",
+			"expires_in":         0,
+			"refresh_token":      "refresh",
+			"refresh_expires_in": 1800,
+		})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	manager, err := newKeycloakTokenManager(ctx, gocloak.NewClient(server.URL), &KeycloakClientOptions{
+		Name:     "keycloak",
+		Realm:    "master",
+		Username: "admin",
+		Password: "secret",
+	})
+	assert.NoError(t, err, "error logging in")
+
+	accessToken, err := manager.GetAccessToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh_token-token", accessToken, "An expired token should be refreshed")
+
+	refreshFails = true
+	accessToken, err = manager.GetAccessToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "password-token", accessToken, "A failing refresh should fall back to logging in again")
+
+	assert.Equal(t, []string{"password", "refresh_token", "refresh_token", "password"}, grants)
+}
+
+func TestKeycloakClientCredentialsLogin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		clientId, clientSecret, ok := r.BasicAuth()
+		assert.True(t, ok, "The client should authenticate with its secret")
+		assert.Equal(t, "broke", clientId)
+		assert.Equal(t, "secret", clientSecret)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "service-account-token",
+			"expires_in":   300,
+		})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	manager, err := newKeycloakTokenManager(ctx, gocloak.NewClient(server.URL), &KeycloakClientOptions{
+		Name:         "keycloak",
+		Realm:        "company",
+		AuthType:     config.KeycloakAuthTypeClientCredentials,
+		ClientId:     "broke",
+		ClientSecret: "secret",
+	})
+	assert.NoError(t, err, "error logging in")
+
+	accessToken, err := manager.GetAccessToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "service-account-token", accessToken)
+}
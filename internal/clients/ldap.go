@@ -0,0 +1,369 @@
+package clients
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultLdapUserFilter = "(objectClass=person)"
+const defaultLdapGroupFilter = "(|(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=group))"
+const defaultLdapPageSize = 500
+const DefaultLdapTimeout = 30 * time.Second
+
+// Active Directory flag of userAccountControl marking a disabled account
+const ldapAccountDisabledFlag = 0x2
+
+type LdapClient struct {
+	Options *LdapClientOptions
+}
+
+type LdapClientOptions struct {
+	Name         string
+	Url          string
+	StartTls     bool
+	Insecure     bool
+	BindDn       string
+	BindPassword string
+	BaseDn       string
+	// defaults to BaseDn
+	GroupBaseDn     string
+	UserFilter      string
+	GroupFilter     string
+	Membership      config.LdapMembership
+	PageSize        uint32
+	Attributes      config.LdapAttributesConfig
+	ExtraAttributes []string
+	// timeout of dialing and of every request. Defaults to DefaultLdapTimeout
+	Timeout time.Duration
+}
+
+func NewLdapClient(options *LdapClientOptions) (*LdapClient, error) {
+	if options.Url == "" {
+		return nil, fmt.Errorf("LdapClientOptions.Url is empty")
+	}
+	if !strings.HasPrefix(options.Url, "ldap://") && !strings.HasPrefix(options.Url, "ldaps://") {
+		return nil, fmt.Errorf("LdapClientOptions.Url must start with ldap:// or ldaps://")
+	}
+	if options.BindDn == "" {
+		return nil, fmt.Errorf("LdapClientOptions.BindDn is empty")
+	}
+	if options.BindPassword == "" {
+		return nil, fmt.Errorf("LdapClientOptions.BindPassword is empty")
+	}
+	if options.BaseDn == "" {
+		return nil, fmt.Errorf("LdapClientOptions.BaseDn is empty")
+	}
+
+	if options.GroupBaseDn == "" {
+		options.GroupBaseDn = options.BaseDn
+	}
+	if options.UserFilter == "" {
+		options.UserFilter = defaultLdapUserFilter
+	}
+	if options.GroupFilter == "" {
+		options.GroupFilter = defaultLdapGroupFilter
+	}
+	if options.Membership == "" {
+		options.Membership = config.LdapMembershipMemberOf
+	}
+	if options.PageSize == 0 {
+		options.PageSize = defaultLdapPageSize
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultLdapTimeout
+	}
+	setDefaultLdapAttributes(&options.Attributes)
+
+	if strings.HasPrefix(options.Url, "ldap://") && !options.StartTls {
+		log.Warn().Str("client", options.Name).Msgf("The bind password for '%s' is sent unencrypted. Use ldaps:// or enable startTls", options.Url)
+	}
+
+	return &LdapClient{Options: options}, nil
+}
+
+func setDefaultLdapAttributes(attributes *config.LdapAttributesConfig) {
+	defaults := []struct {
+		value        *string
+		defaultValue string
+	}{
+		{&attributes.Username, "uid"},
+		{&attributes.Email, "mail"},
+		{&attributes.FirstName, "givenName"},
+		{&attributes.LastName, "sn"},
+		{&attributes.MemberOf, "memberOf"},
+		{&attributes.GroupName, "cn"},
+		{&attributes.GroupMember, "member"},
+	}
+	for _, attribute := range defaults {
+		if *attribute.value == "" {
+			*attribute.value = attribute.defaultValue
+		}
+	}
+}
+
+func (c *LdapClient) TestConnection() error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Testing connection to LDAP server at '%s'", c.Options.Url)
+	conn, err := c.connect(context.Background())
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to test LDAP connection for user source at '%s'", c.Options.Url)
+		return err
+	}
+	conn.Close()
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully connected to LDAP server at '%s'", c.Options.Url)
+	return nil
+}
+
+// connect dials and binds a new connection. Every load uses its own connection, so that a daemon does not depend on
+// long lived connections the server may have closed in the meantime. Dialing gives up at the deadline of the context.
+func (c *LdapClient) connect(ctx context.Context) (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Options.Insecure}
+	dialer := &net.Dialer{Timeout: c.Options.Timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	conn, err := ldap.DialURL(c.Options.Url, ldap.DialWithTLSConfig(tlsConfig), ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(c.Options.Timeout)
+
+	if c.Options.StartTls {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	err = conn.Bind(c.Options.BindDn, c.Options.BindPassword)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *LdapClient) getUserAttributes() []string {
+	attributes := c.Options.Attributes
+	names := []string{attributes.Username, attributes.Email, attributes.FirstName, attributes.LastName, "userAccountControl"}
+	if attributes.Id != "" {
+		names = append(names, attributes.Id)
+	}
+	if c.Options.Membership == config.LdapMembershipMemberOf {
+		names = append(names, attributes.MemberOf)
+	}
+	return append(names, c.Options.ExtraAttributes...)
+}
+
+func (c *LdapClient) GetBrokeUserList(ctx context.Context) ([]*user.User, error) {
+	return c.searchUsers(ctx, c.Options.BaseDn, ldap.ScopeWholeSubtree, c.Options.UserFilter)
+}
+
+// GetPartialBrokeUserList loads all users and keeps the ones that are selected by group, username or attribute.
+// Roles do not exist in LDAP.
+func (c *LdapClient) GetPartialBrokeUserList(ctx context.Context, selection *user.MappingSet) ([]*user.User, error) {
+	users, err := c.GetBrokeUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*user.User{}
+	for _, brokeUser := range users {
+		if brokeUser.IsMappingSatisfied(selection) {
+			result = append(result, brokeUser)
+		}
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Selected %d of %d LDAP users", len(result), len(users))
+	return result, nil
+}
+
+// GetBrokeUsersByIds loads the users with the given ids, which are DNs unless an id attribute is configured
+func (c *LdapClient) GetBrokeUsersByIds(ctx context.Context, ids []string) ([]*user.User, error) {
+	users := []*user.User{}
+	for _, id := range ids {
+		var usersWithId []*user.User
+		var err error
+		if c.Options.Attributes.Id == "" {
+			if _, parseErr := ldap.ParseDN(id); parseErr != nil {
+				// ids of other sources are no DNs
+				continue
+			}
+			usersWithId, err = c.searchUsers(ctx, id, ldap.ScopeBaseObject, c.Options.UserFilter)
+		} else {
+			filter := fmt.Sprintf("(&%s(%s=%s))", c.Options.UserFilter, c.Options.Attributes.Id, ldap.EscapeFilter(id))
+			usersWithId, err = c.searchUsers(ctx, c.Options.BaseDn, ldap.ScopeWholeSubtree, filter)
+		}
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			log.Debug().Str("client", c.Options.Name).Msgf("User %s no longer exists", id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, usersWithId...)
+	}
+	return users, nil
+}
+
+func (c *LdapClient) searchUsers(ctx context.Context, baseDn string, scope int, filter string) ([]*user.User, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// closing the connection aborts running searches when the context is canceled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	groups, err := c.searchGroups(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	request := ldap.NewSearchRequest(baseDn, scope, ldap.NeverDerefAliases, 0, 0, false, filter, c.getUserAttributes(), nil)
+	result, err := conn.SearchWithPaging(request, c.Options.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Found %d LDAP users", len(result.Entries))
+
+	users := []*user.User{}
+	for _, entry := range result.Entries {
+		brokeUser := c.entryToUser(entry, groups)
+		if brokeUser != nil {
+			users = append(users, brokeUser)
+		}
+	}
+	return users, nil
+}
+
+// ldapGroups holds the names of all groups by normalized DN and, for membership resolution via the member
+// attribute of groups, the group names of every member by normalized DN
+type ldapGroups struct {
+	namesByDn     map[string]string
+	namesByMember map[string][]string
+}
+
+func (c *LdapClient) searchGroups(conn *ldap.Conn) (*ldapGroups, error) {
+	attributes := []string{c.Options.Attributes.GroupName}
+	if c.Options.Membership == config.LdapMembershipMember {
+		attributes = append(attributes, c.Options.Attributes.GroupMember)
+	}
+
+	request := ldap.NewSearchRequest(c.Options.GroupBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, c.Options.GroupFilter, attributes, nil)
+	result, err := conn.SearchWithPaging(request, c.Options.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Found %d LDAP groups", len(result.Entries))
+
+	return c.indexGroups(result.Entries), nil
+}
+
+func (c *LdapClient) indexGroups(entries []*ldap.Entry) *ldapGroups {
+	groups := &ldapGroups{
+		namesByDn:     map[string]string{},
+		namesByMember: map[string][]string{},
+	}
+	for _, entry := range entries {
+		name := entry.GetEqualFoldAttributeValue(c.Options.Attributes.GroupName)
+		if name == "" {
+			continue
+		}
+		groups.namesByDn[normalizeDn(entry.DN)] = name
+
+		if c.Options.Membership != config.LdapMembershipMember {
+			continue
+		}
+		for _, member := range entry.GetEqualFoldAttributeValues(c.Options.Attributes.GroupMember) {
+			memberDn := normalizeDn(member)
+			groups.namesByMember[memberDn] = append(groups.namesByMember[memberDn], name)
+		}
+	}
+	return groups
+}
+
+// entryToUser returns nil for entries without a username or id, which cannot be matched to accounts of the targets
+func (c *LdapClient) entryToUser(entry *ldap.Entry, groups *ldapGroups) *user.User {
+	attributes := c.Options.Attributes
+
+	id := entry.DN
+	if attributes.Id != "" {
+		id = entry.GetEqualFoldAttributeValue(attributes.Id)
+		if id == "" {
+			log.Warn().Str("client", c.Options.Name).Msgf("Skipping LDAP entry %s without id attribute %s", entry.DN, attributes.Id)
+			return nil
+		}
+	}
+	username := entry.GetEqualFoldAttributeValue(attributes.Username)
+	if username == "" {
+		log.Warn().Str("client", c.Options.Name).Msgf("Skipping LDAP entry %s without username attribute %s", entry.DN, attributes.Username)
+		return nil
+	}
+
+	brokeUser := &user.User{
+		Id:         id,
+		Source:     c.Options.Name,
+		Username:   username,
+		Email:      entry.GetEqualFoldAttributeValue(attributes.Email),
+		FirstName:  entry.GetEqualFoldAttributeValue(attributes.FirstName),
+		LastName:   entry.GetEqualFoldAttributeValue(attributes.LastName),
+		Groups:     []string{},
+		GroupPaths: []string{},
+		Roles:      []string{},
+		Enabled:    true,
+		Attributes: map[string][]string{},
+	}
+	// addresses in the directory are maintained by administrators
+	brokeUser.EmailVerified = brokeUser.Email != ""
+
+	if accountControl := entry.GetEqualFoldAttributeValue("userAccountControl"); accountControl != "" {
+		flags, err := strconv.Atoi(accountControl)
+		if err == nil && flags&ldapAccountDisabledFlag != 0 {
+			brokeUser.Enabled = false
+		}
+	}
+
+	if c.Options.Membership == config.LdapMembershipMember {
+		for _, name := range groups.namesByMember[normalizeDn(entry.DN)] {
+			brokeUser.AddGroup(name, "", false)
+		}
+	} else {
+		for _, groupDn := range entry.GetEqualFoldAttributeValues(attributes.MemberOf) {
+			// groups outside of the group base DN or filter are ignored
+			if name, ok := groups.namesByDn[normalizeDn(groupDn)]; ok {
+				brokeUser.AddGroup(name, "", false)
+			}
+		}
+	}
+
+	for _, name := range c.Options.ExtraAttributes {
+		values := entry.GetEqualFoldAttributeValues(name)
+		if len(values) > 0 {
+			brokeUser.Attributes[name] = values
+		}
+	}
+
+	return brokeUser
+}
+
+// normalizeDn makes DNs comparable regardless of case and spacing
+func normalizeDn(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	return strings.ToLower(parsed.String())
+}
@@ -0,0 +1,96 @@
+package clients
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLdapEntryToUser(t *testing.T) {
+	client, err := NewLdapClient(&LdapClientOptions{
+		Name:            "directory",
+		Url:             "ldap://localhost:389",
+		BindDn:          "cn=admin,dc=example,dc=com",
+		BindPassword:    "secret",
+		BaseDn:          "dc=example,dc=com",
+		ExtraAttributes: []string{"departmentNumber"},
+	})
+	assert.NoError(t, err)
+
+	groups := client.indexGroups([]*ldap.Entry{
+		ldap.NewEntry("cn=developers,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"developers"}}),
+		ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}}),
+	})
+
+	brokeUser := client.entryToUser(ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":              {"alice"},
+		"mail":             {"alice@example.com"},
+		"givenName":        {"Alice"},
+		"sn":               {"Smith"},
+		"departmentNumber": {"42"},
+		// DNs differing in case and spacing and groups outside of the group search
+		"memberOf": {"CN=Developers, OU=groups, DC=example, DC=com", "cn=unknown,ou=groups,dc=example,dc=com"},
+	}), groups)
+
+	assert.Equal(t, "uid=alice,ou=people,dc=example,dc=com", brokeUser.Id, "The DN should be the default id")
+	assert.Equal(t, "directory", brokeUser.Source)
+	assert.Equal(t, "alice", brokeUser.Username)
+	assert.Equal(t, "alice@example.com", brokeUser.Email)
+	assert.True(t, brokeUser.EmailVerified)
+	assert.True(t, brokeUser.Enabled)
+	assert.Equal(t, "Alice Smith", brokeUser.GetDisplayName())
+	assert.Equal(t, []string{"developers"}, brokeUser.Groups, "Only known groups should be resolved from memberOf")
+	assert.Equal(t, []string{"42"}, brokeUser.Attributes["departmentNumber"])
+
+	disabledUser := client.entryToUser(ldap.NewEntry("cn=bob,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":                {"bob"},
+		"userAccountControl": {"514"},
+	}), groups)
+	assert.False(t, disabledUser.Enabled, "Active Directory accounts with the disabled flag should be disabled")
+}
+
+func TestLdapGroupMemberResolution(t *testing.T) {
+	client, err := NewLdapClient(&LdapClientOptions{
+		Url:          "ldap://localhost:389",
+		BindDn:       "cn=admin,dc=example,dc=com",
+		BindPassword: "secret",
+		BaseDn:       "dc=example,dc=com",
+		Membership:   config.LdapMembershipMember,
+	})
+	assert.NoError(t, err)
+
+	groups := client.indexGroups([]*ldap.Entry{
+		ldap.NewEntry("cn=developers,ou=groups,dc=example,dc=com", map[string][]string{
+			"cn":     {"developers"},
+			"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+		}),
+		ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{
+			"cn":     {"admins"},
+			"member": {"UID=Alice,OU=people,DC=example,DC=com"},
+		}),
+	})
+
+	alice := client.entryToUser(ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{"uid": {"alice"}}), groups)
+	assert.Equal(t, []string{"developers", "admins"}, alice.Groups)
+
+	carol := client.entryToUser(ldap.NewEntry("uid=carol,ou=people,dc=example,dc=com", map[string][]string{"uid": {"carol"}}), groups)
+	assert.Empty(t, carol.Groups)
+}
+
+func TestLdapEntryToUserSkipsIncompleteEntries(t *testing.T) {
+	client, err := NewLdapClient(&LdapClientOptions{
+		Url:          "ldaps://localhost:636",
+		BindDn:       "cn=admin,dc=example,dc=com",
+		BindPassword: "secret",
+		BaseDn:       "dc=example,dc=com",
+		Attributes:   config.LdapAttributesConfig{Id: "entryUUID"},
+	})
+	assert.NoError(t, err)
+	groups := client.indexGroups([]*ldap.Entry{})
+
+	assert.Nil(t, client.entryToUser(ldap.NewEntry("cn=printer,dc=example,dc=com", map[string][]string{"entryUUID": {"1"}}), groups), "Entries without username should be skipped")
+	assert.Nil(t, client.entryToUser(ldap.NewEntry("uid=alice,dc=example,dc=com", map[string][]string{"uid": {"alice"}}), groups), "Entries without id should be skipped")
+	assert.NotNil(t, client.entryToUser(ldap.NewEntry("uid=alice,dc=example,dc=com", map[string][]string{"uid": {"alice"}, "entryUUID": {"2"}}), groups))
+}
@@ -1,25 +1,39 @@
 package clients
 
 import (
+	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 )
 
 type MailcowClient struct {
-	Options *MailcowClientOptions
+	Options    *MailcowClientOptions
+	httpClient *http.Client
+
+	cacheMutex   *sync.Mutex
+	mailboxCache []MailcowMailboxResult
+	mailboxIndex map[string]int
 }
 
 type MailcowClientOptions struct {
 	Name   string
 	Url    string
 	ApiKey string
+	// retries, rate limiting and timeouts of the http client. Defaults apply if nil
+	Http *HttpClientOptions
 }
 
 func NewMailcowClient(options *MailcowClientOptions) (*MailcowClient, error) {
 	options.Url = strings.TrimRight(options.Url, "/")
+	if options.Http == nil {
+		options.Http = &HttpClientOptions{}
+	}
 	return &MailcowClient{
-		Options: options,
+		Options:    options,
+		httpClient: NewHttpClient(options.Http),
+		cacheMutex: &sync.Mutex{},
 	}, nil
 }
 
@@ -35,6 +49,9 @@ func (c MailcowClient) GetAuthorizationType() AuthorizationType {
 func (c MailcowClient) GetAuthorization() string {
 	return c.Options.ApiKey
 }
+func (c MailcowClient) GetHttpClient() *http.Client {
+	return c.httpClient
+}
 
 func (c *MailcowClient) TestConnection() error {
 	log.Debug().Str("client", c.Options.Name).Msgf("Testing connection to Mailcow API at '%s'", c.Options.Url)
@@ -55,11 +72,12 @@ func (c *MailcowClient) TestConnection() error {
 }
 
 type MailcowMailboxResult struct {
-	Active    int    `json:"active"`
-	Username  string `json:"username"`
-	Domain    string `json:"domain"`
-	LocalPart string `json:"local_part"`
-	Name      string `json:"name"`
+	Active     int    `json:"active"`
+	Username   string `json:"username"`
+	Domain     string `json:"domain"`
+	LocalPart  string `json:"local_part"`
+	Name       string `json:"name"`
+	AuthSource string `json:"authsource"`
 }
 
 func (c *MailcowClient) MailboxExists(email string) (bool, error) {
@@ -110,3 +128,105 @@ func (c *MailcowClient) CreateMailbox(options *CreateMailboxOptions) error {
 	log.Debug().Str("client", c.Options.Name).Msgf("Successfully created mailbox '%s@%s'", options.LocalPart, options.Domain)
 	return nil
 }
+
+// GetMailboxes loads all mailboxes of the Mailcow instance. The result is cached on the client until ClearCache is called.
+func (c *MailcowClient) GetMailboxes() ([]MailcowMailboxResult, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if c.mailboxCache != nil {
+		return c.mailboxCache, nil
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msg("Loading all mailboxes")
+
+	mailboxes := []MailcowMailboxResult{}
+	_, err := DoHttpRequestWithResult[[]MailcowMailboxResult](*c, &HttpRequestOptions{
+		Method:             GET,
+		ContextPath:        "/api/v1/get/mailbox/all",
+		ExpectedStatusCode: 200,
+	}, &mailboxes)
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msg("Failed to load mailboxes")
+		return nil, err
+	}
+
+	c.mailboxCache = mailboxes
+	c.mailboxIndex = make(map[string]int, len(mailboxes))
+	for i, mailbox := range mailboxes {
+		c.mailboxIndex[strings.ToLower(mailbox.Username)] = i
+	}
+	return mailboxes, nil
+}
+
+// GetMailbox returns the mailbox with the given address from the cached mailbox list or nil if there is none
+func (c *MailcowClient) GetMailbox(email string) (*MailcowMailboxResult, error) {
+	mailboxes, err := c.GetMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	i, ok := c.mailboxIndex[strings.ToLower(email)]
+	if !ok {
+		return nil, nil
+	}
+	return &mailboxes[i], nil
+}
+
+type editMailboxOptions struct {
+	Items []string          `json:"items"`
+	Attr  map[string]string `json:"attr"`
+}
+
+func (c *MailcowClient) DeactivateMailbox(email string) error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Deactivating mailbox '%s'", email)
+
+	_, err := DoHttpRequest(*c, &HttpRequestOptions{
+		Method:             POST,
+		ContextPath:        "/api/v1/edit/mailbox",
+		ExpectedStatusCode: 200,
+		Body: editMailboxOptions{
+			Items: []string{email},
+			Attr:  map[string]string{"active": "0"},
+		},
+	})
+
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to deactivate mailbox '%s'", email)
+		return err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully deactivated mailbox '%s'", email)
+	return nil
+}
+
+func (c *MailcowClient) DeleteMailbox(email string) error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Deleting mailbox '%s'", email)
+
+	_, err := DoHttpRequest(*c, &HttpRequestOptions{
+		Method:             POST,
+		ContextPath:        "/api/v1/delete/mailbox",
+		ExpectedStatusCode: 200,
+		Body:               []string{email},
+	})
+
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to delete mailbox '%s'", email)
+		return err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully deleted mailbox '%s'", email)
+	return nil
+}
+
+// ClearCache drops the cached mailbox list so that the next call reloads it from Mailcow.
+func (c *MailcowClient) ClearCache() {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	c.mailboxCache = nil
+	c.mailboxIndex = nil
+}
@@ -3,26 +3,42 @@ package clients
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/mxcd/broke/pkg/config"
 	"github.com/rs/zerolog/log"
 )
 
 type OutlineClient struct {
-	Options *OutlineClientOptions
+	Options    *OutlineClientOptions
+	httpClient *http.Client
+
+	cacheMutex       *sync.Mutex
+	groupCache       []OutlineGroup
+	groupMemberCache map[string][]User
 }
 
 type OutlineClientOptions struct {
 	Name  string
 	Url   string
 	Token string
+	// retries, rate limiting and timeouts of the http client. Defaults apply if nil
+	Http *HttpClientOptions
 }
 
 func NewOutlineClient(options *OutlineClientOptions) (*OutlineClient, error) {
 	options.Url = strings.TrimRight(options.Url, "/")
+	if options.Http == nil {
+		options.Http = &HttpClientOptions{}
+	}
 	return &OutlineClient{
-		Options: options,
+		Options:          options,
+		httpClient:       NewHttpClient(options.Http),
+		cacheMutex:       &sync.Mutex{},
+		groupMemberCache: map[string][]User{},
 	}, nil
 }
 
@@ -38,6 +54,9 @@ func (c OutlineClient) GetAuthorizationType() AuthorizationType {
 func (c OutlineClient) GetAuthorization() string {
 	return c.Options.Token
 }
+func (c OutlineClient) GetHttpClient() *http.Client {
+	return c.httpClient
+}
 
 func (c *OutlineClient) TestConnection() error {
 	log.Debug().Str("client", c.Options.Name).Msgf("Testing connection to Outline API at '%s'", c.Options.Url)
@@ -84,6 +103,22 @@ type UserQueryOptions struct {
 }
 
 func (c *OutlineClient) GetUserIdByMail(mail string) (*string, error) {
+	outlineUser, err := c.GetUserByMail(mail)
+	if err != nil {
+		return nil, err
+	}
+
+	if outlineUser == nil {
+		errorMessage := fmt.Sprintf("User %s not found", mail)
+		log.Error().Msg(errorMessage)
+		return nil, errors.New(errorMessage)
+	}
+
+	return &outlineUser.ID, nil
+}
+
+// GetUserByMail returns the Outline user with the given email address or nil if there is none.
+func (c *OutlineClient) GetUserByMail(mail string) (*User, error) {
 
 	userQueryOptions := UserQueryOptions{
 		Emails: []string{mail},
@@ -91,9 +126,10 @@ func (c *OutlineClient) GetUserIdByMail(mail string) (*string, error) {
 
 	usersResponse := &UsersResponse{}
 	_, err := DoHttpRequestWithResult[UsersResponse](*c, &HttpRequestOptions{
-		Method:      POST,
-		ContextPath: "/api/users.list",
-		Body:        userQueryOptions,
+		Method:             POST,
+		ContextPath:        "/api/users.list",
+		Body:               userQueryOptions,
+		ExpectedStatusCode: 200,
 	}, usersResponse)
 
 	if err != nil {
@@ -101,18 +137,240 @@ func (c *OutlineClient) GetUserIdByMail(mail string) (*string, error) {
 	}
 
 	if len(usersResponse.Data) == 0 {
-		errorMessage := fmt.Sprintf("User %s not found", mail)
-		log.Error().Msg(errorMessage)
-		return nil, errors.New(errorMessage)
+		return nil, nil
 	} else if len(usersResponse.Data) > 1 {
 		errorMessage := fmt.Sprintf("Found more than one user with username %s", mail)
 		log.Error().Msg(errorMessage)
 		return nil, errors.New(errorMessage)
 	}
 
-	return &usersResponse.Data[0].ID, nil
+	return &usersResponse.Data[0], nil
+}
+
+type OutlineGroup struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	MemberCount int    `json:"memberCount"`
+}
+
+type GroupsResponse struct {
+	Data struct {
+		Groups []OutlineGroup `json:"groups"`
+	} `json:"data"`
+	Pagination Pagination `json:"pagination"`
+}
+
+type GroupMembershipsResponse struct {
+	Data struct {
+		Users []User `json:"users"`
+	} `json:"data"`
+	Pagination Pagination `json:"pagination"`
+}
+
+type groupMembershipsQueryOptions struct {
+	Id     string `json:"id"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+}
+
+type groupUserOptions struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+}
+
+type updateRoleOptions struct {
+	Id   string `json:"id"`
+	Role string `json:"role"`
+}
+
+const outlinePageSize = 100
+
+// GetGroups loads all groups of the Outline instance. The result is cached on the client until ClearCache is called.
+func (c *OutlineClient) GetGroups() ([]OutlineGroup, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if c.groupCache != nil {
+		return c.groupCache, nil
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msg("Loading Outline groups")
+
+	result := []OutlineGroup{}
+	for {
+		groupsResponse := &GroupsResponse{}
+		_, err := DoHttpRequestWithResult[GroupsResponse](*c, &HttpRequestOptions{
+			Method:             POST,
+			ContextPath:        "/api/groups.list",
+			Body:               Pagination{Offset: len(result), Limit: outlinePageSize},
+			ExpectedStatusCode: 200,
+		}, groupsResponse)
+		if err != nil {
+			log.Error().Err(err).Str("client", c.Options.Name).Msg("Failed to load Outline groups")
+			return nil, err
+		}
+
+		result = append(result, groupsResponse.Data.Groups...)
+		if len(groupsResponse.Data.Groups) < outlinePageSize {
+			break
+		}
+	}
+
+	c.groupCache = result
+	return result, nil
 }
 
-func (c *OutlineClient) getGroupByName() {
-	// Get the group ID by name
+// GetGroupByName returns the Outline group with the given name or an error if it does not exist.
+func (c *OutlineClient) GetGroupByName(name string) (*OutlineGroup, error) {
+	groups, err := c.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var result *OutlineGroup
+	for i, group := range groups {
+		if group.Name != name {
+			continue
+		}
+		if result != nil {
+			errorMessage := fmt.Sprintf("Found more than one group with name %s", name)
+			log.Error().Msg(errorMessage)
+			return nil, errors.New(errorMessage)
+		}
+		result = &groups[i]
+	}
+
+	if result == nil {
+		errorMessage := fmt.Sprintf("Group %s not found", name)
+		log.Error().Msg(errorMessage)
+		return nil, errors.New(errorMessage)
+	}
+
+	return result, nil
+}
+
+// GetGroupMembers loads all members of the Outline group with the given id. The result is cached on the client until ClearCache is called.
+func (c *OutlineClient) GetGroupMembers(groupId string) ([]User, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if members, ok := c.groupMemberCache[groupId]; ok {
+		return members, nil
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Loading members of Outline group '%s'", groupId)
+
+	result := []User{}
+	for {
+		membershipsResponse := &GroupMembershipsResponse{}
+		_, err := DoHttpRequestWithResult[GroupMembershipsResponse](*c, &HttpRequestOptions{
+			Method:      POST,
+			ContextPath: "/api/groups.memberships",
+			Body: groupMembershipsQueryOptions{
+				Id:     groupId,
+				Offset: len(result),
+				Limit:  outlinePageSize,
+			},
+			ExpectedStatusCode: 200,
+		}, membershipsResponse)
+		if err != nil {
+			log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to load members of Outline group '%s'", groupId)
+			return nil, err
+		}
+
+		result = append(result, membershipsResponse.Data.Users...)
+		if len(membershipsResponse.Data.Users) < outlinePageSize {
+			break
+		}
+	}
+
+	c.groupMemberCache[groupId] = result
+	return result, nil
+}
+
+// IsGroupMember checks whether the Outline user is a member of the Outline group.
+func (c *OutlineClient) IsGroupMember(groupId string, userId string) (bool, error) {
+	members, err := c.GetGroupMembers(groupId)
+	if err != nil {
+		return false, err
+	}
+
+	for _, member := range members {
+		if member.ID == userId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *OutlineClient) AddUserToGroup(groupId string, userId string) error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Adding user '%s' to Outline group '%s'", userId, groupId)
+
+	_, err := DoHttpRequest(*c, &HttpRequestOptions{
+		Method:             POST,
+		ContextPath:        "/api/groups.add_user",
+		Body:               groupUserOptions{Id: groupId, UserId: userId},
+		ExpectedStatusCode: 200,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to add user '%s' to Outline group '%s'", userId, groupId)
+		return err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully added user '%s' to Outline group '%s'", userId, groupId)
+	return nil
+}
+
+func (c *OutlineClient) RemoveUserFromGroup(groupId string, userId string) error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Removing user '%s' from Outline group '%s'", userId, groupId)
+
+	_, err := DoHttpRequest(*c, &HttpRequestOptions{
+		Method:             POST,
+		ContextPath:        "/api/groups.remove_user",
+		Body:               groupUserOptions{Id: groupId, UserId: userId},
+		ExpectedStatusCode: 200,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to remove user '%s' from Outline group '%s'", userId, groupId)
+		return err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully removed user '%s' from Outline group '%s'", userId, groupId)
+	return nil
+}
+
+func (c *OutlineClient) UpdateUserRole(userId string, role config.OutlineRole) error {
+	log.Debug().Str("client", c.Options.Name).Msgf("Setting role of Outline user '%s' to '%s'", userId, role)
+
+	_, err := DoHttpRequest(*c, &HttpRequestOptions{
+		Method:             POST,
+		ContextPath:        "/api/users.update_role",
+		Body:               updateRoleOptions{Id: userId, Role: OutlineApiRole(role)},
+		ExpectedStatusCode: 200,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to set role of Outline user '%s' to '%s'", userId, role)
+		return err
+	}
+
+	log.Debug().Str("client", c.Options.Name).Msgf("Successfully set role of Outline user '%s' to '%s'", userId, role)
+	return nil
+}
+
+// ClearCache drops all cached groups and group memberships so that the next call reloads them from Outline.
+func (c *OutlineClient) ClearCache() {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	c.groupCache = nil
+	c.groupMemberCache = map[string][]User{}
+}
+
+// OutlineApiRole translates the configured role into the role name used by the Outline API.
+// Outline calls editors "member" in its API.
+func OutlineApiRole(role config.OutlineRole) string {
+	if role == config.OutlineRoleUser {
+		return "member"
+	}
+	return string(role)
 }
@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/mxcd/broke/internal/scim"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/rs/zerolog/log"
+)
+
+// ScimClient reads the directory an identity provider pushed to the SCIM endpoint of 'broke serve'.
+// The store file is read again on every load, so that runs outside of the daemon see the latest state.
+type ScimClient struct {
+	Options *ScimClientOptions
+}
+
+type ScimClientOptions struct {
+	Name      string
+	StoreFile string
+}
+
+func NewScimClient(options *ScimClientOptions) (*ScimClient, error) {
+	if options.StoreFile == "" {
+		return nil, fmt.Errorf("ScimClientOptions.StoreFile is empty")
+	}
+	return &ScimClient{Options: options}, nil
+}
+
+// TestConnection reads the store file. A missing file is fine since nothing may have been pushed yet.
+func (c *ScimClient) TestConnection() error {
+	_, err := scim.LoadDirectory(c.Options.StoreFile)
+	if err != nil {
+		log.Error().Err(err).Str("client", c.Options.Name).Msgf("Failed to read SCIM store file '%s'", c.Options.StoreFile)
+		return err
+	}
+	return nil
+}
+
+func (c *ScimClient) GetBrokeUserList(ctx context.Context) ([]*user.User, error) {
+	directory, err := scim.LoadDirectory(c.Options.StoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*user.User{}
+	for _, scimUser := range directory.Users {
+		users = append(users, c.toBrokeUser(directory, scimUser))
+	}
+	log.Debug().Str("client", c.Options.Name).Msgf("Read %d SCIM users from '%s'", len(users), c.Options.StoreFile)
+	return users, nil
+}
+
+// GetPartialBrokeUserList reads all users and keeps the ones that are selected by group, role or username
+func (c *ScimClient) GetPartialBrokeUserList(ctx context.Context, selection *user.MappingSet) ([]*user.User, error) {
+	users, err := c.GetBrokeUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*user.User{}
+	for _, brokeUser := range users {
+		if brokeUser.IsMappingSatisfied(selection) {
+			result = append(result, brokeUser)
+		}
+	}
+	return result, nil
+}
+
+func (c *ScimClient) GetBrokeUsersByIds(ctx context.Context, ids []string) ([]*user.User, error) {
+	users, err := c.GetBrokeUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*user.User{}
+	for _, brokeUser := range users {
+		if slices.Contains(ids, brokeUser.Id) {
+			result = append(result, brokeUser)
+		}
+	}
+	return result, nil
+}
+
+func (c *ScimClient) toBrokeUser(directory *scim.Directory, scimUser *scim.User) *user.User {
+	email := scimUser.GetEmail()
+	brokeUser := &user.User{
+		Id:         scimUser.Id,
+		Source:     c.Options.Name,
+		Username:   scimUser.UserName,
+		Email:      email,
+		Groups:     []string{},
+		GroupPaths: []string{},
+		Roles:      []string{},
+		Enabled:    scimUser.IsActive(),
+		// the identity provider is trusted with the addresses it pushes
+		EmailVerified: email != "",
+		Attributes:    map[string][]string{},
+	}
+	if scimUser.Name != nil {
+		brokeUser.FirstName = scimUser.Name.GivenName
+		brokeUser.LastName = scimUser.Name.FamilyName
+	}
+	for _, group := range directory.GetUserGroups(scimUser.Id) {
+		brokeUser.AddGroup(group, "", false)
+	}
+	for _, role := range scimUser.Roles {
+		if !slices.Contains(brokeUser.Roles, role.Value) {
+			brokeUser.Roles = append(brokeUser.Roles, role.Value)
+		}
+	}
+	if scimUser.ExternalId != "" {
+		brokeUser.Attributes["externalId"] = []string{scimUser.ExternalId}
+	}
+	return brokeUser
+}
@@ -0,0 +1,49 @@
+package clients
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxcd/broke/internal/scim"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScimClient(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "scim.json")
+	client, err := NewScimClient(&ScimClientOptions{Name: "okta", StoreFile: storeFile})
+	assert.NoError(t, err)
+
+	users, err := client.GetBrokeUserList(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, users, "A missing store file should yield no users")
+
+	store, err := scim.NewStore(storeFile)
+	assert.NoError(t, err)
+	active := false
+	alice, err := store.CreateUser(&scim.User{
+		UserName: "alice",
+		Name:     &scim.Name{GivenName: "Alice", FamilyName: "Doe"},
+		Emails:   []scim.MultiValue{{Value: "alice@example.com"}},
+	})
+	assert.NoError(t, err)
+	_, err = store.CreateUser(&scim.User{UserName: "bob", Active: &active})
+	assert.NoError(t, err)
+	_, err = store.CreateGroup(&scim.Group{DisplayName: "developers", Members: []scim.MultiValue{{Value: alice.Id}}})
+	assert.NoError(t, err)
+
+	users, err = client.GetBrokeUserList(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, alice.Id, users[0].Id)
+	assert.Equal(t, "okta", users[0].Source)
+	assert.Equal(t, "alice@example.com", users[0].Email)
+	assert.Equal(t, "Doe", users[0].LastName)
+	assert.Equal(t, []string{"developers"}, users[0].Groups)
+	assert.True(t, users[0].Enabled)
+	assert.False(t, users[1].Enabled)
+
+	users, err = client.GetBrokeUsersByIds(context.Background(), []string{alice.Id, "unknown"})
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+}
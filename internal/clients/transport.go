@@ -0,0 +1,258 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+type HttpClientOptions struct {
+	// maximum number of requests in flight at the same time. 0 means no limit
+	MaxConcurrency int
+	// maximum time to wait for the response headers of a single attempt. 0 means no timeout
+	Timeout time.Duration
+	// number of retries of requests failing with a connection error, 429 or 5xx
+	MaxRetries int
+	// bounds of the exponential backoff between retries. A Retry-After header of the response takes precedence
+	RetryWaitMin time.Duration
+	RetryWaitMax time.Duration
+	// requests per second allowed by the token bucket. 0 means no limit
+	RateLimit float64
+	// size of the token bucket. Defaults to 1
+	RateLimitBurst int
+}
+
+const (
+	DefaultHttpTimeout      = 30 * time.Second
+	DefaultHttpMaxRetries   = 3
+	DefaultHttpRetryWaitMin = 1 * time.Second
+	DefaultHttpRetryWaitMax = 30 * time.Second
+)
+
+// GetHttpClientOptions builds the http client options of a user target, falling back to the defaults for unset values
+func GetHttpClientOptions(userTargetConfig *config.UserTargetConfig) (*HttpClientOptions, error) {
+	return getHttpClientOptions(userTargetConfig.Http, userTargetConfig.Concurrency)
+}
+
+func getHttpClientOptions(httpConfig *config.HttpConfig, concurrency int) (*HttpClientOptions, error) {
+	options := &HttpClientOptions{
+		MaxConcurrency: concurrency,
+		Timeout:        DefaultHttpTimeout,
+		MaxRetries:     DefaultHttpMaxRetries,
+		RetryWaitMin:   DefaultHttpRetryWaitMin,
+		RetryWaitMax:   DefaultHttpRetryWaitMax,
+	}
+
+	if httpConfig == nil {
+		return options, nil
+	}
+
+	var err error
+	if httpConfig.Timeout != "" {
+		options.Timeout, err = time.ParseDuration(httpConfig.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if httpConfig.MaxRetries != nil {
+		options.MaxRetries = *httpConfig.MaxRetries
+	}
+	if httpConfig.RetryWaitMin != "" {
+		options.RetryWaitMin, err = time.ParseDuration(httpConfig.RetryWaitMin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if httpConfig.RetryWaitMax != "" {
+		options.RetryWaitMax, err = time.ParseDuration(httpConfig.RetryWaitMax)
+		if err != nil {
+			return nil, err
+		}
+	}
+	options.RateLimit = httpConfig.RateLimit
+	options.RateLimitBurst = httpConfig.RateLimitBurst
+
+	return options, nil
+}
+
+// NewRateLimiter creates the token bucket for the options or nil if requests are not rate limited
+func (o *HttpClientOptions) NewRateLimiter() *rate.Limiter {
+	if o.RateLimit <= 0 {
+		return nil
+	}
+	burst := o.RateLimitBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(o.RateLimit), burst)
+}
+
+// limitedTransport restricts the number of requests that are in flight at the same time
+type limitedTransport struct {
+	transport http.RoundTripper
+	semaphore chan struct{}
+}
+
+func (t *limitedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	select {
+	case t.semaphore <- struct{}{}:
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+	defer func() { <-t.semaphore }()
+
+	return t.transport.RoundTrip(request)
+}
+
+// retryTransport retries requests failing with a connection error, 429 or 5xx and waits for the rate limiter before
+// every attempt. Requests that are not idempotent, like POST and PATCH, may have been processed by the server despite
+// the error, so they are only retried on 429 or if the connection could not be established.
+type retryTransport struct {
+	transport http.RoundTripper
+	limiter   *rate.Limiter
+	options   *HttpClientOptions
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			err := t.limiter.Wait(request.Context())
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		attemptRequest := request
+		if attempt > 0 && request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptRequest = request.Clone(request.Context())
+			attemptRequest.Body = body
+		}
+
+		response, err := t.transport.RoundTrip(attemptRequest)
+		if !shouldRetry(request, response, err) || attempt >= t.options.MaxRetries || (request.Body != nil && request.GetBody == nil) {
+			return response, err
+		}
+
+		wait := t.backoff(attempt, response)
+		if err != nil {
+			log.Warn().Err(err).Msgf("HTTP %s %s failed. Retrying in %s", request.Method, request.URL, wait)
+		} else {
+			log.Warn().Msgf("HTTP %s %s failed with status %s. Retrying in %s", request.Method, request.URL, response.Status, wait)
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		}
+	}
+}
+
+func shouldRetry(request *http.Request, response *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		return isIdempotent(request.Method) || isDialError(err)
+	}
+	if response.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return response.StatusCode >= 500 && isIdempotent(request.Method)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isDialError reports whether the request failed before it was written because no connection could be established
+func isDialError(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+// backoff honours the Retry-After header and falls back to an exponential backoff with jitter
+func (t *retryTransport) backoff(attempt int, response *http.Response) time.Duration {
+	if response != nil {
+		if wait, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			if wait > t.options.RetryWaitMax {
+				return t.options.RetryWaitMax
+			}
+			return wait
+		}
+	}
+
+	wait := t.options.RetryWaitMin << attempt
+	if wait <= 0 || wait > t.options.RetryWaitMax {
+		wait = t.options.RetryWaitMax
+	}
+	jitter := time.Duration(rand.Int63n(int64(wait)/2 + 1))
+	return wait/2 + jitter
+}
+
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// NewHttpClient creates an http client with retries, rate limiting, a concurrency limit and timeouts as configured in the options
+func NewHttpClient(options *HttpClientOptions) *http.Client {
+	return &http.Client{Transport: newTransport(options, true)}
+}
+
+// NewHttpClientWithoutRetries creates an http client like NewHttpClient but leaves retries and rate limiting to the caller
+func NewHttpClientWithoutRetries(options *HttpClientOptions) *http.Client {
+	return &http.Client{Transport: newTransport(options, false)}
+}
+
+func newTransport(options *HttpClientOptions, retry bool) http.RoundTripper {
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	baseTransport.ResponseHeaderTimeout = options.Timeout
+
+	var transport http.RoundTripper = baseTransport
+	if options.MaxConcurrency > 0 {
+		transport = &limitedTransport{
+			transport: transport,
+			semaphore: make(chan struct{}, options.MaxConcurrency),
+		}
+	}
+	if retry {
+		transport = &retryTransport{
+			transport: transport,
+			limiter:   options.NewRateLimiter(),
+			options:   options,
+		}
+	}
+	return transport
+}
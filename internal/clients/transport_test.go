@@ -0,0 +1,136 @@
+package clients
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpClientConcurrencyLimit(t *testing.T) {
+	var inFlight int32
+	var maxInFlight int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			observed := atomic.LoadInt32(&maxInFlight)
+			if current <= observed || atomic.CompareAndSwapInt32(&maxInFlight, observed, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(&HttpClientOptions{MaxConcurrency: 2})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := client.Get(server.URL)
+			assert.NoError(t, err, "error sending request")
+			response.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, maxInFlight, int32(2), "There should never be more than 2 requests in flight")
+}
+
+func TestHttpClientRetries(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "payload", string(body), "The request body should be sent on every attempt")
+
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(&HttpClientOptions{
+		MaxRetries:   3,
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+	})
+	put := func() *http.Response {
+		request, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("payload"))
+		assert.NoError(t, err)
+		response, err := client.Do(request)
+		assert.NoError(t, err, "error sending request")
+		response.Body.Close()
+		return response
+	}
+	response := put()
+	assert.Equal(t, http.StatusOK, response.StatusCode, "The request should succeed after retrying")
+	assert.Equal(t, int32(3), attempts, "The request should have been sent three times")
+
+	atomic.StoreInt32(&attempts, -10)
+	client = NewHttpClient(&HttpClientOptions{
+		MaxRetries:   1,
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+	})
+	response = put()
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode, "The last response should be returned once the retries are exhausted")
+	assert.Equal(t, int32(-8), attempts, "The request should have been sent twice")
+
+	atomic.StoreInt32(&attempts, 0)
+	response, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err, "error sending request")
+	response.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+	assert.Equal(t, int32(1), attempts, "A POST request should not be retried on 5xx, since it may have been processed")
+}
+
+func TestHttpClientRetriesPostOnTooManyRequests(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(&HttpClientOptions{
+		MaxRetries:   3,
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+	})
+	response, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err, "error sending request")
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode, "A POST request rejected with 429 should be retried")
+	assert.Equal(t, int32(2), attempts)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	wait, ok := parseRetryAfter("5")
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, wait)
+
+	_, ok = parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok, "HTTP dates should be accepted")
+
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
@@ -0,0 +1,212 @@
+package planner
+
+import (
+	"context"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+func (p *Planner) ComputeGitlabActions(ctx context.Context, brokeUser *user.User) ([]*GitlabAction, error) {
+	actions := []*GitlabAction{}
+
+	for _, userTarget := range p.Config.UserTargets {
+		if userTarget.GitLab == nil {
+			continue
+		}
+
+		gitlabClient, err := p.ClientSet.GetUserTargetGitLabClient(&userTarget)
+		if err != nil {
+			return nil, err
+		}
+
+		// the highest permission per group and the highest access level of all satisfied mappings win
+		desiredPermissions := map[string]config.GitlabGroupPermission{}
+		desiredGroups := []string{}
+		var desiredAccessLevel *config.GitlabAccessLevel
+
+		for _, mapping := range userTarget.GitLab.Mappings {
+			mappingSet := user.NewMappingSet().FromConfig(mapping)
+			if !brokeUser.IsMappingSatisfied(mappingSet) {
+				continue
+			}
+
+			log.Trace().Msgf("User %s satisfies mapping for Gitlab target %s", brokeUser.Username, userTarget.Name)
+
+			if mapping.GitlabAccessLevel != nil && (desiredAccessLevel == nil || *mapping.GitlabAccessLevel == config.GitlabAccessLevelAdministrator) {
+				desiredAccessLevel = mapping.GitlabAccessLevel
+			}
+
+			if mapping.GitlabGroupAssignments == nil {
+				continue
+			}
+
+			for _, assignment := range *mapping.GitlabGroupAssignments {
+				current, ok := desiredPermissions[assignment.Group]
+				if !ok {
+					desiredGroups = append(desiredGroups, assignment.Group)
+				}
+				if !ok || clients.AccessToValueMap[assignment.Permission] > clients.AccessToValueMap[current] {
+					desiredPermissions[assignment.Group] = assignment.Permission
+				}
+			}
+		}
+
+		if len(desiredGroups) == 0 && desiredAccessLevel == nil {
+			continue
+		}
+
+		// GitLab accounts are created on the first SSO login. Users who have not logged in yet are picked up by a later run.
+		gitlabUser, err := gitlabClient.GetUserByName(brokeUser.Username)
+		if err != nil {
+			return nil, err
+		}
+		if gitlabUser == nil {
+			log.Trace().Msgf("User %s does not exist in Gitlab target %s. skipping.", brokeUser.Username, userTarget.Name)
+			continue
+		}
+
+		for _, groupName := range desiredGroups {
+			permission := desiredPermissions[groupName]
+
+			accessLevel, err := clients.GetAccessLevelValue(permission)
+			if err != nil {
+				return nil, err
+			}
+
+			group, err := gitlabClient.GetGroupByName(groupName)
+			if err != nil {
+				return nil, err
+			}
+
+			member, err := gitlabClient.GetGroupMember(group.ID, gitlabUser.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			if member == nil {
+				log.Trace().Msgf("User %s is not a member of Gitlab group %s", brokeUser.Username, groupName)
+				actions = append(actions, &GitlabAction{
+					UserTarget: &userTarget,
+					AddGroup: &GitlabAddGroupAction{
+						GroupName:       groupName,
+						PermissionLevel: string(permission),
+					},
+				})
+				continue
+			}
+
+			if member.AccessLevel < accessLevel {
+				log.Trace().Msgf("User %s has access level %d in Gitlab group %s but should have %d", brokeUser.Username, member.AccessLevel, groupName, accessLevel)
+				actions = append(actions, &GitlabAction{
+					UserTarget: &userTarget,
+					UpdateGroup: &GitlabUpdateGroupAction{
+						GroupName:       groupName,
+						PermissionLevel: string(permission),
+					},
+				})
+				continue
+			}
+
+			log.Trace().Msgf("User %s already has sufficient permissions in Gitlab group %s. skipping.", brokeUser.Username, groupName)
+		}
+
+		if desiredAccessLevel != nil && gitlabUser.IsAdmin != (*desiredAccessLevel == config.GitlabAccessLevelAdministrator) {
+			log.Trace().Msgf("User %s should have Gitlab access level %s", brokeUser.Username, *desiredAccessLevel)
+			actions = append(actions, &GitlabAction{
+				UserTarget: &userTarget,
+				SetAccessLevel: &GitlabSetAccessLevelAction{
+					AccessLevel: string(*desiredAccessLevel),
+				},
+			})
+		}
+	}
+
+	return actions, nil
+}
+
+func ExecuteUserGitlabActions(runner *Runner, userPlan *UserPlan) error {
+	gitlabActions := userPlan.Actions.GitlabActions
+	if gitlabActions == nil {
+		return nil
+	}
+
+	for _, action := range gitlabActions {
+		err := executeGitlabAction(runner, userPlan, action)
+		if err != nil {
+			err = runner.Fail(userPlan, action.UserTarget, action.Describe(), err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		runner.Succeed()
+	}
+	return nil
+}
+
+func executeGitlabAction(runner *Runner, userPlan *UserPlan, action *GitlabAction) error {
+	gitlabClient, err := runner.ClientSet.GetUserTargetGitLabClient(action.UserTarget)
+	if err != nil {
+		return err
+	}
+
+	userId, err := gitlabClient.GetUserIdByName(userPlan.User.Username)
+	if err != nil {
+		return err
+	}
+
+	if action.AddGroup != nil {
+		group, err := gitlabClient.GetGroupByName(action.AddGroup.GroupName)
+		if err != nil {
+			return err
+		}
+
+		err = gitlabClient.AddUserToGroup(userId, group.ID, config.GitlabGroupPermission(action.AddGroup.PermissionLevel))
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.UpdateGroup != nil {
+		group, err := gitlabClient.GetGroupByName(action.UpdateGroup.GroupName)
+		if err != nil {
+			return err
+		}
+
+		err = gitlabClient.UpdateGroupMember(userId, group.ID, config.GitlabGroupPermission(action.UpdateGroup.PermissionLevel))
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.RemoveGroup != nil {
+		group, err := gitlabClient.GetGroupByName(action.RemoveGroup.GroupName)
+		if err != nil {
+			return err
+		}
+
+		err = gitlabClient.RemoveUserFromGroup(userId, group.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.SetAccessLevel != nil {
+		admin := config.GitlabAccessLevel(action.SetAccessLevel.AccessLevel) == config.GitlabAccessLevelAdministrator
+		err = gitlabClient.SetAdmin(userId, admin)
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.BlockUser != nil {
+		err = gitlabClient.BlockUser(userId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package planner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// SyncState is the state of a user source with incremental loading
+type SyncState struct {
+	// realm name -> cursor of the admin events of the realm
+	Realms       map[string]*RealmSyncState `json:"realms"`
+	LastFullSync time.Time                  `json:"lastFullSync"`
+}
+
+// RealmSyncState is the cursor of the admin events of one realm
+type RealmSyncState struct {
+	// time of the last processed admin event in milliseconds since epoch, as seen by Keycloak
+	LastEventTime int64 `json:"lastEventTime"`
+	// keys of the processed events at LastEventTime, so that later events of the same millisecond are not missed
+	LastEventKeys []string `json:"lastEventKeys,omitempty"`
+}
+
+// LoadSyncState reads the state file. nil is returned if the file does not exist yet.
+func LoadSyncState(stateFile string) (*SyncState, error) {
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &SyncState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save writes the state to a temporary file first, so an interrupted write does not corrupt the state file
+func (s *SyncState) Save(stateFile string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(stateFile), filepath.Base(stateFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), stateFile)
+}
+
+// GetAffectedUserIds returns the ids of the users changed by the admin events in order of their first change.
+// requiresFullSync is set if an event may affect users that cannot be told from the event itself,
+// like changes of groups or role composites, or if a user was deleted.
+func GetAffectedUserIds(events []*clients.KeycloakAdminEvent) (ids []string, requiresFullSync bool) {
+	ids = []string{}
+	seen := map[string]bool{}
+	for _, event := range events {
+		switch event.ResourceType {
+		case "USER", "GROUP_MEMBERSHIP", "REALM_ROLE_MAPPING", "CLIENT_ROLE_MAPPING":
+		default:
+			return nil, true
+		}
+
+		userId := event.GetUserId()
+		if userId == "" || (event.ResourceType == "USER" && event.OperationType == "DELETE") {
+			return nil, true
+		}
+		if !seen[userId] {
+			seen[userId] = true
+			ids = append(ids, userId)
+		}
+	}
+	return ids, false
+}
+
+// loadIncrementalUsers loads only the users affected by the admin events since the last run, or all users if no run
+// succeeded yet, the full resync interval passed or the events cannot be attributed to single users.
+// Every realm has its own cursor, which only holds times of Keycloak so that the clock of broke does not matter.
+// The new state is stored on the planner and written once the plan was executed successfully.
+func (p *Planner) loadIncrementalUsers(ctx context.Context, userSource *config.UserSourceConfig) ([]*user.User, error) {
+	incremental := userSource.LoadConfig.Incremental
+	start := time.Now()
+
+	realmClients, err := p.ClientSet.GetKeycloakRealmClients(*userSource)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := LoadSyncState(incremental.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fullSync := func(reason string) ([]*user.User, error) {
+		log.Info().Msgf("Loading all users from source %s: %s", userSource.Name, reason)
+		// the cursors are taken before loading, events happening while loading are processed again in the next run,
+		// which does no harm
+		newState := &SyncState{
+			Realms:       map[string]*RealmSyncState{},
+			LastFullSync: start,
+		}
+		for _, realmClient := range realmClients {
+			lastEventTime, err := realmClient.GetLatestAdminEventTime(ctx)
+			if err != nil {
+				return nil, err
+			}
+			newState.Realms[realmClient.Realm] = &RealmSyncState{LastEventTime: lastEventTime}
+		}
+
+		users, err := p.loadUsers(ctx, userSource)
+		if err != nil {
+			return nil, err
+		}
+		p.pendingSyncStates[incremental.StateFile] = newState
+		return users, nil
+	}
+
+	if state == nil {
+		return fullSync("no previous sync state")
+	}
+	if time.Since(state.LastFullSync) >= incremental.GetFullResyncInterval() {
+		return fullSync("full resync is due")
+	}
+
+	newState := &SyncState{
+		Realms:       map[string]*RealmSyncState{},
+		LastFullSync: state.LastFullSync,
+	}
+	users := []*user.User{}
+	eventCount := 0
+	for _, realmClient := range realmClients {
+		realmState, ok := state.Realms[realmClient.Realm]
+		if !ok {
+			return fullSync(fmt.Sprintf("no previous sync state for realm %s", realmClient.Realm))
+		}
+
+		events, err := realmClient.GetAdminEventsSince(ctx, realmState.LastEventTime, realmState.LastEventKeys)
+		if err != nil {
+			return nil, err
+		}
+		ids, requiresFullSync := GetAffectedUserIds(events)
+		if requiresFullSync {
+			return fullSync("admin events affect more than single users")
+		}
+
+		usersFromRealm, err := realmClient.GetBrokeUsersByIds(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, usersFromRealm...)
+
+		eventCount += len(events)
+		newRealmState := &RealmSyncState{
+			LastEventTime: realmState.LastEventTime,
+			LastEventKeys: slices.Clone(realmState.LastEventKeys),
+		}
+		newRealmState.advance(events)
+		newState.Realms[realmClient.Realm] = newRealmState
+	}
+	log.Info().Msgf("Loaded %d users affected by %d admin events from source %s", len(users), eventCount, userSource.Name)
+
+	p.pendingSyncStates[incremental.StateFile] = newState
+	p.partialUserSet = true
+	return users, nil
+}
+
+// advance moves the cursor to the newest of the events, which are sorted oldest first
+func (s *RealmSyncState) advance(events []*clients.KeycloakAdminEvent) {
+	for _, event := range events {
+		if event.Time > s.LastEventTime {
+			s.LastEventTime = event.Time
+			s.LastEventKeys = []string{}
+		}
+		if event.Time == s.LastEventTime {
+			s.LastEventKeys = append(s.LastEventKeys, event.GetKey())
+		}
+	}
+}
+
+// saveSyncStates writes the states of all incrementally loaded sources after the plan was executed successfully
+func (p *Planner) saveSyncStates() error {
+	for stateFile, state := range p.pendingSyncStates {
+		err := state.Save(stateFile)
+		if err != nil {
+			return err
+		}
+	}
+	p.pendingSyncStates = map[string]*SyncState{}
+	return nil
+}
@@ -0,0 +1,152 @@
+package planner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAffectedUserIds(t *testing.T) {
+	ids, requiresFullSync := GetAffectedUserIds([]*clients.KeycloakAdminEvent{
+		{ResourceType: "USER", OperationType: "CREATE", ResourcePath: "users/alice"},
+		{ResourceType: "GROUP_MEMBERSHIP", OperationType: "CREATE", ResourcePath: "users/bob/groups/developers"},
+		{ResourceType: "REALM_ROLE_MAPPING", OperationType: "DELETE", ResourcePath: "users/alice/role-mappings/realm"},
+	})
+	assert.False(t, requiresFullSync)
+	assert.Equal(t, []string{"alice", "bob"}, ids, "Every affected user should be reported once")
+
+	_, requiresFullSync = GetAffectedUserIds([]*clients.KeycloakAdminEvent{
+		{ResourceType: "USER", OperationType: "DELETE", ResourcePath: "users/alice"},
+	})
+	assert.True(t, requiresFullSync, "Deleted users should require a full sync to be pruned")
+
+	_, requiresFullSync = GetAffectedUserIds([]*clients.KeycloakAdminEvent{
+		{ResourceType: "REALM_ROLE_MAPPING", OperationType: "CREATE", ResourcePath: "groups/developers/role-mappings/realm"},
+	})
+	assert.True(t, requiresFullSync, "Role mappings of groups should require a full sync")
+
+	_, requiresFullSync = GetAffectedUserIds([]*clients.KeycloakAdminEvent{
+		{ResourceType: "GROUP", OperationType: "UPDATE", ResourcePath: "groups/developers"},
+	})
+	assert.True(t, requiresFullSync, "Group changes should require a full sync")
+}
+
+func TestSyncState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := LoadSyncState(stateFile)
+	assert.NoError(t, err)
+	assert.Nil(t, state, "A missing state file should yield no state")
+
+	lastFullSync := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	err = (&SyncState{Realms: map[string]*RealmSyncState{"test": {LastEventTime: 1714564800000}}, LastFullSync: lastFullSync}).Save(stateFile)
+	assert.NoError(t, err)
+
+	state, err = LoadSyncState(stateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1714564800000), state.Realms["test"].LastEventTime)
+	assert.True(t, lastFullSync.Equal(state.LastFullSync))
+}
+
+func TestSyncStateAdvance(t *testing.T) {
+	state := &RealmSyncState{LastEventTime: 1000, LastEventKeys: []string{"a"}}
+	state.advance([]*clients.KeycloakAdminEvent{{Id: "b", Time: 1000}})
+	assert.Equal(t, int64(1000), state.LastEventTime)
+	assert.Equal(t, []string{"a", "b"}, state.LastEventKeys, "Events of the same millisecond should be remembered")
+
+	state.advance([]*clients.KeycloakAdminEvent{{Id: "c", Time: 1500}, {Id: "d", Time: 2000}, {Id: "e", Time: 2000}})
+	assert.Equal(t, int64(2000), state.LastEventTime)
+	assert.Equal(t, []string{"d", "e"}, state.LastEventKeys, "Only the events of the newest millisecond should be remembered")
+}
+
+func TestLoadIncrementalUsersUsesTheClockOfKeycloak(t *testing.T) {
+	ctx := context.Background()
+	// the clock of Keycloak is an hour behind the one of broke
+	keycloakNow := time.Now().Add(-time.Hour).UnixMilli()
+	events := map[string][]*clients.KeycloakAdminEvent{
+		"staff":    {{Id: "a", Time: keycloakNow, ResourceType: "USER", OperationType: "UPDATE", ResourcePath: "users/alice"}},
+		"partners": {},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/staff/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","expires_in":300}`))
+	})
+	mux.HandleFunc("/admin/realms/{realm}/admin-events", func(w http.ResponseWriter, r *http.Request) {
+		// newest first like Keycloak
+		realmEvents := []*clients.KeycloakAdminEvent{}
+		for i := len(events[r.PathValue("realm")]) - 1; i >= 0; i-- {
+			realmEvents = append(realmEvents, events[r.PathValue("realm")][i])
+		}
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		realmEvents = realmEvents[min(first, len(realmEvents)):min(first+max, len(realmEvents))]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(realmEvents)
+	})
+	mux.HandleFunc("/admin/realms/{realm}/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("/admin/realms/{realm}/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	keycloakClient, err := clients.NewKeycloakClient(ctx, &clients.KeycloakClientOptions{
+		Name:     "keycloak",
+		Url:      server.URL,
+		Realm:    "staff",
+		Realms:   []string{"staff", "partners"},
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err)
+	clientSet := getEmptyClientSet()
+	clientSet.KeycloakClients["keycloak"] = keycloakClient
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	userSource := &config.UserSourceConfig{
+		Name:     "keycloak",
+		Keycloak: &config.KeycloakConfig{Realm: "staff", Realms: []string{"staff", "partners"}},
+		LoadConfig: config.UserLoadConfig{
+			Type:        config.UserLoadTypePartial,
+			Usernames:   []string{"nobody"},
+			Incremental: &config.IncrementalLoadConfig{StateFile: stateFile},
+		},
+	}
+	plannerInstance := &Planner{
+		Config:            &config.BrokeConfig{UserSources: []config.UserSourceConfig{*userSource}},
+		ClientSet:         clientSet,
+		pendingSyncStates: map[string]*SyncState{},
+	}
+
+	_, err = plannerInstance.loadIncrementalUsers(ctx, userSource)
+	assert.NoError(t, err)
+	state := plannerInstance.pendingSyncStates[stateFile]
+	assert.Equal(t, keycloakNow, state.Realms["staff"].LastEventTime, "The cursor should be the time of the newest event instead of the local time")
+	assert.Equal(t, int64(0), state.Realms["partners"].LastEventTime)
+	assert.NoError(t, plannerInstance.saveSyncStates())
+
+	// earlier than the local time of the full sync, but after it according to Keycloak
+	events["staff"] = append(events["staff"], &clients.KeycloakAdminEvent{Id: "b", Time: keycloakNow + 1000, ResourceType: "USER", OperationType: "UPDATE", ResourcePath: "users/bob"})
+	events["partners"] = append(events["partners"], &clients.KeycloakAdminEvent{Id: "c", Time: keycloakNow - 1000, ResourceType: "USER", OperationType: "UPDATE", ResourcePath: "users/carol"})
+	_, err = plannerInstance.loadIncrementalUsers(ctx, userSource)
+	assert.NoError(t, err)
+	state = plannerInstance.pendingSyncStates[stateFile]
+	assert.Equal(t, keycloakNow+1000, state.Realms["staff"].LastEventTime)
+	assert.Equal(t, []string{"b"}, state.Realms["staff"].LastEventKeys, "Events after the cursor should be processed")
+	assert.Equal(t, keycloakNow-1000, state.Realms["partners"].LastEventTime, "Every realm should have its own cursor")
+	assert.Equal(t, []string{"c"}, state.Realms["partners"].LastEventKeys)
+}
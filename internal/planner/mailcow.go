@@ -31,12 +31,12 @@ func (p *Planner) ComputeMailcowActions(ctx context.Context, brokeUser *user.Use
 
 			mailboxEmail := brokeUser.Username + "@" + mapping.Domain
 
-			mailboxExists, err := mailcowClient.MailboxExists(mailboxEmail)
+			mailbox, err := mailcowClient.GetMailbox(mailboxEmail)
 			if err != nil {
 				return nil, err
 			}
 
-			if mailboxExists {
+			if mailbox != nil {
 				log.Trace().Msgf("Mailbox %s already exists. skipping.", mailboxEmail)
 				continue
 			}
@@ -62,7 +62,7 @@ func (p *Planner) ComputeMailcowActions(ctx context.Context, brokeUser *user.Use
 
 func mailcowCreateActionExists(actions []*MailcowAction, userTargetName string, domain string) bool {
 	for _, action := range actions {
-		if action.UserTarget.Name == userTargetName && action.CreateAccount.Domain == domain {
+		if action.UserTarget.Name == userTargetName && action.CreateAccount != nil && action.CreateAccount.Domain == domain {
 			return true
 		}
 	}
@@ -76,22 +76,50 @@ func ExecuteUserMailcowActions(runner *Runner, userPlan *UserPlan) error {
 	}
 
 	for _, action := range mailcowActions {
-		if action.CreateAccount != nil {
-			createMailboxOptions := &clients.CreateMailboxOptions{
-				Name:       userPlan.User.Username,
-				Domain:     action.CreateAccount.Domain,
-				LocalPart:  userPlan.User.Username,
-				AuthSource: action.CreateAccount.AuthSource,
-			}
-			mailcowClient, err := runner.ClientSet.GetUserTargetMailcowClient(action.UserTarget)
+		err := executeMailcowAction(runner, userPlan, action)
+		if err != nil {
+			err = runner.Fail(userPlan, action.UserTarget, action.Describe(), err)
 			if err != nil {
 				return err
 			}
+			continue
+		}
+		runner.Succeed()
+	}
+	return nil
+}
 
-			err = mailcowClient.CreateMailbox(createMailboxOptions)
-			if err != nil {
-				return err
-			}
+func executeMailcowAction(runner *Runner, userPlan *UserPlan, action *MailcowAction) error {
+	mailcowClient, err := runner.ClientSet.GetUserTargetMailcowClient(action.UserTarget)
+	if err != nil {
+		return err
+	}
+
+	if action.CreateAccount != nil {
+		createMailboxOptions := &clients.CreateMailboxOptions{
+			Name:       userPlan.User.GetDisplayName(),
+			Domain:     action.CreateAccount.Domain,
+			LocalPart:  userPlan.User.Username,
+			AuthSource: action.CreateAccount.AuthSource,
+		}
+
+		err = mailcowClient.CreateMailbox(createMailboxOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.DeactivateAccount != nil {
+		err = mailcowClient.DeactivateMailbox(userPlan.User.Username + "@" + action.DeactivateAccount.Domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.DeleteAccount != nil {
+		err = mailcowClient.DeleteMailbox(userPlan.User.Username + "@" + action.DeleteAccount.Domain)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
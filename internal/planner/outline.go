@@ -0,0 +1,182 @@
+package planner
+
+import (
+	"context"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+var outlineRolePriority = map[config.OutlineRole]int{
+	config.OutlineRoleViewer: 1,
+	config.OutlineRoleUser:   2,
+	config.OutlineRoleAdmin:  3,
+}
+
+func (p *Planner) ComputeOutlineActions(ctx context.Context, brokeUser *user.User) ([]*OutlineAction, error) {
+	actions := []*OutlineAction{}
+
+	for _, userTarget := range p.Config.UserTargets {
+		if userTarget.Outline == nil {
+			continue
+		}
+
+		outlineClient, err := p.ClientSet.GetUserTargetOutlineClient(&userTarget)
+		if err != nil {
+			return nil, err
+		}
+
+		satisfiedMappings := []config.OutlineMappingConfig{}
+		for _, mapping := range userTarget.Outline.Mappings {
+			mappingSet := user.NewMappingSet().FromConfig(mapping)
+			if brokeUser.IsMappingSatisfied(mappingSet) {
+				log.Trace().Msgf("User %s satisfies mapping for Outline target %s", brokeUser.Username, userTarget.Name)
+				satisfiedMappings = append(satisfiedMappings, mapping)
+			}
+		}
+
+		if len(satisfiedMappings) == 0 {
+			continue
+		}
+
+		if brokeUser.Email == "" {
+			log.Debug().Msgf("User %s has no email address to find the Outline account by. skipping.", brokeUser.Username)
+			continue
+		}
+
+		// Outline accounts are created on the first SSO login. Users who have not logged in yet are picked up by a later run.
+		outlineUser, err := outlineClient.GetUserByMail(brokeUser.Email)
+		if err != nil {
+			return nil, err
+		}
+		if outlineUser == nil {
+			log.Trace().Msgf("User %s does not exist in Outline target %s. skipping.", brokeUser.Email, userTarget.Name)
+			continue
+		}
+
+		var desiredRole *config.OutlineRole
+		for _, mapping := range satisfiedMappings {
+			if mapping.OutlineRole != nil && (desiredRole == nil || outlineRolePriority[*mapping.OutlineRole] > outlineRolePriority[*desiredRole]) {
+				desiredRole = mapping.OutlineRole
+			}
+
+			if mapping.OutlineGroup == nil {
+				continue
+			}
+
+			group, err := outlineClient.GetGroupByName(*mapping.OutlineGroup)
+			if err != nil {
+				return nil, err
+			}
+
+			isMember, err := outlineClient.IsGroupMember(group.ID, outlineUser.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			if isMember {
+				log.Trace().Msgf("User %s is already member of Outline group %s. skipping.", brokeUser.Username, group.Name)
+				continue
+			}
+
+			if outlineAddGroupActionExists(actions, userTarget.Name, group.Name) {
+				log.Trace().Msgf("Outline add group action already exists for user target %s and group %s", userTarget.Name, group.Name)
+				continue
+			}
+
+			actions = append(actions, &OutlineAction{
+				UserTarget: &userTarget,
+				AddGroup: &OutlineAddGroupAction{
+					GroupName: group.Name,
+				},
+			})
+		}
+
+		if desiredRole != nil && outlineUser.Role != clients.OutlineApiRole(*desiredRole) {
+			log.Trace().Msgf("Outline user %s has role %s but should have role %s", brokeUser.Username, outlineUser.Role, *desiredRole)
+			actions = append(actions, &OutlineAction{
+				UserTarget: &userTarget,
+				SetRole: &OutlineSetRoleAction{
+					Role: string(*desiredRole),
+				},
+			})
+		}
+	}
+
+	return actions, nil
+}
+
+func outlineAddGroupActionExists(actions []*OutlineAction, userTargetName string, groupName string) bool {
+	for _, action := range actions {
+		if action.UserTarget.Name == userTargetName && action.AddGroup != nil && action.AddGroup.GroupName == groupName {
+			return true
+		}
+	}
+	return false
+}
+
+func ExecuteUserOutlineActions(runner *Runner, userPlan *UserPlan) error {
+	outlineActions := userPlan.Actions.OutlineActions
+	if outlineActions == nil {
+		return nil
+	}
+
+	for _, action := range outlineActions {
+		err := executeOutlineAction(runner, userPlan, action)
+		if err != nil {
+			err = runner.Fail(userPlan, action.UserTarget, action.Describe(), err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		runner.Succeed()
+	}
+	return nil
+}
+
+func executeOutlineAction(runner *Runner, userPlan *UserPlan, action *OutlineAction) error {
+	outlineClient, err := runner.ClientSet.GetUserTargetOutlineClient(action.UserTarget)
+	if err != nil {
+		return err
+	}
+
+	userId, err := outlineClient.GetUserIdByMail(userPlan.User.Email)
+	if err != nil {
+		return err
+	}
+
+	if action.AddGroup != nil {
+		group, err := outlineClient.GetGroupByName(action.AddGroup.GroupName)
+		if err != nil {
+			return err
+		}
+
+		err = outlineClient.AddUserToGroup(group.ID, *userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.RemoveGroup != nil {
+		group, err := outlineClient.GetGroupByName(action.RemoveGroup.GroupName)
+		if err != nil {
+			return err
+		}
+
+		err = outlineClient.RemoveUserFromGroup(group.ID, *userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if action.SetRole != nil {
+		err = outlineClient.UpdateUserRole(*userId, config.OutlineRole(action.SetRole.Role))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package planner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/mxcd/broke/internal/util"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+type OutputFormat string
+
+const (
+	OutputFormatTable    OutputFormat = "table"
+	OutputFormatJson     OutputFormat = "json"
+	OutputFormatYaml     OutputFormat = "yaml"
+	OutputFormatMarkdown OutputFormat = "markdown"
+)
+
+var OutputFormats = []OutputFormat{OutputFormatTable, OutputFormatJson, OutputFormatYaml, OutputFormatMarkdown}
+
+func ParseOutputFormat(format string) (OutputFormat, error) {
+	if format == "" {
+		return OutputFormatTable, nil
+	}
+	for _, outputFormat := range OutputFormats {
+		if string(outputFormat) == strings.ToLower(format) {
+			return outputFormat, nil
+		}
+	}
+	return "", fmt.Errorf("invalid output format '%s'. Must be one of %v", format, OutputFormats)
+}
+
+// Print renders the plan as tables to the log writer if verbose output is enabled
+func (p *Plan) Print() {
+	if !util.GetCliContext().Bool("verbose") && !util.GetCliContext().Bool("very-verbose") {
+		return
+	}
+
+	log.Info().Msgf("Plan for %d users:", len(p.UserPlans))
+
+	err := p.Write(util.GetLogWriter(util.GetCliContext()), OutputFormatTable)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to print plan")
+	}
+}
+
+// WriteFile renders the plan in the given format to the file or to stdout if no file name is given
+func (p *Plan) WriteFile(fileName string, format OutputFormat) error {
+	if fileName == "" {
+		return p.Write(os.Stdout, format)
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to create output file '%s': %w", fileName, err)
+	}
+	defer file.Close()
+
+	err = p.Write(file, format)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Wrote plan as %s to '%s'", format, fileName)
+	return nil
+}
+
+// Write renders all user plans with actions in the given format
+func (p *Plan) Write(w io.Writer, format OutputFormat) error {
+	changes := &Plan{
+		ConfigHash: p.ConfigHash,
+		UserPlans:  []*UserPlan{},
+		Conflicts:  p.Conflicts,
+	}
+	for _, userPlan := range p.UserPlans {
+		if userPlan.HasActions() {
+			changes.UserPlans = append(changes.UserPlans, userPlan)
+		}
+	}
+
+	switch format {
+	case OutputFormatJson:
+		data, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case OutputFormatYaml:
+		// go through json to keep the json field names
+		data, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		var document yaml.MapSlice
+		err = yaml.Unmarshal(data, &document)
+		if err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(document)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case OutputFormatMarkdown:
+		changes.writeTables(w, true)
+		return nil
+	default:
+		changes.writeTables(w, false)
+		return nil
+	}
+}
+
+func (p *Plan) writeTables(w io.Writer, markdown bool) {
+	render := func(t table.Writer) {
+		t.SetOutputMirror(w)
+		if markdown {
+			t.RenderMarkdown()
+			fmt.Fprintln(w)
+		} else {
+			t.Render()
+		}
+	}
+
+	if markdown {
+		fmt.Fprintf(w, "## Plan\n\n%d users with changes\n\n", len(p.UserPlans))
+	} else if len(p.UserPlans) == 0 {
+		fmt.Fprintln(w, "No changes.")
+	}
+
+	if len(p.Conflicts) > 0 {
+		printHeading(w, "Correlation Conflicts", markdown)
+		conflictTable := table.NewWriter()
+		conflictTable.AppendHeader(table.Row{"Key", "Field", "Used Value", "Other Values"})
+		for _, conflict := range p.Conflicts {
+			otherValues := []string{}
+			for _, value := range conflict.Values[1:] {
+				otherValues = append(otherValues, fmt.Sprintf("%s (%s)", value.Value, value.Source))
+			}
+			usedValue := fmt.Sprintf("%s (%s)", conflict.Values[0].Value, conflict.Values[0].Source)
+			conflictTable.AppendRow(table.Row{conflict.Key, conflict.Field, usedValue, strings.Join(otherValues, ", ")})
+		}
+		render(conflictTable)
+	}
+
+	for _, userPlan := range p.UserPlans {
+		if markdown {
+			fmt.Fprintf(w, "### User: %s\n\n", userPlan.User.Username)
+		} else {
+			fmt.Fprintln(w, "---")
+			fmt.Fprintf(w, "User: %s\n", userPlan.User.Username)
+		}
+
+		// Print Mailcow Actions
+		if len(userPlan.Actions.MailcowActions) > 0 {
+			printHeading(w, "Mailcow Actions", markdown)
+			mailcowTable := table.NewWriter()
+			mailcowTable.AppendHeader(table.Row{"User Target Name", "Action", "Domain", "Auth Source"})
+			for _, action := range userPlan.Actions.MailcowActions {
+				if action.CreateAccount != nil {
+					mailcowTable.AppendRow(table.Row{action.UserTarget.Name, "create", action.CreateAccount.Domain, action.CreateAccount.AuthSource})
+				}
+				if action.DeactivateAccount != nil {
+					mailcowTable.AppendRow(table.Row{action.UserTarget.Name, "deactivate", action.DeactivateAccount.Domain, ""})
+				}
+				if action.DeleteAccount != nil {
+					mailcowTable.AppendRow(table.Row{action.UserTarget.Name, "delete", action.DeleteAccount.Domain, ""})
+				}
+			}
+			render(mailcowTable)
+		}
+
+		// Print Outline Actions
+		if len(userPlan.Actions.OutlineActions) > 0 {
+			printHeading(w, "Outline Actions", markdown)
+			outlineTable := table.NewWriter()
+			outlineTable.AppendHeader(table.Row{"User Target Name", "Add Group", "Remove Group", "Set Role"})
+			for _, action := range userPlan.Actions.OutlineActions {
+				addGroup := ""
+				removeGroup := ""
+				setRole := ""
+				if action.AddGroup != nil {
+					addGroup = action.AddGroup.GroupName
+				}
+				if action.RemoveGroup != nil {
+					removeGroup = action.RemoveGroup.GroupName
+				}
+				if action.SetRole != nil {
+					setRole = action.SetRole.Role
+				}
+				outlineTable.AppendRow(table.Row{action.UserTarget.Name, addGroup, removeGroup, setRole})
+			}
+			render(outlineTable)
+		}
+
+		// Print Gitlab Actions
+		if len(userPlan.Actions.GitlabActions) > 0 {
+			printHeading(w, "Gitlab Actions", markdown)
+			gitlabTable := table.NewWriter()
+			gitlabTable.AppendHeader(table.Row{"User Target Name", "Add Group", "Update Group", "Remove Group", "Permission Level", "Set Access Level", "Block User"})
+			for _, action := range userPlan.Actions.GitlabActions {
+				addGroup := ""
+				updateGroup := ""
+				removeGroup := ""
+				permissionLevel := ""
+				setAccessLevel := ""
+				blockUser := ""
+				if action.AddGroup != nil {
+					addGroup = action.AddGroup.GroupName
+					permissionLevel = action.AddGroup.PermissionLevel
+				}
+				if action.UpdateGroup != nil {
+					updateGroup = action.UpdateGroup.GroupName
+					permissionLevel = action.UpdateGroup.PermissionLevel
+				}
+				if action.RemoveGroup != nil {
+					removeGroup = action.RemoveGroup.GroupName
+				}
+				if action.SetAccessLevel != nil {
+					setAccessLevel = action.SetAccessLevel.AccessLevel
+				}
+				if action.BlockUser != nil {
+					blockUser = "yes"
+				}
+				gitlabTable.AppendRow(table.Row{action.UserTarget.Name, addGroup, updateGroup, removeGroup, permissionLevel, setAccessLevel, blockUser})
+			}
+			render(gitlabTable)
+		}
+	}
+}
+
+func printHeading(w io.Writer, heading string, markdown bool) {
+	if markdown {
+		fmt.Fprintf(w, "**%s**\n\n", heading)
+	} else {
+		fmt.Fprintf(w, "%s:\n", heading)
+	}
+}
@@ -1,18 +1,22 @@
 package planner
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 
-	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/mxcd/broke/internal/user"
-	"github.com/mxcd/broke/internal/util"
 	"github.com/mxcd/broke/pkg/config"
 	"github.com/rs/zerolog/log"
 )
 
 type Plan struct {
-	UserPlans []*UserPlan `json:"userPlans"`
+	// sha256 of the configuration file the plan was computed with
+	ConfigHash string      `json:"configHash"`
+	UserPlans  []*UserPlan `json:"userPlans"`
+	// differing profile fields of users correlated across sources
+	Conflicts []*user.Conflict `json:"conflicts,omitempty"`
 }
 
 type UserPlan struct {
@@ -27,8 +31,10 @@ type Actions struct {
 }
 
 type MailcowAction struct {
-	UserTarget    *config.UserTargetConfig    `json:"userTarget"`
-	CreateAccount *MailcowCreateAccountAction `json:"createAccount"`
+	UserTarget        *config.UserTargetConfig        `json:"userTarget"`
+	CreateAccount     *MailcowCreateAccountAction     `json:"createAccount"`
+	DeactivateAccount *MailcowDeactivateAccountAction `json:"deactivateAccount"`
+	DeleteAccount     *MailcowDeleteAccountAction     `json:"deleteAccount"`
 }
 
 type MailcowCreateAccountAction struct {
@@ -36,16 +42,29 @@ type MailcowCreateAccountAction struct {
 	AuthSource string `json:"authSource"`
 }
 
+type MailcowDeactivateAccountAction struct {
+	Domain string `json:"domain"`
+}
+
+type MailcowDeleteAccountAction struct {
+	Domain string `json:"domain"`
+}
+
 type OutlineAction struct {
-	UserTarget *config.UserTargetConfig `json:"userTarget"`
-	AddGroup   *OutlineAddGroupAction   `json:"addGroup"`
-	SetRole    *OutlineSetRoleAction    `json:"setRole"`
+	UserTarget  *config.UserTargetConfig  `json:"userTarget"`
+	AddGroup    *OutlineAddGroupAction    `json:"addGroup"`
+	RemoveGroup *OutlineRemoveGroupAction `json:"removeGroup"`
+	SetRole     *OutlineSetRoleAction     `json:"setRole"`
 }
 
 type OutlineAddGroupAction struct {
 	GroupName string `json:"groupName"`
 }
 
+type OutlineRemoveGroupAction struct {
+	GroupName string `json:"groupName"`
+}
+
 type OutlineSetRoleAction struct {
 	Role string `json:"role"`
 }
@@ -53,7 +72,10 @@ type OutlineSetRoleAction struct {
 type GitlabAction struct {
 	UserTarget     *config.UserTargetConfig    `json:"userTarget"`
 	AddGroup       *GitlabAddGroupAction       `json:"addGroup"`
+	UpdateGroup    *GitlabUpdateGroupAction    `json:"updateGroup"`
+	RemoveGroup    *GitlabRemoveGroupAction    `json:"removeGroup"`
 	SetAccessLevel *GitlabSetAccessLevelAction `json:"setAccessLevel"`
+	BlockUser      *GitlabBlockUserAction      `json:"blockUser"`
 }
 
 type GitlabAddGroupAction struct {
@@ -61,82 +83,144 @@ type GitlabAddGroupAction struct {
 	PermissionLevel string `json:"permissionLevel"`
 }
 
+type GitlabUpdateGroupAction struct {
+	GroupName       string `json:"groupName"`
+	PermissionLevel string `json:"permissionLevel"`
+}
+
+type GitlabRemoveGroupAction struct {
+	GroupName string `json:"groupName"`
+}
+
 type GitlabSetAccessLevelAction struct {
 	AccessLevel string `json:"accessLevel"`
 }
 
-func (p *Plan) Print() {
+type GitlabBlockUserAction struct{}
+
+// Describe returns a short human readable description of the action
+func (a *MailcowAction) Describe() string {
+	switch {
+	case a.CreateAccount != nil:
+		return "create mailbox in domain " + a.CreateAccount.Domain
+	case a.DeactivateAccount != nil:
+		return "deactivate mailbox in domain " + a.DeactivateAccount.Domain
+	case a.DeleteAccount != nil:
+		return "delete mailbox in domain " + a.DeleteAccount.Domain
+	}
+	return "no action"
+}
 
-	if !util.GetCliContext().Bool("verbose") && !util.GetCliContext().Bool("very-verbose") {
-		return
+// Describe returns a short human readable description of the action
+func (a *OutlineAction) Describe() string {
+	switch {
+	case a.AddGroup != nil:
+		return "add to group " + a.AddGroup.GroupName
+	case a.RemoveGroup != nil:
+		return "remove from group " + a.RemoveGroup.GroupName
+	case a.SetRole != nil:
+		return "set role " + a.SetRole.Role
 	}
+	return "no action"
+}
 
-	log.Info().Msgf("Plan for %d users:", len(p.UserPlans))
+// Describe returns a short human readable description of the action
+func (a *GitlabAction) Describe() string {
+	switch {
+	case a.AddGroup != nil:
+		return "add to group " + a.AddGroup.GroupName + " as " + a.AddGroup.PermissionLevel
+	case a.UpdateGroup != nil:
+		return "update group " + a.UpdateGroup.GroupName + " to " + a.UpdateGroup.PermissionLevel
+	case a.RemoveGroup != nil:
+		return "remove from group " + a.RemoveGroup.GroupName
+	case a.SetAccessLevel != nil:
+		return "set access level " + a.SetAccessLevel.AccessLevel
+	case a.BlockUser != nil:
+		return "block user"
+	}
+	return "no action"
+}
 
-	// Iterate over each user plan and print details
-	for _, userPlan := range p.UserPlans {
+func LoadPlan(fileName string) (*Plan, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan file '%s': %w", fileName, err)
+	}
 
-		if userPlan.Actions == nil || (len(userPlan.Actions.GitlabActions) == 0 && len(userPlan.Actions.MailcowActions) == 0 && len(userPlan.Actions.OutlineActions) == 0) {
-			continue
-		}
+	plan := &Plan{}
+	err = json.Unmarshal(data, plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse plan file '%s': %w", fileName, err)
+	}
 
-		fmt.Println("---")
-		fmt.Printf("User: %s\n", userPlan.User.Username)
-
-		// Print Mailcow Actions
-		if len(userPlan.Actions.MailcowActions) > 0 {
-			fmt.Println("Mailcow Actions:")
-			mailcowTable := table.NewWriter()
-			mailcowTable.SetOutputMirror(os.Stdout)
-			mailcowTable.AppendHeader(table.Row{"User Target Name", "Domain", "Auth Source"})
-			for _, action := range userPlan.Actions.MailcowActions {
-				if action.CreateAccount != nil {
-					mailcowTable.AppendRow(table.Row{action.UserTarget.Name, action.CreateAccount.Domain, action.CreateAccount.AuthSource})
-				}
-			}
-			mailcowTable.Render()
+	for _, userPlan := range plan.UserPlans {
+		if userPlan.User == nil || userPlan.Actions == nil {
+			return nil, fmt.Errorf("invalid plan file '%s': user plan without user or actions", fileName)
 		}
+	}
 
-		// Print Outline Actions
-		if len(userPlan.Actions.OutlineActions) > 0 {
-			fmt.Println("Outline Actions:")
-			outlineTable := table.NewWriter()
-			outlineTable.SetOutputMirror(os.Stdout)
-			outlineTable.AppendHeader(table.Row{"User Target Name", "Add Group", "Set Role"})
-			for _, action := range userPlan.Actions.OutlineActions {
-				addGroup := ""
-				setRole := ""
-				if action.AddGroup != nil {
-					addGroup = action.AddGroup.GroupName
-				}
-				if action.SetRole != nil {
-					setRole = action.SetRole.Role
-				}
-				outlineTable.AppendRow(table.Row{action.UserTarget.Name, addGroup, setRole})
-			}
-			outlineTable.Render()
-		}
+	return plan, nil
+}
+
+func (p *Plan) Save(fileName string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(fileName, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write plan file '%s': %w", fileName, err)
+	}
+
+	log.Info().Msgf("Saved plan to '%s'", fileName)
+	return nil
+}
+
+// HasActions reports whether the user plan contains at least one action
+func (u *UserPlan) HasActions() bool {
+	return u.Actions != nil && (len(u.Actions.MailcowActions) > 0 || len(u.Actions.OutlineActions) > 0 || len(u.Actions.GitlabActions) > 0)
+}
+
+// Matches reports whether both plans contain the same actions for the same users.
+// Users without actions are ignored.
+func (p *Plan) Matches(other *Plan) (bool, error) {
+	fingerprint, err := p.fingerprint()
+	if err != nil {
+		return false, err
+	}
+	otherFingerprint, err := other.fingerprint()
+	if err != nil {
+		return false, err
+	}
+	return fingerprint == otherFingerprint, nil
+}
 
-		// Print Gitlab Actions
-		if len(userPlan.Actions.GitlabActions) > 0 {
-			fmt.Println("Gitlab Actions:")
-			gitlabTable := table.NewWriter()
-			gitlabTable.SetOutputMirror(os.Stdout)
-			gitlabTable.AppendHeader(table.Row{"User Target Name", "Add Group", "Permission Level", "Set Access Level"})
-			for _, action := range userPlan.Actions.GitlabActions {
-				addGroup := ""
-				permissionLevel := ""
-				setAccessLevel := ""
-				if action.AddGroup != nil {
-					addGroup = action.AddGroup.GroupName
-					permissionLevel = action.AddGroup.PermissionLevel
-				}
-				if action.SetAccessLevel != nil {
-					setAccessLevel = action.SetAccessLevel.AccessLevel
-				}
-				gitlabTable.AppendRow(table.Row{action.UserTarget.Name, addGroup, permissionLevel, setAccessLevel})
-			}
-			gitlabTable.Render()
+func (p *Plan) fingerprint() (string, error) {
+	type userActions struct {
+		Username string   `json:"username"`
+		Email    string   `json:"email"`
+		Actions  *Actions `json:"actions"`
+	}
+
+	entries := []userActions{}
+	for _, userPlan := range p.UserPlans {
+		if !userPlan.HasActions() {
+			continue
 		}
+		entries = append(entries, userActions{
+			Username: userPlan.User.Username,
+			Email:    userPlan.User.Email,
+			Actions:  userPlan.Actions,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Username < entries[j].Username
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
 	}
+	return string(data), nil
 }
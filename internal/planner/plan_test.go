@@ -0,0 +1,97 @@
+package planner
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestPlan() *Plan {
+	userTarget := &config.UserTargetConfig{
+		Name:    "mail",
+		Mailcow: &config.MailcowConfig{Url: "https://mail.example.com"},
+	}
+
+	return &Plan{
+		ConfigHash: "hash",
+		UserPlans: []*UserPlan{
+			{
+				User: &user.User{Username: "alice", Email: "alice@example.com"},
+				Actions: &Actions{
+					MailcowActions: []*MailcowAction{
+						{UserTarget: userTarget, CreateAccount: &MailcowCreateAccountAction{Domain: "example.com", AuthSource: "keycloak"}},
+					},
+				},
+			},
+			{
+				User:    &user.User{Username: "bob", Email: "bob@example.com"},
+				Actions: &Actions{},
+			},
+		},
+	}
+}
+
+func TestPlanSaveAndLoad(t *testing.T) {
+	plan := getTestPlan()
+	fileName := filepath.Join(t.TempDir(), "plan.json")
+
+	err := plan.Save(fileName)
+	assert.NoError(t, err, "error saving plan")
+
+	loadedPlan, err := LoadPlan(fileName)
+	assert.NoError(t, err, "error loading plan")
+	assert.Equal(t, plan.ConfigHash, loadedPlan.ConfigHash, "The config hash should survive a round trip")
+
+	matches, err := plan.Matches(loadedPlan)
+	assert.NoError(t, err)
+	assert.True(t, matches, "A loaded plan should match the saved plan")
+}
+
+func TestPlanMatches(t *testing.T) {
+	plan := getTestPlan()
+
+	// users without actions do not matter
+	otherPlan := getTestPlan()
+	otherPlan.UserPlans = otherPlan.UserPlans[:1]
+	matches, err := plan.Matches(otherPlan)
+	assert.NoError(t, err)
+	assert.True(t, matches, "Plans only differing in users without actions should match")
+
+	otherPlan = getTestPlan()
+	otherPlan.UserPlans[0].Actions.MailcowActions[0].CreateAccount.Domain = "example.org"
+	matches, err = plan.Matches(otherPlan)
+	assert.NoError(t, err)
+	assert.False(t, matches, "Plans with different actions should not match")
+}
+
+func TestPlanWrite(t *testing.T) {
+	plan := getTestPlan()
+
+	for _, format := range OutputFormats {
+		buffer := &bytes.Buffer{}
+		err := plan.Write(buffer, format)
+		assert.NoError(t, err, "error writing plan as %s", format)
+		assert.Contains(t, buffer.String(), "alice", "The %s output should contain users with actions", format)
+		assert.NotContains(t, buffer.String(), "bob", "The %s output should not contain users without actions", format)
+	}
+
+	buffer := &bytes.Buffer{}
+	err := plan.Write(buffer, OutputFormatYaml)
+	assert.NoError(t, err)
+	assert.Contains(t, buffer.String(), "userPlans:", "The yaml output should use the json field names")
+
+	plan.Conflicts = []*user.Conflict{{Key: "alice@example.com", Field: "username", Values: []*user.ConflictValue{
+		{Source: "ldap", Value: "adoe"},
+		{Source: "keycloak", Value: "alice.doe"},
+	}}}
+	for _, format := range OutputFormats {
+		buffer := &bytes.Buffer{}
+		err := plan.Write(buffer, format)
+		assert.NoError(t, err)
+		assert.Contains(t, buffer.String(), "alice.doe", "The %s output should contain the correlation conflicts", format)
+	}
+}
@@ -2,6 +2,10 @@ package planner
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 
 	"github.com/mxcd/broke/internal/clients"
 	"github.com/mxcd/broke/internal/user"
@@ -12,49 +16,72 @@ import (
 )
 
 type Planner struct {
-	Options   *PlannerOptions
-	Config    *config.BrokeConfig
-	ClientSet *clients.ClientSet
+	Options    *PlannerOptions
+	Config     *config.BrokeConfig
+	ConfigHash string
+	ClientSet  *clients.ClientSet
+	// set by GetUsers if only the users changed since the last run or an explicit selection were loaded from a source.
+	// Accounts in targets that belong to none of the loaded users are no orphans then.
+	partialUserSet bool
+	// states of incrementally loaded sources by state file, written once the plan was executed
+	pendingSyncStates map[string]*SyncState
+	// differing profile fields of the users correlated by GetUsers, reported in the plan
+	conflicts []*user.Conflict
 }
 
 type PlannerOptions struct {
 	ConfigFileName string
+	// format the computed plan is rendered in. Leave empty to not render the plan at all
+	OutputFormat OutputFormat
+	// file the rendered plan is written to. Leave empty for stdout
+	OutputFile string
+	// stop executing at the first failing action
+	FailFast bool
 }
 
 func NewPlanner(options *PlannerOptions) (*Planner, error) {
-	config, err := config.LoadConfig(&config.LoadConfigOptions{
+	brokeConfig, err := config.LoadConfig(&config.LoadConfigOptions{
 		ConfigFile: options.ConfigFileName,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	configHash, err := config.GetConfigFileHash(options.ConfigFileName)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Planner{
-		Options: options,
-		Config:  config,
+		Options:    options,
+		Config:     brokeConfig,
+		ConfigHash: configHash,
 	}, nil
 }
 
-func (p *Planner) Plan() error {
+func (p *Planner) Plan() (*Plan, error) {
 	ctx := context.Background()
 	err := p.InitClientSet(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	users, err := p.GetUsers(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plan, err := p.ComputePlan(ctx, users)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	plan.Print()
+	err = p.OutputPlan(plan)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return plan, nil
 }
 
 func (p *Planner) InitClientSet(ctx context.Context) error {
@@ -73,36 +100,174 @@ func (p *Planner) InitClientSet(ctx context.Context) error {
 
 func (p *Planner) GetUsers(ctx context.Context) ([]*user.User, error) {
 	users := []*user.User{}
+	p.partialUserSet = false
+	p.pendingSyncStates = map[string]*SyncState{}
+	p.conflicts = []*user.Conflict{}
 
 	for _, userSource := range p.Config.UserSources {
-		userSourceClient, err := p.ClientSet.GetUserSourceClient(userSource)
+		var usersFromSource []*user.User
+		var err error
+		if userSource.LoadConfig.Incremental != nil {
+			usersFromSource, err = p.loadIncrementalUsers(ctx, &userSource)
+		} else {
+			usersFromSource, err = p.loadUsers(ctx, &userSource)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		usersFromSource, err := userSourceClient.GetBrokeUserList(ctx)
+		filteredUsers, err := filterUsers(&userSource, usersFromSource)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, usersFromSource...)
+		users = append(users, filteredUsers...)
 	}
 
 	log.Info().Msgf("Loaded %d users from %d sources", len(users), len(p.Config.UserSources))
 
+	if p.Config.Correlation != nil {
+		users = p.correlateUsers(users)
+	} else {
+		err := checkRealmDuplicates(users)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return users, nil
 }
 
+// checkRealmDuplicates fails if users of different realms of a Keycloak source share a username or email.
+// Targets only know usernames and emails, so these users would compete for the same accounts.
+func checkRealmDuplicates(users []*user.User) error {
+	duplicates := []string{}
+	seen := map[string]*user.User{}
+	for _, brokeUser := range users {
+		if brokeUser.Realm == "" {
+			continue
+		}
+		for _, field := range []struct {
+			name  string
+			value string
+		}{
+			{"username", brokeUser.Username},
+			{"email", brokeUser.Email},
+		} {
+			if field.value == "" {
+				continue
+			}
+			key := brokeUser.Source + "/" + field.name + "/" + strings.ToLower(field.value)
+			other, ok := seen[key]
+			if !ok {
+				seen[key] = brokeUser
+				continue
+			}
+			if other.Realm != brokeUser.Realm {
+				duplicates = append(duplicates, fmt.Sprintf("%s %s in realms %s and %s of source %s", field.name, field.value, other.Realm, brokeUser.Realm, brokeUser.Source))
+			}
+		}
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("users of several realms share a username or email, configure correlation to merge them: %s", strings.Join(duplicates, "; "))
+	}
+	return nil
+}
+
+// correlateUsers merges the users that belong to the same person according to the correlation config
+func (p *Planner) correlateUsers(users []*user.User) []*user.User {
+	sourceNames := []string{}
+	for _, userSource := range p.Config.UserSources {
+		sourceNames = append(sourceNames, userSource.Name)
+	}
+
+	correlatedUsers, conflicts := user.NewCorrelator(p.Config.Correlation, sourceNames).Correlate(users)
+	log.Info().Msgf("Correlated %d users to %d persons", len(users), len(correlatedUsers))
+	for _, conflict := range conflicts {
+		log.Warn().Msgf("Correlated users of %s differ in %s, using '%s' of source %s", conflict.Key, conflict.Field, conflict.Values[0].Value, conflict.Values[0].Source)
+	}
+
+	p.conflicts = conflicts
+	return correlatedUsers
+}
+
+// loadUsers loads all users of a source, from all realms of a Keycloak source, according to its load type
+func (p *Planner) loadUsers(ctx context.Context, userSource *config.UserSourceConfig) ([]*user.User, error) {
+	userSourceClients, err := p.ClientSet.GetUserSourceClients(*userSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if userSource.LoadConfig.HasExplicitSelection() {
+		// users satisfying a mapping may be outside of the selection, so their accounts are no orphans
+		p.partialUserSet = true
+	}
+
+	users := []*user.User{}
+	for _, userSourceClient := range userSourceClients {
+		var usersFromClient []*user.User
+		if userSource.LoadConfig.GetType() == config.UserLoadTypePartial {
+			usersFromClient, err = userSourceClient.GetPartialBrokeUserList(ctx, p.GetPartialLoadSelection(userSource))
+		} else {
+			usersFromClient, err = userSourceClient.GetBrokeUserList(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, usersFromClient...)
+	}
+	return users, nil
+}
+
+// filterUsers drops the users ignored by the filter config of the source
+func filterUsers(userSource *config.UserSourceConfig, users []*user.User) ([]*user.User, error) {
+	filter, err := user.NewFilter(userSource.LoadConfig.Filter)
+	if err != nil {
+		return nil, err
+	}
+	filteredUsers := filter.Apply(users)
+	if len(filteredUsers) < len(users) {
+		log.Info().Msgf("Ignoring %d of %d users from source %s", len(users)-len(filteredUsers), len(users), userSource.Name)
+	}
+	return filteredUsers, nil
+}
+
+// GetPartialLoadSelection returns the groups, roles and usernames whose users are loaded from a source with a partial load config.
+// Unless they are listed explicitly, these are all the ones referenced by the mappings of the user targets.
+func (p *Planner) GetPartialLoadSelection(userSource *config.UserSourceConfig) *user.MappingSet {
+	loadConfig := userSource.LoadConfig
+	selection := user.NewMappingSet()
+	if loadConfig.HasExplicitSelection() {
+		selection.Groups = append(selection.Groups, loadConfig.Groups...)
+		selection.Roles = append(selection.Roles, loadConfig.Roles...)
+		selection.Usernames = append(selection.Usernames, loadConfig.Usernames...)
+		return selection
+	}
+
+	for _, userTarget := range p.Config.UserTargets {
+		for _, mapping := range userTarget.GetMappingSets() {
+			selection.FromConfig(mapping)
+		}
+	}
+	selection.Groups = unique(selection.Groups)
+	selection.Roles = unique(selection.Roles)
+	selection.Usernames = unique(selection.Usernames)
+	return selection
+}
+
 func (p *Planner) ComputePlan(ctx context.Context, users []*user.User) (*Plan, error) {
 	log.Info().Msgf("Computing plan for %d users", len(users))
 
 	plan := &Plan{
-		UserPlans: []*UserPlan{},
+		ConfigHash: p.ConfigHash,
+		UserPlans:  []*UserPlan{},
+		Conflicts:  p.conflicts,
 	}
 
 	showProgress := util.GetCliContext().Bool("progress")
 	var bar *progressbar.ProgressBar
 	if showProgress {
 		bar = progressbar.NewOptions(len(users),
+			progressbar.OptionSetWriter(util.GetLogWriter(util.GetCliContext())),
 			progressbar.OptionEnableColorCodes(true),
 			progressbar.OptionShowBytes(false),
 			progressbar.OptionSetWidth(50),
@@ -113,29 +278,89 @@ func (p *Planner) ComputePlan(ctx context.Context, users []*user.User) (*Plan, e
 		)
 	}
 
-	for _, user := range users {
-		actions, err := p.ComputeUserActions(ctx, user)
-		if err != nil {
-			return nil, err
-		}
-
-		plan.UserPlans = append(plan.UserPlans, &UserPlan{
-			User:    user,
-			Actions: actions,
-		})
-
-		if showProgress {
-			bar.Add(1)
-		}
+	userPlans, err := p.computeUserPlans(ctx, users, bar)
+	if err != nil {
+		return nil, err
 	}
+	plan.UserPlans = userPlans
 
 	if showProgress {
 		bar.Finish()
 	}
 
+	err = p.ComputePruneActions(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+
 	return plan, nil
 }
 
+// computeUserPlans computes the actions of all users with a pool of workers.
+// The user plans are returned in the order of the given users regardless of the order they are computed in.
+func (p *Planner) computeUserPlans(ctx context.Context, users []*user.User, bar *progressbar.ProgressBar) ([]*UserPlan, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	userPlans := make([]*UserPlan, len(users))
+	indices := make(chan int)
+	errs := make(chan error, 1)
+	wg := &sync.WaitGroup{}
+
+	concurrency := p.Config.GetConcurrency()
+	log.Debug().Msgf("Planning with %d workers", concurrency)
+
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				actions, err := p.ComputeUserActions(ctx, users[i])
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					cancel()
+					continue
+				}
+
+				userPlans[i] = &UserPlan{
+					User:    users[i],
+					Actions: actions,
+				}
+
+				if bar != nil {
+					bar.Add(1)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range users {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+
+	return userPlans, nil
+}
+
 func (p *Planner) ComputeUserActions(ctx context.Context, user *user.User) (*Actions, error) {
 	actions := &Actions{
 		MailcowActions: []*MailcowAction{},
@@ -149,12 +374,33 @@ func (p *Planner) ComputeUserActions(ctx context.Context, user *user.User) (*Act
 	}
 	actions.MailcowActions = mailcowActions
 
+	outlineActions, err := p.ComputeOutlineActions(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	actions.OutlineActions = outlineActions
+
+	gitlabActions, err := p.ComputeGitlabActions(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	actions.GitlabActions = gitlabActions
+
 	return actions, nil
 }
 
-func (p *Planner) Print() {
+// OutputPlan renders the plan as configured in the planner options
+func (p *Planner) OutputPlan(plan *Plan) error {
+	if p.Options.OutputFormat == "" {
+		return nil
+	}
+	return plan.WriteFile(p.Options.OutputFile, p.Options.OutputFormat)
+}
+
+// Print renders the configuration to the writer if verbose output is enabled
+func (p *Planner) Print(w io.Writer) {
 	if !util.GetCliContext().Bool("verbose") && !util.GetCliContext().Bool("very-verbose") {
 		return
 	}
-	p.Config.Print()
+	p.Config.Print(w)
 }
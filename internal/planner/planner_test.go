@@ -0,0 +1,202 @@
+package planner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPartialLoadSelection(t *testing.T) {
+	developers := "developers"
+	admins := "admins"
+	plannerInstance := &Planner{
+		Config: &config.BrokeConfig{
+			UserTargets: []config.UserTargetConfig{
+				{
+					Name: "mail",
+					Mailcow: &config.MailcowConfig{Mappings: []config.MailcowMappingConfig{
+						{KeycloakGroup: &developers},
+						{KeycloakRole: &admins, KeycloakUsernames: &[]string{"alice"}},
+					}},
+				},
+				{
+					Name: "git",
+					GitLab: &config.GitLabConfig{Mappings: []config.GitlabMappingConfig{
+						{KeycloakGroup: &developers},
+					}},
+				},
+			},
+		},
+	}
+
+	selection := plannerInstance.GetPartialLoadSelection(&config.UserSourceConfig{
+		LoadConfig: config.UserLoadConfig{Type: config.UserLoadTypePartial},
+	})
+	assert.Equal(t, []string{"developers"}, selection.Groups, "Groups of all mappings should be selected once")
+	assert.Equal(t, []string{"admins"}, selection.Roles)
+	assert.Equal(t, []string{"alice"}, selection.Usernames)
+
+	selection = plannerInstance.GetPartialLoadSelection(&config.UserSourceConfig{
+		LoadConfig: config.UserLoadConfig{Type: config.UserLoadTypePartial, Roles: []string{"staff"}},
+	})
+	assert.Empty(t, selection.Groups, "An explicit selection should replace the mappings")
+	assert.Equal(t, []string{"staff"}, selection.Roles)
+}
+
+func TestPartialLoadPrune(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]clients.MailcowMailboxResult{
+			{Active: 1, Username: "alice@example.com", Domain: "example.com", LocalPart: "alice", AuthSource: "keycloak"},
+			{Active: 1, Username: "carol@example.com", Domain: "example.com", LocalPart: "carol", AuthSource: "keycloak"},
+			{Active: 1, Username: "dave@example.com", Domain: "example.com", LocalPart: "dave", AuthSource: "keycloak"},
+		})
+	}))
+	defer server.Close()
+
+	userFile := filepath.Join(t.TempDir(), "users.yml")
+	assert.NoError(t, os.WriteFile(userFile, []byte("users:\n  - username: alice\n    groups: [developers]\n  - username: carol\n    groups: [developers]\n"), 0600))
+
+	developers := "developers"
+	userSource := config.UserSourceConfig{
+		Name:       "file",
+		File:       &config.FileConfig{Path: userFile},
+		LoadConfig: config.UserLoadConfig{Type: config.UserLoadTypePartial, Usernames: []string{"alice"}},
+	}
+	userTarget := config.UserTargetConfig{
+		Name:  "mail",
+		Prune: config.PrunePolicyDisable,
+		Mailcow: &config.MailcowConfig{Mappings: []config.MailcowMappingConfig{
+			{KeycloakGroup: &developers, Domain: "example.com", AuthSource: "keycloak"},
+		}},
+	}
+	fileClient, err := clients.NewFileClient(&clients.FileClientOptions{Name: "file", Path: userFile})
+	assert.NoError(t, err)
+	mailcowClient, err := clients.NewMailcowClient(&clients.MailcowClientOptions{Name: "mail", Url: server.URL})
+	assert.NoError(t, err)
+
+	clientSet := getEmptyClientSet()
+	clientSet.FileClients = map[string]*clients.FileClient{"file": fileClient}
+	clientSet.MailcowClients["mail"] = mailcowClient
+	plannerInstance := &Planner{
+		Config:    &config.BrokeConfig{UserSources: []config.UserSourceConfig{userSource}, UserTargets: []config.UserTargetConfig{userTarget}},
+		ClientSet: clientSet,
+	}
+
+	users, err := plannerInstance.GetUsers(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	plan := &Plan{UserPlans: []*UserPlan{{User: users[0], Actions: &Actions{}}}}
+	assert.NoError(t, plannerInstance.ComputePruneActions(context.Background(), plan))
+	assert.Len(t, plan.UserPlans, 1, "Mailboxes of users outside of an explicit selection should not be pruned")
+	assert.Empty(t, plan.UserPlans[0].Actions.MailcowActions)
+
+	userSource.LoadConfig.Usernames = nil
+	plannerInstance.Config.UserSources[0] = userSource
+	users, err = plannerInstance.GetUsers(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 2, "The mappings should select all users")
+
+	plan = &Plan{UserPlans: []*UserPlan{{User: users[0], Actions: &Actions{}}, {User: users[1], Actions: &Actions{}}}}
+	assert.NoError(t, plannerInstance.ComputePruneActions(context.Background(), plan))
+	assert.Len(t, plan.UserPlans, 3, "Mailboxes of unknown users should be pruned if the mappings select the users")
+	assert.Equal(t, "dave", plan.UserPlans[2].User.Username)
+	assert.NotNil(t, plan.UserPlans[2].Actions.MailcowActions[0].DeactivateAccount)
+}
+
+func TestGitlabPruneBlocksOnlyManagedUsers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/user":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "username": "broke"})
+		case "/api/v4/groups/developers":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 10, "name": "developers", "full_path": "developers"})
+		case "/api/v4/groups/10/members":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"id": 1, "username": "broke", "state": "active"},
+				{"id": 2, "username": "alice", "state": "active"},
+				{"id": 3, "username": "bob", "state": "active"},
+				{"id": 4, "username": "mallory", "state": "active"},
+			})
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	gitlabClient, err := clients.NewGitLabClient(&clients.GitLabClientOptions{Name: "git", Url: server.URL, Token: "token"})
+	assert.NoError(t, err)
+	clientSet := getEmptyClientSet()
+	clientSet.GitLabClients["git"] = gitlabClient
+
+	developers := "developers"
+	userTarget := config.UserTargetConfig{
+		Name:  "git",
+		Prune: config.PrunePolicyDisable,
+		GitLab: &config.GitLabConfig{Mappings: []config.GitlabMappingConfig{{
+			KeycloakGroup:          &developers,
+			GitlabGroupAssignments: &[]config.GitlabGroupAssignment{{Group: "developers", Permission: config.GitlabGroupPermissionDeveloper}},
+		}}},
+	}
+	plannerInstance := &Planner{
+		Config:    &config.BrokeConfig{UserTargets: []config.UserTargetConfig{userTarget}},
+		ClientSet: clientSet,
+	}
+	getPlan := func() *Plan {
+		return &Plan{UserPlans: []*UserPlan{
+			{User: &user.User{Source: "file", Username: "alice", Groups: []string{"developers"}}, Actions: &Actions{}},
+			{User: &user.User{Source: "file", Username: "bob", Groups: []string{}}, Actions: &Actions{}},
+		}}
+	}
+
+	plan := getPlan()
+	assert.NoError(t, plannerInstance.ComputePruneActions(context.Background(), plan))
+	assert.Len(t, plan.UserPlans, 3)
+	assert.Empty(t, plan.UserPlans[0].Actions.GitlabActions)
+	assert.Len(t, plan.UserPlans[1].Actions.GitlabActions, 2, "A source user without a satisfied mapping should be removed and blocked")
+	assert.NotNil(t, plan.UserPlans[1].Actions.GitlabActions[1].BlockUser)
+	assert.Equal(t, "mallory", plan.UserPlans[2].User.Username)
+	assert.Len(t, plan.UserPlans[2].Actions.GitlabActions, 1, "Unknown users should only be removed from the group")
+	assert.NotNil(t, plan.UserPlans[2].Actions.GitlabActions[0].RemoveGroup)
+
+	plannerInstance.Config.UserTargets[0].GitLab.BlockUnknownUsers = true
+	gitlabClient.ClearCache()
+	plan = getPlan()
+	assert.NoError(t, plannerInstance.ComputePruneActions(context.Background(), plan))
+	assert.Len(t, plan.UserPlans[2].Actions.GitlabActions, 2, "Unknown users should be blocked if enabled")
+}
+
+func TestCheckRealmDuplicates(t *testing.T) {
+	users := []*user.User{
+		{Source: "keycloak", Realm: "staff", Username: "alice", Email: "alice@example.com"},
+		{Source: "keycloak", Realm: "partners", Username: "bob", Email: "bob@example.com"},
+	}
+	assert.NoError(t, checkRealmDuplicates(users))
+
+	users = append(users, &user.User{Source: "keycloak", Realm: "partners", Username: "Alice", Email: "alice@partner.com"})
+	err := checkRealmDuplicates(users)
+	assert.ErrorContains(t, err, "username Alice in realms staff and partners", "Usernames should be unique across realms")
+
+	users[2].Username = "alice2"
+	users[2].Email = "ALICE@example.com"
+	assert.ErrorContains(t, checkRealmDuplicates(users), "email", "Emails should be unique across realms")
+}
+
+func TestUserPlanIndexCorrelatedUsers(t *testing.T) {
+	merged := &UserPlan{User: &user.User{Username: "adoe", Email: "alice.doe@example.com", CorrelatedUsernames: []string{"alice", "bob"}, CorrelatedEmails: []string{"alice@example.com"}}}
+	bob := &UserPlan{User: &user.User{Username: "bob", Email: "bob@example.com"}}
+	index := newUserPlanIndex(&Plan{UserPlans: []*UserPlan{merged, bob}}, false)
+
+	assert.Equal(t, merged, index.findByUsername("Alice"), "Accounts of correlated users should belong to the merged user")
+	assert.Equal(t, merged, index.findByEmail("alice@example.com"))
+	assert.Equal(t, bob, index.findByUsername("bob"), "A user with the username itself should take precedence")
+}
@@ -0,0 +1,411 @@
+package planner
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// gitlabBotUsernamePattern matches the users GitLab creates for group and project access tokens
+var gitlabBotUsernamePattern = regexp.MustCompile(`^(group|project)_\d+_bot`)
+
+// userPlanIndex looks up the user plans of a plan by username and email.
+// Accounts found in a target that belong to none of the source users are collected as orphans.
+type userPlanIndex struct {
+	plan             *Plan
+	byUsername       map[string]*UserPlan
+	byEmail          map[string]*UserPlan
+	orphanByUsername map[string]*UserPlan
+	orphanByEmail    map[string]*UserPlan
+	orphans          []*UserPlan
+	// the plan covers only some of the source users, so unknown accounts are skipped instead of collected as orphans
+	partial bool
+}
+
+func newUserPlanIndex(plan *Plan, partial bool) *userPlanIndex {
+	index := &userPlanIndex{
+		plan:             plan,
+		partial:          partial,
+		byUsername:       map[string]*UserPlan{},
+		byEmail:          map[string]*UserPlan{},
+		orphanByUsername: map[string]*UserPlan{},
+		orphanByEmail:    map[string]*UserPlan{},
+		orphans:          []*UserPlan{},
+	}
+	for _, userPlan := range plan.UserPlans {
+		index.byUsername[strings.ToLower(userPlan.User.Username)] = userPlan
+		if userPlan.User.Email != "" {
+			index.byEmail[strings.ToLower(userPlan.User.Email)] = userPlan
+		}
+	}
+	// accounts named after users correlated into another one belong to the merged user,
+	// unless another user has the name itself
+	for _, userPlan := range plan.UserPlans {
+		for _, username := range userPlan.User.CorrelatedUsernames {
+			if _, ok := index.byUsername[strings.ToLower(username)]; !ok {
+				index.byUsername[strings.ToLower(username)] = userPlan
+			}
+		}
+		for _, email := range userPlan.User.CorrelatedEmails {
+			if _, ok := index.byEmail[strings.ToLower(email)]; !ok {
+				index.byEmail[strings.ToLower(email)] = userPlan
+			}
+		}
+	}
+	return index
+}
+
+func (i *userPlanIndex) findByUsername(username string) *UserPlan {
+	return i.byUsername[strings.ToLower(username)]
+}
+
+func (i *userPlanIndex) findByEmail(email string) *UserPlan {
+	return i.byEmail[strings.ToLower(email)]
+}
+
+// getOrphan returns the plan for an account that is unknown to all user sources, creating it if necessary.
+// Accounts are matched by username and by email, empty values match nothing.
+func (i *userPlanIndex) getOrphan(username string, email string) *UserPlan {
+	username = strings.ToLower(username)
+	email = strings.ToLower(email)
+
+	if userPlan, ok := i.orphanByUsername[username]; ok && username != "" {
+		return userPlan
+	}
+	if userPlan, ok := i.orphanByEmail[email]; ok && email != "" {
+		return userPlan
+	}
+
+	userPlan := &UserPlan{
+		User: &user.User{
+			Username: username,
+			Email:    email,
+			Groups:   []string{},
+			Roles:    []string{},
+		},
+		Actions: &Actions{
+			MailcowActions: []*MailcowAction{},
+			OutlineActions: []*OutlineAction{},
+			GitlabActions:  []*GitlabAction{},
+		},
+	}
+	if username != "" {
+		i.orphanByUsername[username] = userPlan
+	}
+	if email != "" {
+		i.orphanByEmail[email] = userPlan
+	}
+	i.orphans = append(i.orphans, userPlan)
+	return userPlan
+}
+
+// flush appends all orphan plans to the plan, sorted by username
+func (i *userPlanIndex) flush() {
+	sort.SliceStable(i.orphans, func(a, b int) bool {
+		return i.orphans[a].User.Username < i.orphans[b].User.Username
+	})
+	i.plan.UserPlans = append(i.plan.UserPlans, i.orphans...)
+	i.orphans = []*UserPlan{}
+}
+
+// ComputePruneActions adds actions revoking access of users that no longer satisfy a mapping
+// or that have disappeared from all user sources, according to the prune policy of every target.
+func (p *Planner) ComputePruneActions(ctx context.Context, plan *Plan) error {
+	index := newUserPlanIndex(plan, p.partialUserSet)
+
+	for _, userTarget := range p.Config.UserTargets {
+		policy := userTarget.GetPrunePolicy()
+		if policy == config.PrunePolicyOff {
+			continue
+		}
+
+		log.Debug().Msgf("Computing prune actions for user target %s with policy %s", userTarget.Name, policy)
+
+		if userTarget.Mailcow != nil {
+			err := p.computeMailcowPruneActions(&userTarget, index)
+			if err != nil {
+				return err
+			}
+		}
+		if userTarget.Outline != nil {
+			err := p.computeOutlinePruneActions(&userTarget, index)
+			if err != nil {
+				return err
+			}
+		}
+		if userTarget.GitLab != nil {
+			err := p.computeGitlabPruneActions(&userTarget, index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	index.flush()
+	return nil
+}
+
+func (p *Planner) computeMailcowPruneActions(userTarget *config.UserTargetConfig, index *userPlanIndex) error {
+	mailcowClient, err := p.ClientSet.GetUserTargetMailcowClient(userTarget)
+	if err != nil {
+		return err
+	}
+
+	// domain -> auth sources of mailboxes created by broke
+	managedDomains := map[string]map[string]bool{}
+	for _, mapping := range userTarget.Mailcow.Mappings {
+		domain := strings.ToLower(mapping.Domain)
+		if _, ok := managedDomains[domain]; !ok {
+			managedDomains[domain] = map[string]bool{}
+		}
+		managedDomains[domain][mapping.AuthSource] = true
+	}
+
+	mailboxes, err := mailcowClient.GetMailboxes()
+	if err != nil {
+		return err
+	}
+
+	for _, mailbox := range mailboxes {
+		authSources, ok := managedDomains[strings.ToLower(mailbox.Domain)]
+		if !ok || !authSources[mailbox.AuthSource] {
+			continue
+		}
+
+		userPlan := index.findByUsername(mailbox.LocalPart)
+		if userPlan != nil && mailcowDomainSatisfied(userPlan.User, userTarget, mailbox.Domain) {
+			continue
+		}
+
+		if userPlan == nil && index.partial {
+			continue
+		}
+		if userPlan == nil {
+			log.Trace().Msgf("Mailbox %s belongs to no source user", mailbox.Username)
+			userPlan = index.getOrphan(mailbox.LocalPart, mailbox.Username)
+		} else {
+			log.Trace().Msgf("User %s no longer satisfies a mapping for mailbox %s", userPlan.User.Username, mailbox.Username)
+		}
+
+		if userTarget.GetPrunePolicy() == config.PrunePolicyDelete {
+			userPlan.Actions.MailcowActions = append(userPlan.Actions.MailcowActions, &MailcowAction{
+				UserTarget:    userTarget,
+				DeleteAccount: &MailcowDeleteAccountAction{Domain: mailbox.Domain},
+			})
+			continue
+		}
+
+		if mailbox.Active == 0 {
+			log.Trace().Msgf("Mailbox %s is already inactive. skipping.", mailbox.Username)
+			continue
+		}
+
+		userPlan.Actions.MailcowActions = append(userPlan.Actions.MailcowActions, &MailcowAction{
+			UserTarget:        userTarget,
+			DeactivateAccount: &MailcowDeactivateAccountAction{Domain: mailbox.Domain},
+		})
+	}
+
+	return nil
+}
+
+func mailcowDomainSatisfied(brokeUser *user.User, userTarget *config.UserTargetConfig, domain string) bool {
+	for _, mapping := range userTarget.Mailcow.Mappings {
+		if strings.EqualFold(mapping.Domain, domain) && brokeUser.IsMappingSatisfied(user.NewMappingSet().FromConfig(mapping)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Planner) computeOutlinePruneActions(userTarget *config.UserTargetConfig, index *userPlanIndex) error {
+	outlineClient, err := p.ClientSet.GetUserTargetOutlineClient(userTarget)
+	if err != nil {
+		return err
+	}
+
+	managedGroups := []string{}
+	for _, mapping := range userTarget.Outline.Mappings {
+		if mapping.OutlineGroup != nil && !contains(managedGroups, *mapping.OutlineGroup) {
+			managedGroups = append(managedGroups, *mapping.OutlineGroup)
+		}
+	}
+
+	for _, groupName := range managedGroups {
+		group, err := outlineClient.GetGroupByName(groupName)
+		if err != nil {
+			return err
+		}
+
+		members, err := outlineClient.GetGroupMembers(group.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if member.Email == "" {
+				log.Warn().Msgf("Outline user %s in group %s has no visible email address. skipping.", member.ID, groupName)
+				continue
+			}
+
+			userPlan := index.findByEmail(member.Email)
+			if userPlan != nil && outlineGroupSatisfied(userPlan.User, userTarget, groupName) {
+				continue
+			}
+
+			if userPlan == nil && index.partial {
+				continue
+			}
+			if userPlan == nil {
+				log.Trace().Msgf("Outline user %s in group %s belongs to no source user", member.Email, groupName)
+				// Outline accounts have no username, and the local part of the address may be the one of someone else
+				userPlan = index.getOrphan("", member.Email)
+			} else {
+				log.Trace().Msgf("User %s no longer satisfies a mapping for Outline group %s", userPlan.User.Username, groupName)
+			}
+
+			userPlan.Actions.OutlineActions = append(userPlan.Actions.OutlineActions, &OutlineAction{
+				UserTarget:  userTarget,
+				RemoveGroup: &OutlineRemoveGroupAction{GroupName: groupName},
+			})
+		}
+	}
+
+	return nil
+}
+
+func outlineGroupSatisfied(brokeUser *user.User, userTarget *config.UserTargetConfig, groupName string) bool {
+	for _, mapping := range userTarget.Outline.Mappings {
+		if mapping.OutlineGroup != nil && *mapping.OutlineGroup == groupName && brokeUser.IsMappingSatisfied(user.NewMappingSet().FromConfig(mapping)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Planner) computeGitlabPruneActions(userTarget *config.UserTargetConfig, index *userPlanIndex) error {
+	gitlabClient, err := p.ClientSet.GetUserTargetGitLabClient(userTarget)
+	if err != nil {
+		return err
+	}
+
+	currentUsername, err := gitlabClient.GetCurrentUsername()
+	if err != nil {
+		return err
+	}
+
+	managedGroups := []string{}
+	for _, mapping := range userTarget.GitLab.Mappings {
+		if mapping.GitlabGroupAssignments == nil {
+			continue
+		}
+		for _, assignment := range *mapping.GitlabGroupAssignments {
+			if !contains(managedGroups, assignment.Group) {
+				managedGroups = append(managedGroups, assignment.Group)
+			}
+		}
+	}
+
+	blockedUsers := map[string]bool{}
+
+	for _, groupName := range managedGroups {
+		group, err := gitlabClient.GetGroupByName(groupName)
+		if err != nil {
+			return err
+		}
+
+		members, err := gitlabClient.GetGroupMembers(group.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if member.Username == currentUsername || gitlabBotUsernamePattern.MatchString(member.Username) {
+				continue
+			}
+
+			userPlan := index.findByUsername(member.Username)
+			if userPlan != nil && gitlabGroupSatisfied(userPlan.User, userTarget, groupName) {
+				continue
+			}
+
+			if userPlan == nil && index.partial {
+				continue
+			}
+			// blocking locks the user out of the whole instance, so it is limited to users broke knows it manages
+			block := false
+			if userPlan == nil {
+				log.Trace().Msgf("Gitlab user %s in group %s belongs to no source user", member.Username, groupName)
+				userPlan = index.getOrphan(member.Username, member.Email)
+				block = userTarget.GitLab.BlockUnknownUsers
+			} else {
+				log.Trace().Msgf("User %s no longer satisfies a mapping for Gitlab group %s", userPlan.User.Username, groupName)
+				block = !gitlabTargetSatisfied(userPlan.User, userTarget)
+			}
+
+			userPlan.Actions.GitlabActions = append(userPlan.Actions.GitlabActions, &GitlabAction{
+				UserTarget:  userTarget,
+				RemoveGroup: &GitlabRemoveGroupAction{GroupName: groupName},
+			})
+
+			if !block || member.State == "blocked" || blockedUsers[member.Username] {
+				continue
+			}
+
+			blockedUsers[member.Username] = true
+			userPlan.Actions.GitlabActions = append(userPlan.Actions.GitlabActions, &GitlabAction{
+				UserTarget: userTarget,
+				BlockUser:  &GitlabBlockUserAction{},
+			})
+		}
+	}
+
+	return nil
+}
+
+func gitlabGroupSatisfied(brokeUser *user.User, userTarget *config.UserTargetConfig, groupName string) bool {
+	for _, mapping := range userTarget.GitLab.Mappings {
+		if mapping.GitlabGroupAssignments == nil || !brokeUser.IsMappingSatisfied(user.NewMappingSet().FromConfig(mapping)) {
+			continue
+		}
+		for _, assignment := range *mapping.GitlabGroupAssignments {
+			if assignment.Group == groupName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func gitlabTargetSatisfied(brokeUser *user.User, userTarget *config.UserTargetConfig) bool {
+	for _, mapping := range userTarget.GitLab.Mappings {
+		if brokeUser.IsMappingSatisfied(user.NewMappingSet().FromConfig(mapping)) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func unique(values []string) []string {
+	result := []string{}
+	for _, value := range values {
+		if !contains(result, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package planner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestMailbox(localPart string, domain string) clients.MailcowMailboxResult {
+	return clients.MailcowMailboxResult{Active: 1, Username: localPart + "@" + domain, Domain: domain, LocalPart: localPart, AuthSource: "keycloak"}
+}
+
+func TestMailcowAndOutlinePruneActions(t *testing.T) {
+	developers := "developers"
+	managers := []string{"carol"}
+
+	testCases := []struct {
+		name           string
+		users          []*user.User
+		mailboxes      []clients.MailcowMailboxResult
+		outlineMembers []clients.User
+		// usernames of the user plans in order, orphans are appended after the source users
+		expectedUsers []string
+		check         func(t *testing.T, plan *Plan)
+	}{
+		{
+			name:           "Outline orphans sharing a local part",
+			outlineMembers: []clients.User{{ID: "1", Email: "john@a.com"}, {ID: "2", Email: "john@b.com"}},
+			expectedUsers:  []string{"", ""},
+			check: func(t *testing.T, plan *Plan) {
+				assert.ElementsMatch(t, []string{"john@a.com", "john@b.com"}, []string{plan.UserPlans[0].User.Email, plan.UserPlans[1].User.Email}, "Unrelated Outline accounts should not be merged")
+				assert.Len(t, plan.UserPlans[0].Actions.OutlineActions, 1)
+				assert.Len(t, plan.UserPlans[1].Actions.OutlineActions, 1)
+			},
+		},
+		{
+			name:           "Mailcow and Outline orphans sharing a local part",
+			mailboxes:      []clients.MailcowMailboxResult{getTestMailbox("john", "a.com")},
+			outlineMembers: []clients.User{{ID: "1", Email: "john@b.com"}},
+			expectedUsers:  []string{"", "john"},
+			check: func(t *testing.T, plan *Plan) {
+				outlineOrphan, mailcowOrphan := plan.UserPlans[0], plan.UserPlans[1]
+				assert.Equal(t, "john@b.com", outlineOrphan.User.Email, "The Outline account should not be merged into the mailbox of another address")
+				assert.Len(t, outlineOrphan.Actions.OutlineActions, 1)
+				assert.Empty(t, outlineOrphan.Actions.MailcowActions)
+				assert.Len(t, mailcowOrphan.Actions.MailcowActions, 1)
+				assert.Empty(t, mailcowOrphan.Actions.OutlineActions)
+			},
+		},
+		{
+			name:           "Mailcow and Outline orphans with the same address",
+			mailboxes:      []clients.MailcowMailboxResult{getTestMailbox("john", "a.com")},
+			outlineMembers: []clients.User{{ID: "1", Email: "John@a.com"}},
+			expectedUsers:  []string{"john"},
+			check: func(t *testing.T, plan *Plan) {
+				assert.Len(t, plan.UserPlans[0].Actions.MailcowActions, 1)
+				assert.Len(t, plan.UserPlans[0].Actions.OutlineActions, 1)
+			},
+		},
+		{
+			name:           "Accounts of a correlated user",
+			users:          []*user.User{{Username: "adoe", Email: "adoe@example.com", Groups: []string{"developers"}, CorrelatedUsernames: []string{"alice"}, CorrelatedEmails: []string{"alice@example.com"}}},
+			mailboxes:      []clients.MailcowMailboxResult{getTestMailbox("alice", "example.com")},
+			outlineMembers: []clients.User{{ID: "1", Email: "alice@example.com"}},
+			expectedUsers:  []string{"adoe"},
+			check: func(t *testing.T, plan *Plan) {
+				assert.False(t, plan.UserPlans[0].HasActions(), "Accounts of correlated users should be kept")
+			},
+		},
+		{
+			name:           "Accounts of a user listed by username",
+			users:          []*user.User{{Username: "carol", Email: "carol@example.com", Groups: []string{}}},
+			mailboxes:      []clients.MailcowMailboxResult{getTestMailbox("carol", "example.com")},
+			outlineMembers: []clients.User{{ID: "1", Email: "carol@example.com"}},
+			expectedUsers:  []string{"carol"},
+			check: func(t *testing.T, plan *Plan) {
+				assert.False(t, plan.UserPlans[0].HasActions(), "Users listed in a usernames mapping should be kept")
+			},
+		},
+		{
+			name:           "Accounts of a correlated user that no longer satisfies a mapping",
+			users:          []*user.User{{Username: "adoe", Email: "adoe@example.com", Groups: []string{}, CorrelatedUsernames: []string{"alice"}, CorrelatedEmails: []string{"alice@example.com"}}},
+			mailboxes:      []clients.MailcowMailboxResult{getTestMailbox("alice", "example.com")},
+			outlineMembers: []clients.User{{ID: "1", Email: "alice@example.com"}},
+			expectedUsers:  []string{"adoe"},
+			check: func(t *testing.T, plan *Plan) {
+				assert.Len(t, plan.UserPlans[0].Actions.MailcowActions, 1, "The accounts should be pruned with the merged user instead of as orphans")
+				assert.Len(t, plan.UserPlans[0].Actions.OutlineActions, 1)
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/groups.list":
+					response := &clients.GroupsResponse{}
+					response.Data.Groups = []clients.OutlineGroup{{ID: "group1", Name: "developers"}}
+					json.NewEncoder(w).Encode(response)
+				case "/api/groups.memberships":
+					response := &clients.GroupMembershipsResponse{}
+					response.Data.Users = testCase.outlineMembers
+					json.NewEncoder(w).Encode(response)
+				default:
+					json.NewEncoder(w).Encode(testCase.mailboxes)
+				}
+			}))
+			defer server.Close()
+
+			mailcowClient, err := clients.NewMailcowClient(&clients.MailcowClientOptions{Name: "mail", Url: server.URL})
+			assert.NoError(t, err)
+			outlineClient, err := clients.NewOutlineClient(&clients.OutlineClientOptions{Name: "wiki", Url: server.URL})
+			assert.NoError(t, err)
+			clientSet := getEmptyClientSet()
+			clientSet.MailcowClients["mail"] = mailcowClient
+			clientSet.OutlineClients["wiki"] = outlineClient
+
+			plannerInstance := &Planner{
+				Config: &config.BrokeConfig{UserTargets: []config.UserTargetConfig{
+					{
+						Name:  "mail",
+						Prune: config.PrunePolicyDisable,
+						Mailcow: &config.MailcowConfig{Mappings: []config.MailcowMappingConfig{
+							{KeycloakGroup: &developers, Domain: "example.com", AuthSource: "keycloak"},
+							{KeycloakGroup: &developers, Domain: "a.com", AuthSource: "keycloak"},
+							{KeycloakUsernames: &managers, Domain: "example.com", AuthSource: "keycloak"},
+						}},
+					},
+					{
+						Name:  "wiki",
+						Prune: config.PrunePolicyDisable,
+						Outline: &config.OutlineConfig{Mappings: []config.OutlineMappingConfig{
+							{KeycloakGroup: &developers, OutlineGroup: &developers},
+							{KeycloakUsernames: &managers, OutlineGroup: &developers},
+						}},
+					},
+				}},
+				ClientSet: clientSet,
+			}
+
+			plan := &Plan{UserPlans: []*UserPlan{}}
+			for _, brokeUser := range testCase.users {
+				plan.UserPlans = append(plan.UserPlans, &UserPlan{User: brokeUser, Actions: &Actions{}})
+			}
+			assert.NoError(t, plannerInstance.ComputePruneActions(context.Background(), plan))
+
+			usernames := []string{}
+			for _, userPlan := range plan.UserPlans {
+				usernames = append(usernames, userPlan.User.Username)
+			}
+			assert.Equal(t, testCase.expectedUsers, usernames)
+			if len(usernames) == len(testCase.expectedUsers) {
+				testCase.check(t, plan)
+			}
+		})
+	}
+}
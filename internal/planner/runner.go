@@ -2,15 +2,85 @@ package planner
 
 import (
 	"context"
+	"fmt"
+	"io"
 
+	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
 	"github.com/mxcd/broke/internal/util"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
 	"github.com/schollz/progressbar/v3"
 )
 
 type Runner struct {
 	Context   context.Context
 	ClientSet *clients.ClientSet
+	// stop at the first failing action instead of executing all remaining actions
+	FailFast bool
+	Report   *ExecutionReport
+}
+
+type ExecutionReport struct {
+	Succeeded int                 `json:"succeeded"`
+	Failures  []*ExecutionFailure `json:"failures"`
+}
+
+type ExecutionFailure struct {
+	Username   string `json:"username"`
+	UserTarget string `json:"userTarget"`
+	Action     string `json:"action"`
+	Error      string `json:"error"`
+}
+
+func NewRunner(ctx context.Context, clientSet *clients.ClientSet, failFast bool) *Runner {
+	return &Runner{
+		Context:   ctx,
+		ClientSet: clientSet,
+		FailFast:  failFast,
+		Report: &ExecutionReport{
+			Failures: []*ExecutionFailure{},
+		},
+	}
+}
+
+// Succeed records a successfully executed action
+func (r *Runner) Succeed() {
+	r.Report.Succeeded++
+}
+
+// Fail records a failed action. The error is returned again in fail fast mode to abort the execution.
+func (r *Runner) Fail(userPlan *UserPlan, userTarget *config.UserTargetConfig, action string, err error) error {
+	log.Error().Err(err).Msgf("Failed to %s for user %s on user target %s", action, userPlan.User.Username, userTarget.Name)
+
+	r.Report.Failures = append(r.Report.Failures, &ExecutionFailure{
+		Username:   userPlan.User.Username,
+		UserTarget: userTarget.Name,
+		Action:     action,
+		Error:      err.Error(),
+	})
+
+	if r.FailFast {
+		return err
+	}
+	return nil
+}
+
+// Print renders a summary of the execution and a table of all failures
+func (r *ExecutionReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Executed %d actions: %d succeeded, %d failed\n", r.Succeeded+len(r.Failures), r.Succeeded, len(r.Failures))
+	if len(r.Failures) == 0 {
+		return
+	}
+
+	failureTable := table.NewWriter()
+	failureTable.SetOutputMirror(w)
+	failureTable.AppendHeader(table.Row{"User", "User Target Name", "Action", "Error"})
+	for _, failure := range r.Failures {
+		failureTable.AppendRow(table.Row{failure.Username, failure.UserTarget, failure.Action, failure.Error})
+	}
+	failureTable.Render()
 }
 
 func (p *Planner) Run() error {
@@ -20,6 +90,11 @@ func (p *Planner) Run() error {
 		return err
 	}
 
+	return p.Reconcile(ctx)
+}
+
+// Reconcile computes a plan with the already initialized client set and executes it
+func (p *Planner) Reconcile(ctx context.Context) error {
 	users, err := p.GetUsers(ctx)
 	if err != nil {
 		return err
@@ -30,26 +105,126 @@ func (p *Planner) Run() error {
 		return err
 	}
 
-	if util.GetCliContext().Bool("verbose") || util.GetCliContext().Bool("very-verbose") {
-		plan.Print()
+	err = p.OutputPlan(plan)
+	if err != nil {
+		return err
 	}
 
-	runner := &Runner{
-		Context:   ctx,
-		ClientSet: p.ClientSet,
+	runner := NewRunner(ctx, p.ClientSet, p.Options.FailFast)
+	err = plan.Execute(runner)
+	if err != nil {
+		return err
 	}
+	return p.saveSyncStates()
+}
 
-	plan.Execute(runner)
+// ReconcileUser loads a single user from the sources and executes the plan for just that user.
+// Accounts of other users in the targets are left untouched. If the user is found in no source,
+// for example because it was deleted, all users are reconciled instead so that its accounts are pruned.
+func (p *Planner) ReconcileUser(ctx context.Context, sourceName string, userId string) error {
+	if p.Config.Correlation != nil {
+		log.Info().Msgf("Reconciling all users instead of user %s, since correlated users are merged from all sources", userId)
+		return p.Reconcile(ctx)
+	}
 
-	return nil
+	users := []*user.User{}
+	for _, userSource := range p.Config.UserSources {
+		if sourceName != "" && userSource.Name != sourceName {
+			continue
+		}
+
+		userSourceClients, err := p.ClientSet.GetUserSourceClients(userSource)
+		if err != nil {
+			return err
+		}
+		usersFromSource := []*user.User{}
+		for _, userSourceClient := range userSourceClients {
+			usersFromClient, err := userSourceClient.GetBrokeUsersByIds(ctx, []string{userId})
+			if err != nil {
+				return err
+			}
+			usersFromSource = append(usersFromSource, usersFromClient...)
+		}
+		filteredUsers, err := filterUsers(&userSource, usersFromSource)
+		if err != nil {
+			return err
+		}
+		users = append(users, filteredUsers...)
+	}
+
+	if len(users) == 0 {
+		log.Info().Msgf("User %s was not found in any user source, reconciling all users", userId)
+		return p.Reconcile(ctx)
+	}
+
+	p.partialUserSet = true
+	p.pendingSyncStates = map[string]*SyncState{}
+
+	plan, err := p.ComputePlan(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	err = p.OutputPlan(plan)
+	if err != nil {
+		return err
+	}
+
+	runner := NewRunner(ctx, p.ClientSet, p.Options.FailFast)
+	return plan.Execute(runner)
+}
+
+// Apply executes a previously saved plan. It refuses to do so if the configuration changed since the plan was computed
+// or if planning against the current state of sources and targets yields different actions.
+func (p *Planner) Apply(savedPlan *Plan) error {
+	if savedPlan.ConfigHash != p.ConfigHash {
+		return fmt.Errorf("plan is stale: configuration file '%s' changed since the plan was computed", p.Options.ConfigFileName)
+	}
+
+	ctx := context.Background()
+	err := p.InitClientSet(ctx)
+	if err != nil {
+		return err
+	}
+
+	users, err := p.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("Re-computing plan to check saved plan against the current state")
+	currentPlan, err := p.ComputePlan(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	matches, err := savedPlan.Matches(currentPlan)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return fmt.Errorf("plan is stale: the current state of user sources and targets yields different actions")
+	}
+
+	savedPlan.Print()
+
+	runner := NewRunner(ctx, p.ClientSet, p.Options.FailFast)
+	err = savedPlan.Execute(runner)
+	if err != nil {
+		return err
+	}
+	return p.saveSyncStates()
 }
 
+// Execute runs all actions of the plan. Unless the runner is in fail fast mode, failing actions do not stop the execution.
+// An error is returned if any action failed.
 func (p *Plan) Execute(runner *Runner) error {
 
 	showProgress := util.GetCliContext().Bool("progress")
 	var bar *progressbar.ProgressBar
 	if showProgress {
 		bar = progressbar.NewOptions(len(p.UserPlans),
+			progressbar.OptionSetWriter(util.GetLogWriter(util.GetCliContext())),
 			progressbar.OptionEnableColorCodes(true),
 			progressbar.OptionShowBytes(false),
 			progressbar.OptionSetWidth(50),
@@ -64,10 +239,24 @@ func (p *Plan) Execute(runner *Runner) error {
 		if userPlan.Actions.MailcowActions != nil {
 			err := ExecuteUserMailcowActions(runner, userPlan)
 			if err != nil {
+				runner.Report.Print(util.GetLogWriter(util.GetCliContext()))
+				return err
+			}
+		}
+		if userPlan.Actions.OutlineActions != nil {
+			err := ExecuteUserOutlineActions(runner, userPlan)
+			if err != nil {
+				runner.Report.Print(util.GetLogWriter(util.GetCliContext()))
+				return err
+			}
+		}
+		if userPlan.Actions.GitlabActions != nil {
+			err := ExecuteUserGitlabActions(runner, userPlan)
+			if err != nil {
+				runner.Report.Print(util.GetLogWriter(util.GetCliContext()))
 				return err
 			}
 		}
-		// TODO: add more targets
 
 		if showProgress {
 			bar.Add(1)
@@ -77,5 +266,10 @@ func (p *Plan) Execute(runner *Runner) error {
 	if showProgress {
 		bar.Finish()
 	}
+
+	runner.Report.Print(util.GetLogWriter(util.GetCliContext()))
+	if len(runner.Report.Failures) > 0 {
+		return fmt.Errorf("%d of %d actions failed", len(runner.Report.Failures), runner.Report.Succeeded+len(runner.Report.Failures))
+	}
 	return nil
 }
@@ -0,0 +1,68 @@
+package planner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/user"
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func getEmptyClientSet() *clients.ClientSet {
+	return &clients.ClientSet{
+		KeycloakClients: map[string]*clients.KeycloakClient{},
+		MailcowClients:  map[string]*clients.MailcowClient{},
+		OutlineClients:  map[string]*clients.OutlineClient{},
+		GitLabClients:   map[string]*clients.GitLabClient{},
+	}
+}
+
+func TestExecuteContinuesOnError(t *testing.T) {
+	plan := getTestPlan()
+	plan.UserPlans = append(plan.UserPlans, &UserPlan{
+		User:    &user.User{Username: "carol", Email: "carol@example.com"},
+		Actions: getTestPlan().UserPlans[0].Actions,
+	})
+
+	// there is no client for the target, so every action fails
+	runner := NewRunner(context.Background(), getEmptyClientSet(), false)
+	err := plan.Execute(runner)
+	assert.Error(t, err, "Execution should fail if an action fails")
+	assert.Len(t, runner.Report.Failures, 2, "All failing actions should be reported")
+	assert.Equal(t, "alice", runner.Report.Failures[0].Username)
+	assert.Equal(t, "carol", runner.Report.Failures[1].Username)
+	assert.Equal(t, "mail", runner.Report.Failures[1].UserTarget)
+
+	runner = NewRunner(context.Background(), getEmptyClientSet(), true)
+	err = plan.Execute(runner)
+	assert.Error(t, err, "Execution should fail if an action fails")
+	assert.Len(t, runner.Report.Failures, 1, "Execution should stop at the first failure in fail fast mode")
+}
+
+func TestServeStopsWhenCancelled(t *testing.T) {
+	plannerInstance := &Planner{
+		Options: &PlannerOptions{},
+		Config:  &config.BrokeConfig{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	trigger := make(chan struct{}, 1)
+	trigger <- struct{}{}
+	go func() {
+		// wait for the triggered run to be picked up before stopping
+		for len(trigger) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	err := plannerInstance.Serve(ctx, &ServeOptions{Interval: time.Hour, Trigger: trigger})
+	assert.NoError(t, err, "Serve should stop without error when the context is cancelled")
+	assert.NotNil(t, plannerInstance.ClientSet, "The client set should be initialized once")
+
+	err = plannerInstance.Serve(context.Background(), &ServeOptions{})
+	assert.Error(t, err, "Serve should require an interval")
+}
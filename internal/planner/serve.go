@@ -0,0 +1,91 @@
+package planner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type ServeOptions struct {
+	// time between the start of two scheduled runs
+	Interval time.Duration
+	// receiving on this channel starts a run right away. A trigger arriving during a run starts another run after it
+	Trigger <-chan struct{}
+	// receiving on this channel reconciles the user of the event right away
+	UserEvents <-chan *UserEvent
+}
+
+// UserEvent asks the daemon to reconcile a single user. Without a user id, all users are reconciled.
+type UserEvent struct {
+	// user source the user belongs to. Leave empty to look the user up in all sources
+	Source string
+	UserId string
+}
+
+// Serve keeps the client set alive and reconciles on every interval and trigger until the context is cancelled.
+// Runs never overlap. A failing run is logged and does not stop the daemon.
+func (p *Planner) Serve(ctx context.Context, options *ServeOptions) error {
+	if options.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", options.Interval)
+	}
+
+	err := p.InitClientSet(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Reconciling every %s", options.Interval)
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+
+	p.serveRun(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Stopping")
+			return nil
+		case <-ticker.C:
+			log.Info().Msg("Starting scheduled run")
+			p.serveRun(ctx)
+		case <-options.Trigger:
+			log.Info().Msg("Starting triggered run")
+			p.serveRun(ctx)
+		case event := <-options.UserEvents:
+			if event.UserId == "" {
+				log.Info().Msg("Starting run triggered by an event")
+				p.serveRun(ctx)
+				continue
+			}
+			log.Info().Msgf("Starting run for user %s triggered by an event", event.UserId)
+			p.serveUserRun(ctx, event)
+		}
+	}
+}
+
+func (p *Planner) serveRun(ctx context.Context) {
+	start := time.Now()
+
+	// targets may have been changed by others since the last run
+	p.ClientSet.ClearCaches()
+
+	err := p.Reconcile(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("Run failed after %s", time.Since(start).Round(time.Millisecond))
+		return
+	}
+	log.Info().Msgf("Run finished after %s", time.Since(start).Round(time.Millisecond))
+}
+
+func (p *Planner) serveUserRun(ctx context.Context, event *UserEvent) {
+	start := time.Now()
+	p.ClientSet.ClearCaches()
+
+	err := p.ReconcileUser(ctx, event.Source, event.UserId)
+	if err != nil {
+		log.Error().Err(err).Msgf("Run for user %s failed after %s", event.UserId, time.Since(start).Round(time.Millisecond))
+		return
+	}
+	log.Info().Msgf("Run for user %s finished after %s", event.UserId, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,405 @@
+package scim
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+type HandlerOptions struct {
+	Store *Store
+	// bearer token the identity provider authenticates with
+	Token string
+	// called after every change with the id of each affected user, or with an empty id if all users may be affected
+	OnChange func(userId string)
+}
+
+// filterPattern matches the only filters supported, equality of a single attribute like userName eq "alice"
+var filterPattern = regexp.MustCompile(`^(\w+) eq "([^"]*)"$`)
+
+// RegisterRoutes adds the /Users, /Groups and /ServiceProviderConfig endpoints to the router
+func RegisterRoutes(router gin.IRouter, options *HandlerOptions) {
+	h := &handler{options: options}
+
+	group := router.Group("", h.authenticate)
+	group.GET("/ServiceProviderConfig", h.getServiceProviderConfig)
+	group.GET("/Users", h.listUsers)
+	group.POST("/Users", h.createUser)
+	group.GET("/Users/:id", h.getUser)
+	group.PUT("/Users/:id", h.replaceUser)
+	group.PATCH("/Users/:id", h.patchUser)
+	group.DELETE("/Users/:id", h.deleteUser)
+	group.GET("/Groups", h.listGroups)
+	group.POST("/Groups", h.createGroup)
+	group.GET("/Groups/:id", h.getGroup)
+	group.PUT("/Groups/:id", h.replaceGroup)
+	group.PATCH("/Groups/:id", h.patchGroup)
+	group.DELETE("/Groups/:id", h.deleteGroup)
+}
+
+type handler struct {
+	options *HandlerOptions
+}
+
+type listResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+type errorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func respondError(c *gin.Context, status int, scimType string, detail string) {
+	c.AbortWithStatusJSON(status, &errorResponse{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// respondStoreError translates the errors of the store into SCIM errors
+func respondStoreError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		respondError(c, http.StatusNotFound, "", err.Error())
+	case errors.Is(err, ErrConflict):
+		respondError(c, http.StatusConflict, "uniqueness", err.Error())
+	case errors.Is(err, ErrInvalidValue):
+		respondError(c, http.StatusBadRequest, "invalidValue", err.Error())
+	default:
+		log.Error().Err(err).Msg("Failed to update SCIM store")
+		respondError(c, http.StatusInternalServerError, "", "failed to update the directory")
+	}
+}
+
+func (h *handler) authenticate(c *gin.Context) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if h.options.Token == "" || !found || subtle.ConstantTimeCompare([]byte(token), []byte(h.options.Token)) != 1 {
+		log.Warn().Msgf("Rejected SCIM request from %s: invalid token", c.ClientIP())
+		respondError(c, http.StatusUnauthorized, "", "invalid token")
+		return
+	}
+	c.Next()
+}
+
+func (h *handler) changed(userId string) {
+	if h.options.OnChange != nil {
+		h.options.OnChange(userId)
+	}
+}
+
+// groupChanged reports the users whose membership changed. Renaming a group may affect all of its members
+// and those of other groups with the same name, so it reports all users.
+func (h *handler) groupChanged(before *Group, after *Group) {
+	if before != nil && after != nil && before.DisplayName != after.DisplayName {
+		h.changed("")
+		return
+	}
+
+	memberIds := func(group *Group) map[string]bool {
+		ids := map[string]bool{}
+		if group != nil {
+			for _, member := range group.Members {
+				ids[member.Value] = true
+			}
+		}
+		return ids
+	}
+	beforeIds := memberIds(before)
+	afterIds := memberIds(after)
+	for id := range beforeIds {
+		if !afterIds[id] {
+			h.changed(id)
+		}
+	}
+	for id := range afterIds {
+		if !beforeIds[id] {
+			h.changed(id)
+		}
+	}
+}
+
+func (h *handler) getServiceProviderConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": 1000},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Authentication with a shared bearer token",
+		}},
+	})
+}
+
+// parseFilter returns the attribute and value of an equality filter or empty strings without a filter
+func parseFilter(c *gin.Context) (string, string, bool) {
+	filter := strings.TrimSpace(c.Query("filter"))
+	if filter == "" {
+		return "", "", true
+	}
+	match := filterPattern.FindStringSubmatch(filter)
+	if match == nil {
+		respondError(c, http.StatusBadRequest, "invalidFilter", fmt.Sprintf("unsupported filter '%s'", filter))
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// paginate applies the 1-based startIndex and count query parameters
+func paginate[T any](c *gin.Context, resources []T) {
+	startIndex, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(len(resources))))
+	if err != nil || count < 0 {
+		count = len(resources)
+	}
+
+	page := []T{}
+	if startIndex <= len(resources) {
+		end := min(startIndex-1+count, len(resources))
+		page = resources[startIndex-1 : end]
+	}
+
+	c.JSON(http.StatusOK, &listResponse{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+func (h *handler) listUsers(c *gin.Context) {
+	attribute, value, ok := parseFilter(c)
+	if !ok {
+		return
+	}
+
+	users := []*User{}
+	for _, user := range h.options.Store.ListUsers() {
+		switch strings.ToLower(attribute) {
+		case "":
+		case "username":
+			if !strings.EqualFold(user.UserName, value) {
+				continue
+			}
+		case "externalid":
+			if user.ExternalId != value {
+				continue
+			}
+		case "id":
+			if user.Id != value {
+				continue
+			}
+		default:
+			respondError(c, http.StatusBadRequest, "invalidFilter", fmt.Sprintf("unsupported filter attribute '%s'", attribute))
+			return
+		}
+		users = append(users, user)
+	}
+	paginate(c, users)
+}
+
+func (h *handler) getUser(c *gin.Context) {
+	user, err := h.options.Store.GetUser(c.Param("id"))
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func bindUser(c *gin.Context) (*User, bool) {
+	user := &User{}
+	if err := c.ShouldBindJSON(user); err != nil {
+		respondError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return nil, false
+	}
+	if user.UserName == "" {
+		respondError(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return nil, false
+	}
+	return user, true
+}
+
+func (h *handler) createUser(c *gin.Context) {
+	user, ok := bindUser(c)
+	if !ok {
+		return
+	}
+	user, err := h.options.Store.CreateUser(user)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.changed(user.Id)
+	c.JSON(http.StatusCreated, user)
+}
+
+func (h *handler) replaceUser(c *gin.Context) {
+	user, ok := bindUser(c)
+	if !ok {
+		return
+	}
+	user, err := h.options.Store.ReplaceUser(c.Param("id"), user)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.changed(user.Id)
+	c.JSON(http.StatusOK, user)
+}
+
+func (h *handler) patchUser(c *gin.Context) {
+	request := &PatchRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		respondError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	user, err := h.options.Store.PatchUser(c.Param("id"), request.Operations)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.changed(user.Id)
+	c.JSON(http.StatusOK, user)
+}
+
+func (h *handler) deleteUser(c *gin.Context) {
+	err := h.options.Store.DeleteUser(c.Param("id"))
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	// the accounts of a deleted user are only found when reconciling all users
+	h.changed("")
+	c.Status(http.StatusNoContent)
+}
+
+func (h *handler) listGroups(c *gin.Context) {
+	attribute, value, ok := parseFilter(c)
+	if !ok {
+		return
+	}
+
+	groups := []*Group{}
+	for _, group := range h.options.Store.ListGroups() {
+		switch strings.ToLower(attribute) {
+		case "":
+		case "displayname":
+			if group.DisplayName != value {
+				continue
+			}
+		case "externalid":
+			if group.ExternalId != value {
+				continue
+			}
+		case "id":
+			if group.Id != value {
+				continue
+			}
+		default:
+			respondError(c, http.StatusBadRequest, "invalidFilter", fmt.Sprintf("unsupported filter attribute '%s'", attribute))
+			return
+		}
+		groups = append(groups, group)
+	}
+	paginate(c, groups)
+}
+
+func (h *handler) getGroup(c *gin.Context) {
+	group, err := h.options.Store.GetGroup(c.Param("id"))
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+func bindGroup(c *gin.Context) (*Group, bool) {
+	group := &Group{}
+	if err := c.ShouldBindJSON(group); err != nil {
+		respondError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return nil, false
+	}
+	if group.DisplayName == "" {
+		respondError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return nil, false
+	}
+	return group, true
+}
+
+func (h *handler) createGroup(c *gin.Context) {
+	group, ok := bindGroup(c)
+	if !ok {
+		return
+	}
+	group, err := h.options.Store.CreateGroup(group)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.groupChanged(nil, group)
+	c.JSON(http.StatusCreated, group)
+}
+
+func (h *handler) replaceGroup(c *gin.Context) {
+	group, ok := bindGroup(c)
+	if !ok {
+		return
+	}
+	existing, group, err := h.options.Store.ReplaceGroup(c.Param("id"), group)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.groupChanged(existing, group)
+	c.JSON(http.StatusOK, group)
+}
+
+func (h *handler) patchGroup(c *gin.Context) {
+	request := &PatchRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		respondError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	existing, group, err := h.options.Store.PatchGroup(c.Param("id"), request.Operations)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.groupChanged(existing, group)
+	c.JSON(http.StatusOK, group)
+}
+
+func (h *handler) deleteGroup(c *gin.Context) {
+	existing, err := h.options.Store.DeleteGroup(c.Param("id"))
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	h.groupChanged(existing, nil)
+	c.Status(http.StatusNoContent)
+}
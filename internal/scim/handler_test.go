@@ -0,0 +1,125 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func sendScim(router *gin.Engine, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/scim+json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestScimHandler(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "scim.json")
+	store, err := NewStore(storeFile)
+	assert.Nil(t, err)
+
+	changed := []string{}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	RegisterRoutes(router, &HandlerOptions{
+		Store:    store,
+		Token:    "token",
+		OnChange: func(userId string) { changed = append(changed, userId) },
+	})
+
+	response := sendScim(router, http.MethodGet, "/Users", "", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Requests with a wrong token should be rejected")
+
+	response = sendScim(router, http.MethodPost, "/Users", `{"userName":"alice","name":{"givenName":"Alice","familyName":"Doe"},"emails":[{"value":"alice@example.com","primary":true}],"active":true}`, "token")
+	assert.Equal(t, http.StatusCreated, response.Code)
+	alice := &User{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), alice))
+	assert.NotEmpty(t, alice.Id)
+	assert.Equal(t, "alice@example.com", alice.GetEmail())
+
+	response = sendScim(router, http.MethodPost, "/Users", `{"userName":"ALICE"}`, "token")
+	assert.Equal(t, http.StatusConflict, response.Code, "User names should be unique")
+
+	response = sendScim(router, http.MethodGet, `/Users?filter=userName%20eq%20%22alice%22`, "", "token")
+	assert.Equal(t, http.StatusOK, response.Code)
+	list := &listResponse{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), list))
+	assert.Equal(t, 1, list.TotalResults)
+
+	response = sendScim(router, http.MethodPost, "/Groups", `{"displayName":"developers","members":[{"value":"`+alice.Id+`"}]}`, "token")
+	assert.Equal(t, http.StatusCreated, response.Code)
+	developers := &Group{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), developers))
+
+	directory, err := LoadDirectory(storeFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"developers"}, directory.GetUserGroups(alice.Id), "The directory should be persisted")
+
+	response = sendScim(router, http.MethodPatch, "/Groups/"+developers.Id, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"remove","path":"members[value eq \"`+alice.Id+`\"]"}]}`, "token")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, store.directory.GetUserGroups(alice.Id))
+
+	response = sendScim(router, http.MethodPatch, "/Users/"+alice.Id, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`, "token")
+	assert.Equal(t, http.StatusOK, response.Code)
+	user, err := store.GetUser(alice.Id)
+	assert.Nil(t, err)
+	assert.False(t, user.IsActive())
+	assert.Equal(t, "alice", user.UserName, "Patching should keep the other attributes")
+
+	response = sendScim(router, http.MethodDelete, "/Users/"+alice.Id, "", "token")
+	assert.Equal(t, http.StatusNoContent, response.Code)
+
+	assert.Equal(t, []string{alice.Id, alice.Id, alice.Id, alice.Id, ""}, changed)
+}
+
+func TestStorePatchGroupConcurrently(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "scim.json"))
+	assert.Nil(t, err)
+	group, err := store.CreateGroup(&Group{DisplayName: "developers"})
+	assert.Nil(t, err)
+
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			_, _, err := store.PatchGroup(group.Id, []PatchOperation{{Op: "add", Path: "members", Value: []interface{}{map[string]interface{}{"value": strconv.Itoa(i)}}}})
+			assert.Nil(t, err)
+		}(i)
+	}
+	waitGroup.Wait()
+
+	group, err = store.GetGroup(group.Id)
+	assert.Nil(t, err)
+	assert.Len(t, group.Members, 20, "Concurrent patches should not overwrite each other")
+
+	_, _, err = store.PatchGroup(group.Id, []PatchOperation{{Op: "remove", Path: "displayName"}})
+	assert.ErrorIs(t, err, ErrInvalidValue)
+}
+
+func TestStoreKeepsDirectoryOnFailedSave(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "store")
+	assert.Nil(t, os.Mkdir(directory, 0700))
+	store, err := NewStore(filepath.Join(directory, "scim.json"))
+	assert.Nil(t, err)
+	_, err = store.CreateUser(&User{UserName: "alice"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.RemoveAll(directory))
+	_, err = store.CreateUser(&User{UserName: "bob"})
+	assert.NotNil(t, err)
+	assert.Len(t, store.ListUsers(), 1, "A user that could not be saved should not be stored")
+}
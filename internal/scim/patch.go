@@ -0,0 +1,160 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+type PatchOperation struct {
+	// add, replace or remove. Some identity providers capitalize it
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// valueFilterPathPattern matches paths selecting entries of a multi-valued attribute like members[value eq "id"]
+var valueFilterPathPattern = regexp.MustCompile(`^(\w+)\[value eq "([^"]*)"\]$`)
+
+// applyPatch applies the operations to the JSON representation of source and decodes the result into target.
+// Paths may name a top level attribute, a sub-attribute like name.givenName or entries of a multi-valued attribute
+// selected by value. Attribute names are matched regardless of case.
+func applyPatch(source interface{}, target interface{}, operations []PatchOperation) error {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	resource := map[string]interface{}{}
+	err = json.Unmarshal(data, &resource)
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range operations {
+		err = applyOperation(resource, operation)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err = json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func applyOperation(resource map[string]interface{}, operation PatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("unsupported patch operation '%s'", operation.Op)
+	}
+
+	if operation.Path == "" {
+		if op == "remove" {
+			return fmt.Errorf("remove requires a path")
+		}
+		values, ok := operation.Value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s without a path requires an object value", op)
+		}
+		for name, value := range values {
+			setAttribute(resource, name, value, op == "add")
+		}
+		return nil
+	}
+
+	if match := valueFilterPathPattern.FindStringSubmatch(operation.Path); match != nil {
+		if op != "remove" {
+			return fmt.Errorf("unsupported path '%s' for %s", operation.Path, op)
+		}
+		key := findKey(resource, match[1])
+		resource[key] = removeValues(resource[key], []interface{}{map[string]interface{}{"value": match[2]}})
+		return nil
+	}
+
+	switch op {
+	case "remove":
+		key := findKey(resource, strings.Split(operation.Path, ".")[0])
+		values, isList := operation.Value.([]interface{})
+		if _, hasList := resource[key].([]interface{}); isList && hasList && !strings.Contains(operation.Path, ".") {
+			resource[key] = removeValues(resource[key], values)
+			return nil
+		}
+		removeAttribute(resource, operation.Path)
+	default:
+		setAttribute(resource, operation.Path, operation.Value, op == "add")
+	}
+	return nil
+}
+
+func findKey(resource map[string]interface{}, name string) string {
+	for key := range resource {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// setAttribute sets a possibly dotted attribute. Adding to a multi-valued attribute appends the values.
+func setAttribute(resource map[string]interface{}, path string, value interface{}, add bool) {
+	name, subName, nested := strings.Cut(path, ".")
+	key := findKey(resource, name)
+	if nested {
+		parent, ok := resource[key].(map[string]interface{})
+		if !ok {
+			parent = map[string]interface{}{}
+			resource[key] = parent
+		}
+		setAttribute(parent, subName, value, add)
+		return
+	}
+
+	existing, isList := resource[key].([]interface{})
+	if add && isList {
+		if values, ok := value.([]interface{}); ok {
+			resource[key] = append(existing, values...)
+			return
+		}
+	}
+	resource[key] = value
+}
+
+func removeAttribute(resource map[string]interface{}, path string) {
+	name, subName, nested := strings.Cut(path, ".")
+	key := findKey(resource, name)
+	if !nested {
+		delete(resource, key)
+		return
+	}
+	if parent, ok := resource[key].(map[string]interface{}); ok {
+		removeAttribute(parent, subName)
+	}
+}
+
+// removeValues drops the entries of a multi-valued attribute whose value matches one of the given entries
+func removeValues(existing interface{}, values []interface{}) []interface{} {
+	remove := map[interface{}]bool{}
+	for _, value := range values {
+		if entry, ok := value.(map[string]interface{}); ok {
+			remove[entry["value"]] = true
+		}
+	}
+
+	result := []interface{}{}
+	list, _ := existing.([]interface{})
+	for _, entry := range list {
+		if entryMap, ok := entry.(map[string]interface{}); ok && remove[entryMap["value"]] {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
@@ -0,0 +1,394 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	UserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+type User struct {
+	Schemas     []string     `json:"schemas"`
+	Id          string       `json:"id"`
+	ExternalId  string       `json:"externalId,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *Name        `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Emails      []MultiValue `json:"emails,omitempty"`
+	Roles       []MultiValue `json:"roles,omitempty"`
+	Active      *bool        `json:"active,omitempty"`
+	Meta        *Meta        `json:"meta,omitempty"`
+}
+
+type Name struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+// MultiValue is an entry of a multi-valued attribute like emails, roles or members
+type MultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Group struct {
+	Schemas     []string     `json:"schemas"`
+	Id          string       `json:"id"`
+	ExternalId  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []MultiValue `json:"members,omitempty"`
+	Meta        *Meta        `json:"meta,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// GetEmail returns the primary email or the first one if none is marked as primary
+func (u *User) GetEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+func (u *User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+// Directory is the content of the store file
+type Directory struct {
+	Users  []*User  `json:"users"`
+	Groups []*Group `json:"groups"`
+}
+
+// GetUserGroups returns the display names of the groups the user is a member of
+func (d *Directory) GetUserGroups(userId string) []string {
+	groups := []string{}
+	for _, group := range d.Groups {
+		for _, member := range group.Members {
+			if member.Value == userId {
+				groups = append(groups, group.DisplayName)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// LoadDirectory reads a store file. A missing file yields an empty directory.
+func LoadDirectory(path string) (*Directory, error) {
+	directory := &Directory{Users: []*User{}, Groups: []*Group{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return directory, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, directory)
+	if err != nil {
+		return nil, err
+	}
+	return directory, nil
+}
+
+// Store keeps the directory pushed by an identity provider and writes it to a file after every change
+type Store struct {
+	path      string
+	mutex     *sync.Mutex
+	directory *Directory
+}
+
+func NewStore(path string) (*Store, error) {
+	directory, err := LoadDirectory(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		path:      path,
+		mutex:     &sync.Mutex{},
+		directory: directory,
+	}, nil
+}
+
+// save writes the directory to a temporary file first, so that readers never see a partially written file.
+// Mutators change a copy of the directory and only swap it in once it is saved, so that a failed write changes nothing.
+func (s *Store) save(directory *Directory) error {
+	data, err := json.MarshalIndent(directory, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempFile.Name(), s.path)
+	if err != nil {
+		return err
+	}
+	s.directory = directory
+	return nil
+}
+
+// copyDirectory returns a directory with copies of the user and group lists. Users and groups are never modified
+// in place, but replaced, since handlers may still be encoding them.
+func (s *Store) copyDirectory() *Directory {
+	return &Directory{
+		Users:  slices.Clone(s.directory.Users),
+		Groups: slices.Clone(s.directory.Groups),
+	}
+}
+
+var ErrNotFound = errors.New("resource not found")
+var ErrConflict = errors.New("resource already exists")
+var ErrInvalidValue = errors.New("invalid value")
+
+func (s *Store) ListUsers() []*User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.directory.Users)
+}
+
+func (s *Store) GetUser(id string) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index := s.findUser(id)
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+	return s.directory.Users[index], nil
+}
+
+func (s *Store) findUser(id string) int {
+	return slices.IndexFunc(s.directory.Users, func(user *User) bool { return user.Id == id })
+}
+
+// CreateUser assigns an id to the user and stores it. User names are unique regardless of case.
+func (s *Store) CreateUser(user *User) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, existing := range s.directory.Users {
+		if strings.EqualFold(existing.UserName, user.UserName) {
+			return nil, ErrConflict
+		}
+	}
+
+	now := time.Now().UTC()
+	user.Id = uuid.NewString()
+	user.Schemas = []string{UserSchema}
+	user.Meta = &Meta{ResourceType: "User", Created: now, LastModified: now}
+	directory := s.copyDirectory()
+	directory.Users = append(directory.Users, user)
+	return user, s.save(directory)
+}
+
+// ReplaceUser stores the user under the id of an existing user
+func (s *Store) ReplaceUser(id string, user *User) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.replaceUser(id, user)
+}
+
+func (s *Store) replaceUser(id string, user *User) (*User, error) {
+	index := s.findUser(id)
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+	for _, existing := range s.directory.Users {
+		if existing.Id != id && strings.EqualFold(existing.UserName, user.UserName) {
+			return nil, ErrConflict
+		}
+	}
+
+	created := s.directory.Users[index].Meta.Created
+	user.Id = id
+	user.Schemas = []string{UserSchema}
+	user.Meta = &Meta{ResourceType: "User", Created: created, LastModified: time.Now().UTC()}
+	directory := s.copyDirectory()
+	directory.Users[index] = user
+	return user, s.save(directory)
+}
+
+// PatchUser applies the operations to the stored user. Errors of invalid operations wrap ErrInvalidValue.
+func (s *Store) PatchUser(id string, operations []PatchOperation) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.findUser(id)
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+	user := &User{}
+	err := applyPatch(s.directory.Users[index], user, operations)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidValue, err.Error())
+	}
+	if user.UserName == "" {
+		return nil, fmt.Errorf("%w: userName is required", ErrInvalidValue)
+	}
+	return s.replaceUser(id, user)
+}
+
+// DeleteUser removes the user and its group memberships
+func (s *Store) DeleteUser(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.findUser(id)
+	if index < 0 {
+		return ErrNotFound
+	}
+	directory := s.copyDirectory()
+	directory.Users = slices.Delete(directory.Users, index, index+1)
+	for i, group := range directory.Groups {
+		updated := *group
+		updated.Members = slices.DeleteFunc(slices.Clone(group.Members), func(member MultiValue) bool { return member.Value == id })
+		directory.Groups[i] = &updated
+	}
+	return s.save(directory)
+}
+
+func (s *Store) ListGroups() []*Group {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.directory.Groups)
+}
+
+func (s *Store) GetGroup(id string) (*Group, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index := s.findGroup(id)
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+	return s.directory.Groups[index], nil
+}
+
+func (s *Store) findGroup(id string) int {
+	return slices.IndexFunc(s.directory.Groups, func(group *Group) bool { return group.Id == id })
+}
+
+func (s *Store) CreateGroup(group *Group) (*Group, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, existing := range s.directory.Groups {
+		if existing.DisplayName == group.DisplayName {
+			return nil, ErrConflict
+		}
+	}
+
+	now := time.Now().UTC()
+	group.Id = uuid.NewString()
+	group.Schemas = []string{GroupSchema}
+	group.Meta = &Meta{ResourceType: "Group", Created: now, LastModified: now}
+	directory := s.copyDirectory()
+	directory.Groups = append(directory.Groups, group)
+	return group, s.save(directory)
+}
+
+// ReplaceGroup stores the group under the id of an existing group and returns the replaced and the stored group
+func (s *Store) ReplaceGroup(id string, group *Group) (*Group, *Group, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.replaceGroup(id, group)
+}
+
+func (s *Store) replaceGroup(id string, group *Group) (*Group, *Group, error) {
+	index := s.findGroup(id)
+	if index < 0 {
+		return nil, nil, ErrNotFound
+	}
+	for _, existing := range s.directory.Groups {
+		if existing.Id != id && existing.DisplayName == group.DisplayName {
+			return nil, nil, ErrConflict
+		}
+	}
+
+	existing := s.directory.Groups[index]
+	group.Id = id
+	group.Schemas = []string{GroupSchema}
+	group.Meta = &Meta{ResourceType: "Group", Created: existing.Meta.Created, LastModified: time.Now().UTC()}
+	directory := s.copyDirectory()
+	directory.Groups[index] = group
+	err := s.save(directory)
+	if err != nil {
+		return nil, nil, err
+	}
+	return existing, group, nil
+}
+
+// PatchGroup applies the operations to the stored group and returns the replaced and the stored group.
+// Errors of invalid operations wrap ErrInvalidValue.
+func (s *Store) PatchGroup(id string, operations []PatchOperation) (*Group, *Group, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.findGroup(id)
+	if index < 0 {
+		return nil, nil, ErrNotFound
+	}
+	group := &Group{}
+	err := applyPatch(s.directory.Groups[index], group, operations)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidValue, err.Error())
+	}
+	if group.DisplayName == "" {
+		return nil, nil, fmt.Errorf("%w: displayName is required", ErrInvalidValue)
+	}
+	return s.replaceGroup(id, group)
+}
+
+// DeleteGroup removes the group and returns it
+func (s *Store) DeleteGroup(id string) (*Group, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.findGroup(id)
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+	existing := s.directory.Groups[index]
+	directory := s.copyDirectory()
+	directory.Groups = slices.Delete(directory.Groups, index, index+1)
+	return existing, s.save(directory)
+}
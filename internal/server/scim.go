@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/mxcd/broke/internal/planner"
+	"github.com/mxcd/broke/internal/scim"
+	"github.com/rs/zerolog/log"
+)
+
+type ScimOptions struct {
+	// name of the user source, which is part of the endpoint path /scim/<name>/v2
+	Name  string
+	Store *scim.Store
+	// bearer token the identity provider authenticates with
+	Token string
+	// the reconciles of the changed users are sent to this channel
+	Events chan<- *planner.UserEvent
+}
+
+// RegisterScim adds the SCIM 2.0 endpoint of a user source at /scim/<name>/v2
+func (s *Server) RegisterScim(options *ScimOptions) {
+	scim.RegisterRoutes(s.Router.Group(fmt.Sprintf("/scim/%s/v2", options.Name)), &scim.HandlerOptions{
+		Store: options.Store,
+		Token: options.Token,
+		OnChange: func(userId string) {
+			select {
+			case options.Events <- &planner.UserEvent{Source: options.Name, UserId: userId}:
+			default:
+				// the change is persisted and picked up by the next scheduled run
+				log.Warn().Str("source", options.Name).Msgf("Dropped SCIM reconcile of user '%s': too many pending events", userId)
+			}
+		},
+	})
+	log.Info().Str("source", options.Name).Msgf("Serving SCIM endpoint at /scim/%s/v2", options.Name)
+}
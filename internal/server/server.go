@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+type ServerOptions struct {
+	// address the server listens on, e.g. ":8080"
+	Listen string
+}
+
+// Server is the HTTP server of the daemon. Features like the webhook register their routes on its router.
+type Server struct {
+	Options *ServerOptions
+	Router  *gin.Engine
+}
+
+func NewServer(options *ServerOptions) *Server {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	return &Server{
+		Options: options,
+		Router:  router,
+	}
+}
+
+// Run serves until the context is cancelled and shuts down gracefully afterwards
+func (s *Server) Run(ctx context.Context) error {
+	httpServer := &http.Server{
+		Addr:              s.Options.Listen,
+		Handler:           s.Router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := httpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to shut down HTTP server")
+		}
+	}()
+
+	log.Info().Msgf("Listening on %s", s.Options.Listen)
+	err := httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mxcd/broke/internal/clients"
+	"github.com/mxcd/broke/internal/planner"
+	"github.com/rs/zerolog/log"
+)
+
+// header carrying the hex encoded HMAC-SHA256 of the request body, as sent by the Keycloak webhook event listener
+const webhookSignatureHeader = "X-Keycloak-Signature"
+
+// header carrying the unix time in seconds the request was signed at. If it is set, the signature covers the
+// timestamp followed by a dot and the body, so that old requests cannot be replayed.
+const webhookTimestampHeader = "X-Keycloak-Timestamp"
+
+// signed requests older than this, or this far in the future, are rejected
+const webhookMaxTimestampSkew = 5 * time.Minute
+
+// maximum size of an event payload
+const webhookMaxBodySize = 1 << 20
+
+// user events of Keycloak after which the user has to be reconciled. All others, like logins, are ignored.
+var webhookUserEventTypes = map[string]bool{
+	"REGISTER":                       true,
+	"UPDATE_PROFILE":                 true,
+	"UPDATE_EMAIL":                   true,
+	"VERIFY_EMAIL":                   true,
+	"IDENTITY_PROVIDER_FIRST_LOGIN":  true,
+	"IDENTITY_PROVIDER_LINK_ACCOUNT": true,
+}
+
+type WebhookOptions struct {
+	// shared secret. Requests are authenticated by an HMAC-SHA256 signature of the body or by the secret as bearer token
+	Secret string
+	// reject signatures without a timestamp, which could be replayed
+	RequireTimestamp bool
+	// the reconciles requested by the received events are sent to this channel
+	Events chan<- *planner.UserEvent
+}
+
+// keycloakWebhookEvent covers the admin and user events sent by Keycloak webhook event listeners
+type keycloakWebhookEvent struct {
+	// type of user events, optionally prefixed with a category like "access.REGISTER"
+	Type   string `json:"type"`
+	UserId string `json:"userId"`
+	// set on admin events
+	ResourceType  string `json:"resourceType"`
+	OperationType string `json:"operationType"`
+	ResourcePath  string `json:"resourcePath"`
+}
+
+// RegisterWebhook adds the endpoint receiving Keycloak events. The optional query parameter source restricts
+// the lookup of the affected user to the user source of that name.
+func (s *Server) RegisterWebhook(options *WebhookOptions) {
+	// serializes the capacity check and the sending of the reconciles of concurrent requests
+	enqueueMutex := &sync.Mutex{}
+
+	s.Router.POST("/webhook/keycloak", func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, webhookMaxBodySize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
+			return
+		}
+
+		if !authenticateWebhook(c.Request, body, options, time.Now()) {
+			log.Warn().Msgf("Rejected webhook request from %s: invalid signature", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+			return
+		}
+
+		event := &keycloakWebhookEvent{}
+		err = json.Unmarshal(body, event)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid event payload"})
+			return
+		}
+
+		userEvents, ok := getUserEvents(event, c.Query("source"))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "event refers to no user"})
+			return
+		}
+
+		enqueueMutex.Lock()
+		defer enqueueMutex.Unlock()
+		// all reconciles of an event are queued or none, so that a retry of the sender does not repeat some of them
+		if cap(options.Events)-len(options.Events) < len(userEvents) {
+			// let the sender retry later instead of blocking it
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many pending events"})
+			return
+		}
+		for _, userEvent := range userEvents {
+			// other producers like the SCIM endpoints may have taken the capacity in the meantime, so wait for it
+			select {
+			case options.Events <- userEvent:
+			case <-c.Request.Context().Done():
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many pending events"})
+				return
+			}
+		}
+
+		log.Debug().Msgf("Accepted webhook event %s%s with %d reconciles", event.Type, event.ResourceType, len(userEvents))
+		c.JSON(http.StatusAccepted, gin.H{"reconciles": len(userEvents)})
+	})
+}
+
+func authenticateWebhook(request *http.Request, body []byte, options *WebhookOptions, now time.Time) bool {
+	if options.Secret == "" {
+		return false
+	}
+
+	if signature := request.Header.Get(webhookSignatureHeader); signature != "" {
+		expected, err := hex.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(options.Secret))
+
+		timestamp := request.Header.Get(webhookTimestampHeader)
+		if timestamp != "" {
+			seconds, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return false
+			}
+			skew := now.Sub(time.Unix(seconds, 0))
+			if skew > webhookMaxTimestampSkew || skew < -webhookMaxTimestampSkew {
+				return false
+			}
+			mac.Write([]byte(timestamp + "."))
+		} else if options.RequireTimestamp {
+			return false
+		}
+
+		mac.Write(body)
+		return hmac.Equal(mac.Sum(nil), expected)
+	}
+
+	token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(options.Secret)) == 1
+}
+
+// getUserEvents translates a Keycloak event into the reconciles it requires. Irrelevant events yield none.
+// Admin events that cannot be attributed to single users yield a reconcile of all users.
+func getUserEvents(event *keycloakWebhookEvent, source string) ([]*planner.UserEvent, bool) {
+	if event.ResourceType != "" {
+		ids, requiresFullSync := planner.GetAffectedUserIds([]*clients.KeycloakAdminEvent{{
+			ResourceType:  event.ResourceType,
+			OperationType: event.OperationType,
+			ResourcePath:  event.ResourcePath,
+		}})
+		if requiresFullSync {
+			return []*planner.UserEvent{{Source: source}}, true
+		}
+		userEvents := []*planner.UserEvent{}
+		for _, id := range ids {
+			userEvents = append(userEvents, &planner.UserEvent{Source: source, UserId: id})
+		}
+		return userEvents, true
+	}
+
+	if event.Type == "" {
+		return nil, false
+	}
+	eventType := event.Type[strings.LastIndex(event.Type, ".")+1:]
+	if !webhookUserEventTypes[eventType] {
+		return []*planner.UserEvent{}, true
+	}
+	if event.UserId == "" {
+		return nil, false
+	}
+	return []*planner.UserEvent{{Source: source, UserId: event.UserId}}, true
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxcd/broke/internal/planner"
+	"github.com/stretchr/testify/assert"
+)
+
+func sendWebhook(server *Server, body string, header string, value string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/webhook/keycloak?source=keycloak", strings.NewReader(body))
+	if header != "" {
+		request.Header.Set(header, value)
+	}
+	recorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func sign(body string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhook(t *testing.T) {
+	events := make(chan *planner.UserEvent, 10)
+	server := NewServer(&ServerOptions{})
+	server.RegisterWebhook(&WebhookOptions{Secret: "secret", Events: events})
+
+	body := `{"type":"admin.GROUP_MEMBERSHIP-CREATE","resourceType":"GROUP_MEMBERSHIP","operationType":"CREATE","resourcePath":"users/alice/groups/developers"}`
+	response := sendWebhook(server, body, webhookSignatureHeader, sign(body, "secret"))
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, &planner.UserEvent{Source: "keycloak", UserId: "alice"}, <-events)
+
+	response = sendWebhook(server, body, webhookSignatureHeader, sign(body, "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Requests with a wrong signature should be rejected")
+
+	response = sendWebhook(server, body, "", "")
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Unsigned requests should be rejected")
+
+	body = `{"type":"access.UPDATE_PROFILE","userId":"bob"}`
+	response = sendWebhook(server, body, "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, &planner.UserEvent{Source: "keycloak", UserId: "bob"}, <-events)
+
+	body = `{"type":"access.LOGIN","userId":"bob"}`
+	response = sendWebhook(server, body, "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Empty(t, events, "Logins should not trigger a reconcile")
+
+	body = `{"resourceType":"GROUP","operationType":"DELETE","resourcePath":"groups/developers"}`
+	response = sendWebhook(server, body, "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, &planner.UserEvent{Source: "keycloak"}, <-events, "Group changes should trigger a reconcile of all users")
+}
+
+func TestWebhookTimestamp(t *testing.T) {
+	options := &WebhookOptions{Secret: "secret"}
+	body := []byte(`{"type":"access.UPDATE_PROFILE","userId":"bob"}`)
+	now := time.Now()
+	signedRequest := func(timestamp time.Time) *http.Request {
+		value := strconv.FormatInt(timestamp.Unix(), 10)
+		request := httptest.NewRequest(http.MethodPost, "/webhook/keycloak", nil)
+		request.Header.Set(webhookTimestampHeader, value)
+		request.Header.Set(webhookSignatureHeader, sign(value+"."+string(body), "secret"))
+		return request
+	}
+
+	assert.True(t, authenticateWebhook(signedRequest(now), body, options, now))
+	assert.False(t, authenticateWebhook(signedRequest(now.Add(-10*time.Minute)), body, options, now), "Old requests should be rejected")
+
+	request := signedRequest(now)
+	request.Header.Set(webhookTimestampHeader, strconv.FormatInt(now.Unix()+1, 10))
+	assert.False(t, authenticateWebhook(request, body, options, now), "The timestamp should be covered by the signature")
+
+	request = httptest.NewRequest(http.MethodPost, "/webhook/keycloak", nil)
+	request.Header.Set(webhookSignatureHeader, sign(string(body), "secret"))
+	assert.True(t, authenticateWebhook(request, body, options, now))
+	options.RequireTimestamp = true
+	assert.False(t, authenticateWebhook(request, body, options, now), "Signatures without timestamp should be rejected if required")
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	events := make(chan *planner.UserEvent, 2)
+	events <- &planner.UserEvent{Source: "keycloak", UserId: "alice"}
+	server := NewServer(&ServerOptions{})
+	server.RegisterWebhook(&WebhookOptions{Secret: "secret", Events: events})
+
+	body := `{"type":"access.UPDATE_PROFILE","userId":"bob"}`
+	response := sendWebhook(server, body, "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Len(t, events, 2)
+
+	body = `{"type":"access.UPDATE_PROFILE","userId":"carol"}`
+	response = sendWebhook(server, body, "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Events should be rejected if the queue is full")
+	assert.Len(t, events, 2)
+}
@@ -0,0 +1,223 @@
+package user
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mxcd/broke/pkg/config"
+)
+
+// Conflict is a profile field whose value differs between users correlated to the same person
+type Conflict struct {
+	// value of the correlation key the users share
+	Key   string `json:"key"`
+	Field string `json:"field"`
+	// the first value is the one of the merged user
+	Values []*ConflictValue `json:"values"`
+}
+
+type ConflictValue struct {
+	// name of the user source, followed by the realm for Keycloak sources with several realms
+	Source string `json:"source"`
+	Value  string `json:"value"`
+}
+
+// Correlator merges the users of all sources that belong to the same person
+type Correlator struct {
+	config *config.CorrelationConfig
+	// rank of every user source, lower ranks take precedence
+	ranks map[string]int
+}
+
+// NewCorrelator ranks the sources by the configured precedence, followed by the remaining sources in the given order
+func NewCorrelator(correlationConfig *config.CorrelationConfig, sourceNames []string) *Correlator {
+	ranks := map[string]int{}
+	for _, name := range append(slices.Clone(correlationConfig.Precedence), sourceNames...) {
+		if _, ok := ranks[name]; !ok {
+			ranks[name] = len(ranks)
+		}
+	}
+	return &Correlator{config: correlationConfig, ranks: ranks}
+}
+
+// getKey returns the normalized value the user is correlated by or an empty string if the user is not correlated
+func (c *Correlator) getKey(user *User) string {
+	switch c.config.GetKey() {
+	case config.CorrelationKeyUsername:
+		return strings.ToLower(user.Username)
+	case config.CorrelationKeyAttribute:
+		for _, value := range user.Attributes[c.config.Attribute] {
+			if value != "" {
+				return value
+			}
+		}
+		return ""
+	default:
+		// anyone could claim an unverified address of someone else
+		if !user.EmailVerified {
+			return ""
+		}
+		return strings.ToLower(user.Email)
+	}
+}
+
+// Correlate returns one user per person in the order the persons first appear in the given users.
+// Users without a value for the correlation key are returned unchanged.
+func (c *Correlator) Correlate(users []*User) ([]*User, []*Conflict) {
+	keys := []string{}
+	usersByKey := map[string][]*User{}
+	result := []*User{}
+	// position of the merged users of every key in the result
+	positions := map[string]int{}
+
+	for _, user := range users {
+		key := c.getKey(user)
+		if key == "" {
+			result = append(result, user)
+			continue
+		}
+		if _, ok := usersByKey[key]; !ok {
+			keys = append(keys, key)
+			positions[key] = len(result)
+			result = append(result, user)
+		}
+		usersByKey[key] = append(usersByKey[key], user)
+	}
+
+	conflicts := []*Conflict{}
+	for _, key := range keys {
+		correlated := usersByKey[key]
+		if len(correlated) == 1 {
+			continue
+		}
+		// users of the same source keep the order they were loaded in
+		slices.SortStableFunc(correlated, func(a, b *User) int {
+			return c.ranks[a.Source] - c.ranks[b.Source]
+		})
+		merged, mergeConflicts := c.merge(key, correlated)
+		result[positions[key]] = merged
+		conflicts = append(conflicts, mergeConflicts...)
+	}
+	return result, conflicts
+}
+
+// merge combines the users, which are sorted by precedence, into a copy of the first one
+func (c *Correlator) merge(key string, users []*User) (*User, []*Conflict) {
+	primary := users[0]
+	merged := &User{
+		Id:            primary.Id,
+		Source:        primary.Source,
+		Realm:         primary.Realm,
+		Username:      primary.Username,
+		Email:         primary.Email,
+		Groups:        slices.Clone(primary.Groups),
+		GroupPaths:    slices.Clone(primary.GroupPaths),
+		Roles:         slices.Clone(primary.Roles),
+		FirstName:     primary.FirstName,
+		LastName:      primary.LastName,
+		Enabled:       primary.Enabled,
+		EmailVerified: primary.EmailVerified,
+		Attributes:    map[string][]string{},
+	}
+	for name, values := range primary.Attributes {
+		merged.Attributes[name] = values
+	}
+
+	for _, other := range users[1:] {
+		merged.CorrelatedUsers = append(merged.CorrelatedUsers, getSourceName(other)+":"+other.Id)
+
+		// empty profile fields are filled regardless of the merge policy
+		for _, field := range []struct {
+			value *string
+			other string
+		}{
+			{&merged.Username, other.Username},
+			{&merged.Email, other.Email},
+			{&merged.FirstName, other.FirstName},
+			{&merged.LastName, other.LastName},
+		} {
+			if *field.value == "" {
+				*field.value = field.other
+			}
+		}
+		if strings.EqualFold(merged.Email, other.Email) && other.EmailVerified {
+			merged.EmailVerified = true
+		}
+		if other.Username != "" && !strings.EqualFold(merged.Username, other.Username) && !containsFold(merged.CorrelatedUsernames, other.Username) {
+			merged.CorrelatedUsernames = append(merged.CorrelatedUsernames, other.Username)
+		}
+		if other.Email != "" && !strings.EqualFold(merged.Email, other.Email) && !containsFold(merged.CorrelatedEmails, other.Email) {
+			merged.CorrelatedEmails = append(merged.CorrelatedEmails, other.Email)
+		}
+
+		if c.config.GetMerge() != config.CorrelationMergeUnion {
+			continue
+		}
+		for _, group := range other.Groups {
+			merged.AddGroup(group, "", false)
+		}
+		for _, path := range other.GroupPaths {
+			if !slices.Contains(merged.GroupPaths, path) {
+				merged.GroupPaths = append(merged.GroupPaths, path)
+			}
+		}
+		for _, role := range other.Roles {
+			if !slices.Contains(merged.Roles, role) {
+				merged.Roles = append(merged.Roles, role)
+			}
+		}
+		for name, values := range other.Attributes {
+			if _, ok := merged.Attributes[name]; !ok {
+				merged.Attributes[name] = values
+			}
+		}
+	}
+
+	return merged, getConflicts(key, users)
+}
+
+// getConflicts compares the profile fields of the users with the ones of the first user. Empty values are no conflicts.
+func getConflicts(key string, users []*User) []*Conflict {
+	fields := []struct {
+		name  string
+		value func(*User) string
+	}{
+		{"username", func(u *User) string { return u.Username }},
+		{"email", func(u *User) string { return strings.ToLower(u.Email) }},
+		{"firstName", func(u *User) string { return u.FirstName }},
+		{"lastName", func(u *User) string { return u.LastName }},
+		{"enabled", func(u *User) string { return strconv.FormatBool(u.Enabled) }},
+	}
+
+	conflicts := []*Conflict{}
+	for _, field := range fields {
+		values := []*ConflictValue{}
+		differs := false
+		for _, user := range users {
+			value := field.value(user)
+			if value == "" {
+				continue
+			}
+			if len(values) > 0 && value != values[0].Value {
+				differs = true
+			}
+			values = append(values, &ConflictValue{Source: getSourceName(user), Value: value})
+		}
+		if differs {
+			conflicts = append(conflicts, &Conflict{Key: key, Field: field.name, Values: values})
+		}
+	}
+	return conflicts
+}
+
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, value) })
+}
+
+func getSourceName(user *User) string {
+	if user.Realm == "" {
+		return user.Source
+	}
+	return user.Source + "/" + user.Realm
+}
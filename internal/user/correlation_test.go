@@ -0,0 +1,56 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelate(t *testing.T) {
+	users := []*User{
+		{Id: "1", Source: "keycloak", Username: "alice", Email: "alice@example.com", EmailVerified: true, Enabled: true, Groups: []string{"developers"}, Attributes: map[string][]string{"department": {"sales"}}},
+		{Id: "2", Source: "keycloak", Username: "bob", Email: "bob@example.com", EmailVerified: true, Enabled: true, Groups: []string{}},
+		{Id: "cn=alice", Source: "ldap", Username: "adoe", Email: "Alice@example.com", EmailVerified: true, Enabled: true, FirstName: "Alice", Groups: []string{"admins"}, Attributes: map[string][]string{"department": {"it"}, "office": {"berlin"}}},
+		{Id: "mallory", Source: "file", Username: "mallory", Email: "bob@example.com", Enabled: true, Groups: []string{"admins"}},
+	}
+	correlationConfig := &config.CorrelationConfig{Precedence: []string{"ldap"}}
+
+	correlated, conflicts := NewCorrelator(correlationConfig, []string{"keycloak", "ldap", "file"}).Correlate(users)
+	assert.Len(t, correlated, 3, "Users with the same verified email should be merged")
+
+	alice := correlated[0]
+	assert.Equal(t, "adoe", alice.Username, "The user of the source with the highest precedence should win")
+	assert.Equal(t, "ldap", alice.Source)
+	assert.Equal(t, []string{"keycloak:1"}, alice.CorrelatedUsers)
+	assert.Equal(t, []string{"alice"}, alice.CorrelatedUsernames, "Differing usernames of correlated users should be kept")
+	assert.Empty(t, alice.CorrelatedEmails, "Emails should be compared regardless of case")
+	assert.ElementsMatch(t, []string{"admins", "developers"}, alice.Groups)
+	assert.Equal(t, map[string][]string{"department": {"it"}, "office": {"berlin"}}, alice.Attributes)
+	assert.Equal(t, "mallory", correlated[2].Username, "Unverified emails should not be correlated")
+
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, "username", conflicts[0].Field)
+	assert.Equal(t, []*ConflictValue{{Source: "ldap", Value: "adoe"}, {Source: "keycloak", Value: "alice"}}, conflicts[0].Values)
+
+	correlationConfig.Merge = config.CorrelationMergePrecedence
+	correlated, _ = NewCorrelator(correlationConfig, []string{"keycloak", "ldap", "file"}).Correlate(users)
+	assert.Equal(t, []string{"admins"}, correlated[0].Groups, "Only the groups of the winning user should be kept")
+	assert.Equal(t, []string{"developers"}, users[0].Groups, "Source users should not be modified")
+}
+
+func TestCorrelateByAttribute(t *testing.T) {
+	users := []*User{
+		{Id: "1", Source: "keycloak", Realm: "staff", Username: "alice", Roles: []string{"admin"}, Attributes: map[string][]string{"employeeId": {"42"}}},
+		{Id: "2", Source: "keycloak", Realm: "partners", Username: "alice", Roles: []string{"partner"}, Attributes: map[string][]string{"employeeId": {"42"}}},
+		{Id: "3", Source: "keycloak", Realm: "partners", Username: "bob"},
+	}
+	correlationConfig := &config.CorrelationConfig{Key: config.CorrelationKeyAttribute, Attribute: "employeeId"}
+
+	correlated, conflicts := NewCorrelator(correlationConfig, []string{"keycloak"}).Correlate(users)
+	assert.Len(t, correlated, 2)
+	assert.Equal(t, "staff", correlated[0].Realm, "Users of the same source should keep the order they were loaded in")
+	assert.Equal(t, []string{"admin", "partner"}, correlated[0].Roles)
+	assert.Equal(t, []string{"keycloak/partners:2"}, correlated[0].CorrelatedUsers)
+	assert.Empty(t, conflicts)
+}
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// prefix of the users Keycloak creates for the service accounts of clients
+const serviceAccountUsernamePrefix = "service-account-"
+
+// Filter drops the users of a source that should be ignored according to its filter config
+type Filter struct {
+	config           config.UserFilterConfig
+	includeUsernames []*regexp.Regexp
+	excludeUsernames []*regexp.Regexp
+	includeEmails    []*regexp.Regexp
+	excludeEmails    []*regexp.Regexp
+}
+
+func NewFilter(filterConfig config.UserFilterConfig) (*Filter, error) {
+	filter := &Filter{config: filterConfig}
+
+	var err error
+	if filter.includeUsernames, err = compilePatterns(filterConfig.IncludeUsernames); err != nil {
+		return nil, err
+	}
+	if filter.excludeUsernames, err = compilePatterns(filterConfig.ExcludeUsernames); err != nil {
+		return nil, err
+	}
+	if filter.includeEmails, err = compilePatterns(filterConfig.IncludeEmails); err != nil {
+		return nil, err
+	}
+	if filter.excludeEmails, err = compilePatterns(filterConfig.ExcludeEmails); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, compiled)
+	}
+	return result, nil
+}
+
+// Apply returns the users that pass the filter. Every filtered user is reported in the debug output.
+func (f *Filter) Apply(users []*User) []*User {
+	result := []*User{}
+	for _, user := range users {
+		reason := f.GetExclusionReason(user)
+		if reason != "" {
+			log.Debug().Msgf("Ignoring user %s of source %s: %s", user.Username, user.Source, reason)
+			continue
+		}
+		result = append(result, user)
+	}
+	return result
+}
+
+// GetExclusionReason explains why the user is filtered or returns an empty string if the user passes the filter
+func (f *Filter) GetExclusionReason(user *User) string {
+	if f.config.SkipDisabled && !user.Enabled {
+		return "user is disabled"
+	}
+	if f.config.RequireVerifiedEmail && (user.Email == "" || !user.EmailVerified) {
+		return "email is missing or not verified"
+	}
+	if f.config.ExcludeServiceAccounts && strings.HasPrefix(user.Username, serviceAccountUsernamePrefix) {
+		return "user is a service account"
+	}
+	if len(f.includeUsernames) > 0 && !matchesAny(f.includeUsernames, user.Username) {
+		return "username matches no include pattern"
+	}
+	if matchesAny(f.excludeUsernames, user.Username) {
+		return "username matches an exclude pattern"
+	}
+	if len(f.includeEmails) > 0 && !matchesAny(f.includeEmails, user.Email) {
+		return "email matches no include pattern"
+	}
+	if matchesAny(f.excludeEmails, user.Email) {
+		return "email matches an exclude pattern"
+	}
+	return ""
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,33 +1,61 @@
 package user
 
-import "github.com/mxcd/broke/pkg/config"
+import (
+	"slices"
+	"strings"
+
+	"github.com/mxcd/broke/pkg/config"
+)
 
 type User struct {
 	// uuid of the user in keycloak
 	Id string `json:"id"`
 	// Name of the user source
 	Source string `json:"source"`
+	// keycloak realm the user belongs to
+	Realm string `json:"realm,omitempty"`
 	// username of the user in keycloak
 	Username string `json:"username"`
 	// email of the user in keycloak
 	Email string `json:"email"`
-	// groups of the user in keycloak
+	// names of the groups of the user in keycloak
 	Groups []string `json:"groups"`
+	// full paths of the groups of the user in keycloak like /engineering/backend
+	GroupPaths []string `json:"groupPaths,omitempty"`
 	// roles of the user in keycloak
 	Roles []string `json:"roles"`
+
+	FirstName     string `json:"firstName,omitempty"`
+	LastName      string `json:"lastName,omitempty"`
+	Enabled       bool   `json:"enabled"`
+	EmailVerified bool   `json:"emailVerified"`
+	// custom attributes of the user in keycloak
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	// users of other sources merged into this one by correlation, as source:id
+	CorrelatedUsers []string `json:"correlatedUsers,omitempty"`
+	// usernames and emails of the correlated users that differ from the ones of this user.
+	// Accounts in user targets named after them belong to this user as well.
+	CorrelatedUsernames []string `json:"correlatedUsernames,omitempty"`
+	CorrelatedEmails    []string `json:"correlatedEmails,omitempty"`
 }
 
 type MappingSet struct {
 	Groups    []string
 	Roles     []string
 	Usernames []string
+	// attribute name -> accepted values
+	Attributes map[string][]string
+	// realms the users must belong to. Empty means all realms
+	Realms []string
 }
 
 func NewMappingSet() *MappingSet {
 	return &MappingSet{
-		Groups:    []string{},
-		Roles:     []string{},
-		Usernames: []string{},
+		Groups:     []string{},
+		Roles:      []string{},
+		Usernames:  []string{},
+		Attributes: map[string][]string{},
+		Realms:     []string{},
 	}
 }
 
@@ -41,11 +69,39 @@ func (s *MappingSet) FromConfig(mapping config.MappingSet) *MappingSet {
 	if mapping.GetKeycloakUsernames() != nil {
 		s.Usernames = append(s.Usernames, *mapping.GetKeycloakUsernames()...)
 	}
+	for _, realm := range mapping.GetKeycloakRealms() {
+		if !slices.Contains(s.Realms, realm) {
+			s.Realms = append(s.Realms, realm)
+		}
+	}
+	for name, value := range mapping.GetKeycloakAttributes() {
+		if !slices.Contains(s.Attributes[name], value) {
+			s.Attributes[name] = append(s.Attributes[name], value)
+		}
+	}
 	return s
 }
 
+// GetDisplayName returns the full name of the user or the username if the user has no name
+func (u *User) GetDisplayName() string {
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		return u.Username
+	}
+	return name
+}
+
+func (u *User) HasAttribute(name string, value string) bool {
+	return slices.Contains(u.Attributes[name], value)
+}
+
+// HasGroup matches full group paths starting with a slash against the group paths and everything else against the group names
 func (u *User) HasGroup(groupName string) bool {
-	for _, group := range u.Groups {
+	groups := u.Groups
+	if strings.HasPrefix(groupName, "/") {
+		groups = u.GroupPaths
+	}
+	for _, group := range groups {
 		if group == groupName {
 			return true
 		}
@@ -53,6 +109,27 @@ func (u *User) HasGroup(groupName string) bool {
 	return false
 }
 
+// AddGroup adds a group by name and path. With inheritParents, all parent groups of the path are added as well.
+func (u *User) AddGroup(name string, path string, inheritParents bool) {
+	if !slices.Contains(u.Groups, name) {
+		u.Groups = append(u.Groups, name)
+	}
+	if path == "" {
+		return
+	}
+	if !slices.Contains(u.GroupPaths, path) {
+		u.GroupPaths = append(u.GroupPaths, path)
+	}
+	if !inheritParents {
+		return
+	}
+
+	parentPath := path[:strings.LastIndex(path, "/")]
+	if parentPath != "" {
+		u.AddGroup(parentPath[strings.LastIndex(parentPath, "/")+1:], parentPath, true)
+	}
+}
+
 func (u *User) HasRole(roleName string) bool {
 	for _, role := range u.Roles {
 		if role == roleName {
@@ -62,7 +139,15 @@ func (u *User) HasRole(roleName string) bool {
 	return false
 }
 
+// IsMappingSatisfied reports whether the user is in one of the realms of the mapping set, if any, and is listed by
+// username or has any of its groups, roles or attribute values
 func (u *User) IsMappingSatisfied(mappingSet *MappingSet) bool {
+	if len(mappingSet.Realms) > 0 && !slices.Contains(mappingSet.Realms, u.Realm) {
+		return false
+	}
+	if slices.Contains(mappingSet.Usernames, u.Username) {
+		return true
+	}
 	for _, group := range mappingSet.Groups {
 		if u.HasGroup(group) {
 			return true
@@ -73,5 +158,12 @@ func (u *User) IsMappingSatisfied(mappingSet *MappingSet) bool {
 			return true
 		}
 	}
+	for name, values := range mappingSet.Attributes {
+		for _, value := range values {
+			if u.HasAttribute(name, value) {
+				return true
+			}
+		}
+	}
 	return false
 }
@@ -0,0 +1,100 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/mxcd/broke/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupPaths(t *testing.T) {
+	user := &User{Groups: []string{}, GroupPaths: []string{}}
+	user.AddGroup("backend", "/engineering/backend", false)
+
+	assert.True(t, user.HasGroup("backend"), "Groups should match by name")
+	assert.True(t, user.HasGroup("/engineering/backend"), "Groups should match by full path")
+	assert.False(t, user.HasGroup("/sales/backend"), "Subgroups with the same name should be distinguishable by path")
+	assert.False(t, user.HasGroup("engineering"), "Parent groups should not be inherited by default")
+
+	user = &User{Groups: []string{}, GroupPaths: []string{}}
+	user.AddGroup("backend", "/engineering/backend", true)
+	user.AddGroup("frontend", "/engineering/frontend", true)
+
+	assert.True(t, user.HasGroup("engineering"), "Parent groups should be inherited by name")
+	assert.True(t, user.HasGroup("/engineering"), "Parent groups should be inherited by path")
+	assert.Equal(t, []string{"backend", "engineering", "frontend"}, user.Groups, "Inherited groups should only be added once")
+}
+
+func TestAttributeMapping(t *testing.T) {
+	user := &User{
+		Username:   "alice",
+		Attributes: map[string][]string{"department": {"engineering"}},
+	}
+
+	department := &testMapping{attributes: map[string]string{"department": "engineering"}}
+	assert.True(t, user.IsMappingSatisfied(NewMappingSet().FromConfig(department)), "A matching attribute should satisfy the mapping")
+
+	department.attributes["department"] = "sales"
+	assert.False(t, user.IsMappingSatisfied(NewMappingSet().FromConfig(department)), "A different attribute value should not satisfy the mapping")
+}
+
+func TestDisplayName(t *testing.T) {
+	assert.Equal(t, "alice", (&User{Username: "alice"}).GetDisplayName(), "Users without a name should be displayed by username")
+	assert.Equal(t, "Alice Smith", (&User{Username: "alice", FirstName: "Alice", LastName: "Smith"}).GetDisplayName())
+	assert.Equal(t, "Alice", (&User{Username: "alice", FirstName: "Alice"}).GetDisplayName())
+}
+
+type testMapping struct {
+	attributes map[string]string
+	realms     []string
+}
+
+func (m *testMapping) GetKeycloakGroup() *string                { return nil }
+func (m *testMapping) GetKeycloakRole() *string                 { return nil }
+func (m *testMapping) GetKeycloakUsernames() *[]string          { return nil }
+func (m *testMapping) GetKeycloakAttributes() map[string]string { return m.attributes }
+func (m *testMapping) GetKeycloakRealms() []string              { return m.realms }
+
+func TestRealmRestriction(t *testing.T) {
+	mapping := &testMapping{attributes: map[string]string{"department": "sales"}, realms: []string{"staff"}}
+	staffUser := &User{Username: "alice", Realm: "staff", Attributes: map[string][]string{"department": {"sales"}}}
+	partnerUser := &User{Username: "bob", Realm: "partners", Attributes: map[string][]string{"department": {"sales"}}}
+
+	assert.True(t, staffUser.IsMappingSatisfied(NewMappingSet().FromConfig(mapping)))
+	assert.False(t, partnerUser.IsMappingSatisfied(NewMappingSet().FromConfig(mapping)), "Users of other realms should not satisfy the mapping")
+
+	mapping.realms = nil
+	assert.True(t, partnerUser.IsMappingSatisfied(NewMappingSet().FromConfig(mapping)), "Mappings without realms should apply to all realms")
+}
+
+func TestFilter(t *testing.T) {
+	users := []*User{
+		{Username: "alice", Email: "alice@example.com", Enabled: true, EmailVerified: true},
+		{Username: "bob", Email: "bob@example.com", Enabled: false, EmailVerified: true},
+		{Username: "carol", Email: "", Enabled: true},
+		{Username: "service-account-gitlab", Enabled: true},
+		{Username: "dave", Email: "dave@customer.com", Enabled: true, EmailVerified: true},
+	}
+
+	filter, err := NewFilter(config.UserFilterConfig{})
+	assert.NoError(t, err)
+	assert.Len(t, filter.Apply(users), 5, "An empty filter should keep all users")
+
+	filter, err = NewFilter(config.UserFilterConfig{
+		SkipDisabled:           true,
+		RequireVerifiedEmail:   true,
+		ExcludeServiceAccounts: true,
+		ExcludeEmails:          []string{`@customer\.com$`},
+	})
+	assert.NoError(t, err)
+	filtered := filter.Apply(users)
+	assert.Len(t, filtered, 1)
+	assert.Equal(t, "alice", filtered[0].Username)
+
+	filter, err = NewFilter(config.UserFilterConfig{IncludeUsernames: []string{"^(alice|carol)$"}})
+	assert.NoError(t, err)
+	assert.Len(t, filter.Apply(users), 2, "Only users matching an include pattern should be kept")
+
+	_, err = NewFilter(config.UserFilterConfig{ExcludeUsernames: []string{"("}})
+	assert.Error(t, err, "Invalid patterns should be rejected")
+}
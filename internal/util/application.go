@@ -24,7 +24,7 @@ func SetLogLevel(c *cli.Context) {
 	zerolog.TimeFieldFormat = "2006-01-02T15:04:05.000Z"
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	log.Logger = log.Logger.Output(zerolog.ConsoleWriter{
-		Out:        os.Stdout,
+		Out:        GetLogWriter(c),
 		NoColor:    false,
 		TimeFormat: time.RFC3339,
 	}).With().Caller().Logger()
@@ -38,6 +38,16 @@ func SetLogLevel(c *cli.Context) {
 	}
 }
 
+// GetLogWriter returns stderr if a machine readable output is printed to stdout so that logs do not mix with it.
+// Otherwise logs go to stdout.
+func GetLogWriter(c *cli.Context) *os.File {
+	output := c.String("output")
+	if output != "" && output != "table" && c.String("output-file") == "" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
 func PrintLogo(c *cli.Context) {
 	if c.Bool("no-logo") {
 		return
@@ -1,21 +1,258 @@
 package config
 
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
 type BrokeConfig struct {
+	// number of users whose actions are planned in parallel. Defaults to DefaultConcurrency
+	Concurrency int                `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
 	UserSources []UserSourceConfig `yaml:"userSources" json:"userSources"`
 	UserTargets []UserTargetConfig `yaml:"userTargets" json:"userTargets"`
+	// merges the users of all sources that belong to the same person. Users are not correlated if nil
+	Correlation *CorrelationConfig `yaml:"correlation,omitempty" json:"correlation,omitempty"`
+}
+
+const DefaultConcurrency = 4
+
+func (c *BrokeConfig) GetConcurrency() int {
+	if c.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return c.Concurrency
+}
+
+// CorrelationConfig identifies users of different sources or realms as the same person, so that targets see one user
+// instead of one per source. Differing profile fields of correlated users are reported as conflicts in the plan.
+type CorrelationConfig struct {
+	// how users are matched. Defaults to CorrelationKeyEmail
+	Key CorrelationKey `yaml:"key,omitempty" json:"key,omitempty"`
+	// name of the user attribute compared by CorrelationKeyAttribute
+	Attribute string `yaml:"attribute,omitempty" json:"attribute,omitempty"`
+	// how the groups, roles and attributes of correlated users are combined. Defaults to CorrelationMergeUnion
+	Merge CorrelationMergePolicy `yaml:"merge,omitempty" json:"merge,omitempty"`
+	// names of user sources in descending precedence. Unlisted sources follow in the order they are configured.
+	// The profile of the user from the source with the highest precedence wins.
+	Precedence []string `yaml:"precedence,omitempty" json:"precedence,omitempty"`
+}
+
+// CorrelationKey selects the field users are matched by:
+//   - email: the email address, ignoring case. Unverified addresses are never matched
+//   - username: the username, ignoring case
+//   - attribute: the first value of the configured attribute
+type CorrelationKey string
+
+const (
+	CorrelationKeyEmail     CorrelationKey = "email"
+	CorrelationKeyUsername  CorrelationKey = "username"
+	CorrelationKeyAttribute CorrelationKey = "attribute"
+)
+
+func (c *CorrelationConfig) GetKey() CorrelationKey {
+	if c.Key == "" {
+		return CorrelationKeyEmail
+	}
+	return c.Key
+}
+
+// CorrelationMergePolicy defines how the groups, roles and attributes of correlated users are combined:
+//   - union: the merged user has the groups and roles of all correlated users. Attributes missing on the user of the
+//     source with the highest precedence are taken from the others
+//   - precedence: the merged user only has the groups, roles and attributes of the user of the source with the highest precedence
+type CorrelationMergePolicy string
+
+const (
+	CorrelationMergeUnion      CorrelationMergePolicy = "union"
+	CorrelationMergePrecedence CorrelationMergePolicy = "precedence"
+)
+
+func (c *CorrelationConfig) GetMerge() CorrelationMergePolicy {
+	if c.Merge == "" {
+		return CorrelationMergeUnion
+	}
+	return c.Merge
 }
 
 type UserSourceConfig struct {
-	Name       string          `yaml:"name" json:"name"`
-	Keycloak   *KeycloakConfig `yaml:"keycloak,omitempty" json:"keycloak,omitempty"`
-	LoadConfig UserLoadConfig  `yaml:"loadConfig" json:"loadConfig"`
+	Name       string           `yaml:"name" json:"name"`
+	Keycloak   *KeycloakConfig  `yaml:"keycloak,omitempty" json:"keycloak,omitempty"`
+	Ldap       *LdapConfig      `yaml:"ldap,omitempty" json:"ldap,omitempty"`
+	File       *FileConfig      `yaml:"file,omitempty" json:"file,omitempty"`
+	Scim       *ScimConfig      `yaml:"scim,omitempty" json:"scim,omitempty"`
+	Authentik  *AuthentikConfig `yaml:"authentik,omitempty" json:"authentik,omitempty"`
+	LoadConfig UserLoadConfig   `yaml:"loadConfig" json:"loadConfig"`
+	// members of a subgroup like /engineering/backend are also members of its parent groups like /engineering
+	InheritParentGroups bool `yaml:"inheritParentGroups,omitempty" json:"inheritParentGroups,omitempty"`
 }
 
 type KeycloakConfig struct {
-	Url                              string `yaml:"url" json:"url"`
-	Realm                            string `yaml:"realm" json:"realm"`
-	AdminUsernameEnvironmentVariable string `yaml:"adminUsernameEnvironmentVariable" json:"adminUsernameEnvironmentVariable"`
-	AdminPasswordEnvironmentVariable string `yaml:"adminPasswordEnvironmentVariable" json:"adminPasswordEnvironmentVariable"`
+	Url   string `yaml:"url" json:"url"`
+	Realm string `yaml:"realm,omitempty" json:"realm,omitempty"`
+	// realms the users are loaded from instead of the single realm. Users are tagged with their realm.
+	// Usernames and emails must be unique across the realms unless correlation is configured
+	Realms []string `yaml:"realms,omitempty" json:"realms,omitempty"`
+	// realm the credentials belong to. Defaults to master with several realms and to the realm otherwise
+	AuthRealm string `yaml:"authRealm,omitempty" json:"authRealm,omitempty"`
+	// how broke authenticates against Keycloak. Defaults to KeycloakAuthTypePassword
+	AuthType KeycloakAuthType `yaml:"authType,omitempty" json:"authType,omitempty"`
+	// used by KeycloakAuthTypePassword
+	AdminUsernameEnvironmentVariable string `yaml:"adminUsernameEnvironmentVariable,omitempty" json:"adminUsernameEnvironmentVariable,omitempty"`
+	AdminPasswordEnvironmentVariable string `yaml:"adminPasswordEnvironmentVariable,omitempty" json:"adminPasswordEnvironmentVariable,omitempty"`
+	// confidential client with a service account, used by KeycloakAuthTypeClientCredentials and KeycloakAuthTypeClientJwt
+	ClientId string `yaml:"clientId,omitempty" json:"clientId,omitempty"`
+	// used by KeycloakAuthTypeClientCredentials
+	ClientSecretEnvironmentVariable string `yaml:"clientSecretEnvironmentVariable,omitempty" json:"clientSecretEnvironmentVariable,omitempty"`
+	// PEM encoded private key the client assertion is signed with, used by KeycloakAuthTypeClientJwt
+	ClientPrivateKeyFile string `yaml:"clientPrivateKeyFile,omitempty" json:"clientPrivateKeyFile,omitempty"`
+	// algorithm the client assertion is signed with. Defaults to RS256
+	ClientSigningAlgorithm string `yaml:"clientSigningAlgorithm,omitempty" json:"clientSigningAlgorithm,omitempty"`
+}
+
+func (c *KeycloakConfig) GetRealms() []string {
+	if len(c.Realms) > 0 {
+		return c.Realms
+	}
+	return []string{c.Realm}
+}
+
+func (c *KeycloakConfig) GetAuthRealm() string {
+	if c.AuthRealm != "" {
+		return c.AuthRealm
+	}
+	if len(c.Realms) > 0 {
+		return "master"
+	}
+	return c.Realm
+}
+
+// KeycloakAuthType selects how broke authenticates against Keycloak:
+//   - password: admin username and password via the admin-cli client
+//   - clientCredentials: service account of a confidential client with client ID and secret
+//   - clientJwt: service account of a confidential client authenticating with a signed JWT
+//
+// The service account only needs the realm-management roles view-users and view-realm.
+type KeycloakAuthType string
+
+const (
+	KeycloakAuthTypePassword          KeycloakAuthType = "password"
+	KeycloakAuthTypeClientCredentials KeycloakAuthType = "clientCredentials"
+	KeycloakAuthTypeClientJwt         KeycloakAuthType = "clientJwt"
+)
+
+func (c *KeycloakConfig) GetAuthType() KeycloakAuthType {
+	if c.AuthType == "" {
+		return KeycloakAuthTypePassword
+	}
+	return c.AuthType
+}
+
+type LdapConfig struct {
+	// ldap://host:389 or ldaps://host:636
+	Url string `yaml:"url" json:"url"`
+	// upgrade a plain ldap:// connection with StartTLS
+	StartTls bool `yaml:"startTls,omitempty" json:"startTls,omitempty"`
+	// skip the verification of the server certificate
+	Insecure                        bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	BindDnEnvironmentVariable       string `yaml:"bindDnEnvironmentVariable" json:"bindDnEnvironmentVariable"`
+	BindPasswordEnvironmentVariable string `yaml:"bindPasswordEnvironmentVariable" json:"bindPasswordEnvironmentVariable"`
+	BaseDn                          string `yaml:"baseDn" json:"baseDn"`
+	// base DN of the groups. Defaults to BaseDn
+	GroupBaseDn string `yaml:"groupBaseDn,omitempty" json:"groupBaseDn,omitempty"`
+	// defaults to (objectClass=person)
+	UserFilter string `yaml:"userFilter,omitempty" json:"userFilter,omitempty"`
+	// defaults to (|(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=group))
+	GroupFilter string `yaml:"groupFilter,omitempty" json:"groupFilter,omitempty"`
+	// how group memberships are resolved. Defaults to LdapMembershipMemberOf
+	Membership LdapMembership `yaml:"membership,omitempty" json:"membership,omitempty"`
+	// number of entries per page of a search. Defaults to 500
+	PageSize uint32 `yaml:"pageSize,omitempty" json:"pageSize,omitempty"`
+	// names of the attributes the user fields are read from
+	Attributes LdapAttributesConfig `yaml:"attributes,omitempty" json:"attributes,omitempty"`
+	// additional attributes copied onto the users, so that mappings can select users by them
+	ExtraAttributes []string `yaml:"extraAttributes,omitempty" json:"extraAttributes,omitempty"`
+	// timeout of connecting and of every request like 10s. Defaults to 30s
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// LdapMembership selects how the groups of users are resolved:
+//   - memberOf: from the memberOf attribute of the users, as maintained by Active Directory and the OpenLDAP memberof overlay
+//   - member: from the member attribute of the groups
+type LdapMembership string
+
+const (
+	LdapMembershipMemberOf LdapMembership = "memberOf"
+	LdapMembershipMember   LdapMembership = "member"
+)
+
+func (c *LdapConfig) GetMembership() LdapMembership {
+	if c.Membership == "" {
+		return LdapMembershipMemberOf
+	}
+	return c.Membership
+}
+
+// LdapAttributesConfig names the LDAP attributes of users and groups. Empty names fall back to the defaults of OpenLDAP.
+type LdapAttributesConfig struct {
+	// unique id of a user. Defaults to the DN
+	Id string `yaml:"id,omitempty" json:"id,omitempty"`
+	// defaults to uid. Use sAMAccountName for Active Directory
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	// defaults to mail
+	Email string `yaml:"email,omitempty" json:"email,omitempty"`
+	// defaults to givenName
+	FirstName string `yaml:"firstName,omitempty" json:"firstName,omitempty"`
+	// defaults to sn
+	LastName string `yaml:"lastName,omitempty" json:"lastName,omitempty"`
+	// defaults to memberOf
+	MemberOf string `yaml:"memberOf,omitempty" json:"memberOf,omitempty"`
+	// name of a group. Defaults to cn
+	GroupName string `yaml:"groupName,omitempty" json:"groupName,omitempty"`
+	// members of a group. Defaults to member. Use uniqueMember for groupOfUniqueNames
+	GroupMember string `yaml:"groupMember,omitempty" json:"groupMember,omitempty"`
+}
+
+// FileConfig declares users in a YAML or CSV file that is read again on every run
+type FileConfig struct {
+	Path string `yaml:"path" json:"path"`
+	// defaults to csv for files ending in .csv and to yaml otherwise
+	Format FileFormat `yaml:"format,omitempty" json:"format,omitempty"`
+}
+
+type FileFormat string
+
+const (
+	FileFormatYaml FileFormat = "yaml"
+	FileFormatCsv  FileFormat = "csv"
+)
+
+func (c *FileConfig) GetFormat() FileFormat {
+	if c.Format != "" {
+		return c.Format
+	}
+	if strings.HasSuffix(strings.ToLower(c.Path), ".csv") {
+		return FileFormatCsv
+	}
+	return FileFormatYaml
+}
+
+// ScimConfig receives users and groups pushed by an identity provider over SCIM 2.0. The endpoint is served
+// by 'broke serve' at /scim/<source name>/v2 and the received directory is persisted in the store file.
+type ScimConfig struct {
+	StoreFile string `yaml:"storeFile" json:"storeFile"`
+	// bearer token the identity provider authenticates with
+	TokenEnvironmentVariable string `yaml:"tokenEnvironmentVariable" json:"tokenEnvironmentVariable"`
+}
+
+// AuthentikConfig loads users and groups from the REST API of Authentik. Service accounts are skipped.
+type AuthentikConfig struct {
+	Url string `yaml:"url" json:"url"`
+	// API token of a user allowed to view users and groups
+	TokenEnvironmentVariable string `yaml:"tokenEnvironmentVariable" json:"tokenEnvironmentVariable"`
+	// number of users or groups per request. Defaults to 100
+	PageSize int         `yaml:"pageSize,omitempty" json:"pageSize,omitempty"`
+	Http     *HttpConfig `yaml:"http,omitempty" json:"http,omitempty"`
 }
 
 type UserLoadType string
@@ -26,21 +263,173 @@ const (
 )
 
 type UserLoadConfig struct {
+	// defaults to UserLoadTypeFull
 	Type UserLoadType `yaml:"type" json:"type"`
-	// TODO: add partial user load config
+	// groups, roles and usernames whose users are loaded with UserLoadTypePartial.
+	// If none are given, the ones referenced by the mappings of all user targets are loaded.
+	// Otherwise, accounts in targets that belong to none of the loaded users are not pruned,
+	// since they may belong to users outside of the selection.
+	Groups    []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Roles     []string `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Usernames []string `yaml:"usernames,omitempty" json:"usernames,omitempty"`
+	// users of the source that are ignored. Targets treat them as if they did not exist in the source
+	Filter UserFilterConfig `yaml:"filter,omitempty" json:"filter,omitempty"`
+	// only reload the users changed since the last run according to the Keycloak admin events.
+	// Saving admin events has to be enabled in the realm.
+	Incremental *IncrementalLoadConfig `yaml:"incremental,omitempty" json:"incremental,omitempty"`
+}
+
+// HasExplicitSelection reports whether the groups, roles or usernames to load are listed instead of taken from the mappings
+func (c *UserLoadConfig) HasExplicitSelection() bool {
+	return c.GetType() == UserLoadTypePartial && (len(c.Groups) > 0 || len(c.Roles) > 0 || len(c.Usernames) > 0)
+}
+
+type IncrementalLoadConfig struct {
+	// file the times of the last processed admin events of the realms are stored in
+	StateFile string `yaml:"stateFile" json:"stateFile"`
+	// time after which all users are loaded again regardless of the admin events. Defaults to 24h
+	FullResyncInterval string `yaml:"fullResyncInterval,omitempty" json:"fullResyncInterval,omitempty"`
+}
+
+func (c *IncrementalLoadConfig) GetFullResyncInterval() time.Duration {
+	interval, err := time.ParseDuration(c.FullResyncInterval)
+	if err != nil || interval <= 0 {
+		return 24 * time.Hour
+	}
+	return interval
+}
+
+type UserFilterConfig struct {
+	SkipDisabled           bool `yaml:"skipDisabled,omitempty" json:"skipDisabled,omitempty"`
+	RequireVerifiedEmail   bool `yaml:"requireVerifiedEmail,omitempty" json:"requireVerifiedEmail,omitempty"`
+	ExcludeServiceAccounts bool `yaml:"excludeServiceAccounts,omitempty" json:"excludeServiceAccounts,omitempty"`
+	// regular expressions. With include patterns, only users matching at least one of them are kept
+	IncludeUsernames []string `yaml:"includeUsernames,omitempty" json:"includeUsernames,omitempty"`
+	ExcludeUsernames []string `yaml:"excludeUsernames,omitempty" json:"excludeUsernames,omitempty"`
+	IncludeEmails    []string `yaml:"includeEmails,omitempty" json:"includeEmails,omitempty"`
+	ExcludeEmails    []string `yaml:"excludeEmails,omitempty" json:"excludeEmails,omitempty"`
+}
+
+func (c *UserLoadConfig) GetType() UserLoadType {
+	if c.Type == "" {
+		return UserLoadTypeFull
+	}
+	return c.Type
 }
 
 type UserTargetConfig struct {
-	Name    string         `yaml:"name" json:"name"`
-	Mailcow *MailcowConfig `yaml:"mailcow,omitempty" json:"mailcow,omitempty"`
-	Outline *OutlineConfig `yaml:"outline,omitempty" json:"outline,omitempty"`
-	GitLab  *GitLabConfig  `yaml:"gitlab,omitempty" json:"gitlab,omitempty"`
+	Name  string      `yaml:"name" json:"name"`
+	Prune PrunePolicy `yaml:"prune,omitempty" json:"prune,omitempty"`
+	// maximum number of requests to this target in flight at the same time. 0 means no limit
+	Concurrency int            `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	Http        *HttpConfig    `yaml:"http,omitempty" json:"http,omitempty"`
+	Mailcow     *MailcowConfig `yaml:"mailcow,omitempty" json:"mailcow,omitempty"`
+	Outline     *OutlineConfig `yaml:"outline,omitempty" json:"outline,omitempty"`
+	GitLab      *GitLabConfig  `yaml:"gitlab,omitempty" json:"gitlab,omitempty"`
 }
 
+// HttpConfig tunes the http client of a user target or an Authentik user source. Durations are given as strings like '500ms' or '30s'.
+type HttpConfig struct {
+	// maximum time to wait for the response headers of a single attempt. Defaults to 30s
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// number of retries on connection errors, 429 and 5xx. POST and PATCH requests are only retried on 429 and failed
+	// connects, since they may have been processed. Defaults to 3
+	MaxRetries *int `yaml:"maxRetries,omitempty" json:"maxRetries,omitempty"`
+	// bounds of the exponential backoff between retries. Default to 1s and 30s
+	RetryWaitMin string `yaml:"retryWaitMin,omitempty" json:"retryWaitMin,omitempty"`
+	RetryWaitMax string `yaml:"retryWaitMax,omitempty" json:"retryWaitMax,omitempty"`
+	// requests per second. 0 means no limit
+	RateLimit float64 `yaml:"rateLimit,omitempty" json:"rateLimit,omitempty"`
+	// number of requests that may be sent in a burst. Defaults to 1
+	RateLimitBurst int `yaml:"rateLimitBurst,omitempty" json:"rateLimitBurst,omitempty"`
+}
+
+// PrunePolicy defines how access is revoked from users that no longer satisfy any mapping of a target
+// or that have disappeared from all user sources.
+//
+//   - off: nothing is revoked (default)
+//   - disable: Mailcow mailboxes are deactivated, Outline and GitLab group memberships are removed
+//     and GitLab users of source users that satisfy no mapping of the target anymore are blocked
+//   - delete: like disable, but Mailcow mailboxes are deleted
+//
+// The distinction between disable and delete only applies to Mailcow. Outline and GitLab actions are the same for
+// both policies, GitLab users are never deleted.
+//
+// Only accounts managed by broke are considered: Mailcow mailboxes in mapped domains with the mapped auth source
+// and members of Outline and GitLab groups referenced in the mappings. Members of GitLab groups that belong to
+// no source user are only removed from the groups, unless blockUnknownUsers is set on the target.
+type PrunePolicy string
+
+const (
+	PrunePolicyOff     PrunePolicy = "off"
+	PrunePolicyDisable PrunePolicy = "disable"
+	PrunePolicyDelete  PrunePolicy = "delete"
+)
+
+func (c *UserTargetConfig) GetPrunePolicy() PrunePolicy {
+	if c.Prune == "" {
+		return PrunePolicyOff
+	}
+	return c.Prune
+}
+
+// MappingSet selects users by group name or path, by realm role or client role in the form client:role, by username
+// or by the value of a user attribute. A user satisfying any of these is selected, so several attributes select the
+// users having any of them, not all. With realms, only users of these Keycloak realms are selected.
 type MappingSet interface {
 	GetKeycloakGroup() *string
 	GetKeycloakRole() *string
 	GetKeycloakUsernames() *[]string
+	GetKeycloakAttributes() map[string]string
+	GetKeycloakRealms() []string
+}
+
+// SplitClientRole splits a qualified client role like gitlab:maintainer into the client ID and the role name.
+// The client ID of a realm role is empty.
+func SplitClientRole(role string) (string, string) {
+	clientId, roleName, found := strings.Cut(role, ":")
+	if !found {
+		return "", role
+	}
+	return clientId, roleName
+}
+
+// GetClientRoleClients returns the IDs of all clients whose roles are referenced by a mapping
+func (c *BrokeConfig) GetClientRoleClients() []string {
+	clientIds := []string{}
+	for _, userTarget := range c.UserTargets {
+		for _, mapping := range userTarget.GetMappingSets() {
+			if mapping.GetKeycloakRole() == nil {
+				continue
+			}
+			clientId, _ := SplitClientRole(*mapping.GetKeycloakRole())
+			if clientId != "" && !slices.Contains(clientIds, clientId) {
+				clientIds = append(clientIds, clientId)
+			}
+		}
+	}
+	return clientIds
+}
+
+// GetMappingSets returns the mappings of the target regardless of its type
+func (c *UserTargetConfig) GetMappingSets() []MappingSet {
+	mappingSets := []MappingSet{}
+	if c.Mailcow != nil {
+		for _, mapping := range c.Mailcow.Mappings {
+			mappingSets = append(mappingSets, mapping)
+		}
+	}
+	if c.Outline != nil {
+		for _, mapping := range c.Outline.Mappings {
+			mappingSets = append(mappingSets, mapping)
+		}
+	}
+	if c.GitLab != nil {
+		for _, mapping := range c.GitLab.Mappings {
+			mappingSets = append(mappingSets, mapping)
+		}
+	}
+	return mappingSets
 }
 
 type MailcowConfig struct {
@@ -50,11 +439,13 @@ type MailcowConfig struct {
 }
 
 type MailcowMappingConfig struct {
-	KeycloakGroup     *string   `yaml:"group,omitempty" json:"group,omitempty"`
-	KeycloakRole      *string   `yaml:"role,omitempty" json:"role,omitempty"`
-	KeycloakUsernames *[]string `yaml:"usernames,omitempty" json:"usernames,omitempty"`
-	Domain            string    `yaml:"domain" json:"domain"`
-	AuthSource        string    `yaml:"authSource" json:"authSource"`
+	KeycloakGroup      *string           `yaml:"group,omitempty" json:"group,omitempty"`
+	KeycloakRole       *string           `yaml:"role,omitempty" json:"role,omitempty"`
+	KeycloakUsernames  *[]string         `yaml:"usernames,omitempty" json:"usernames,omitempty"`
+	KeycloakAttributes map[string]string `yaml:"attributes,omitempty" json:"attributes,omitempty" jsonschema_description:"users having any of the attribute values are selected"`
+	KeycloakRealms     []string          `yaml:"realms,omitempty" json:"realms,omitempty"`
+	Domain             string            `yaml:"domain" json:"domain"`
+	AuthSource         string            `yaml:"authSource" json:"authSource"`
 }
 
 func (m MailcowMappingConfig) GetKeycloakGroup() *string {
@@ -66,6 +457,12 @@ func (m MailcowMappingConfig) GetKeycloakRole() *string {
 func (m MailcowMappingConfig) GetKeycloakUsernames() *[]string {
 	return m.KeycloakUsernames
 }
+func (m MailcowMappingConfig) GetKeycloakAttributes() map[string]string {
+	return m.KeycloakAttributes
+}
+func (m MailcowMappingConfig) GetKeycloakRealms() []string {
+	return m.KeycloakRealms
+}
 
 type OutlineConfig struct {
 	Url                       string                 `yaml:"url" json:"url"`
@@ -82,11 +479,13 @@ const (
 )
 
 type OutlineMappingConfig struct {
-	KeycloakGroup     *string      `yaml:"group,omitempty" json:"group,omitempty"`
-	KeycloakRole      *string      `yaml:"role,omitempty" json:"role,omitempty"`
-	KeycloakUsernames *[]string    `yaml:"usernames,omitempty" json:"usernames,omitempty"`
-	OutlineGroup      *string      `yaml:"outlineGroup,omitempty" json:"outlineGroup,omitempty"`
-	OutlineRole       *OutlineRole `yaml:"outlineRole,omitempty" json:"outlineRole,omitempty"`
+	KeycloakGroup      *string           `yaml:"group,omitempty" json:"group,omitempty"`
+	KeycloakRole       *string           `yaml:"role,omitempty" json:"role,omitempty"`
+	KeycloakUsernames  *[]string         `yaml:"usernames,omitempty" json:"usernames,omitempty"`
+	KeycloakAttributes map[string]string `yaml:"attributes,omitempty" json:"attributes,omitempty" jsonschema_description:"users having any of the attribute values are selected"`
+	KeycloakRealms     []string          `yaml:"realms,omitempty" json:"realms,omitempty"`
+	OutlineGroup       *string           `yaml:"outlineGroup,omitempty" json:"outlineGroup,omitempty"`
+	OutlineRole        *OutlineRole      `yaml:"outlineRole,omitempty" json:"outlineRole,omitempty"`
 }
 
 func (m OutlineMappingConfig) GetKeycloakGroup() *string {
@@ -98,18 +497,27 @@ func (m OutlineMappingConfig) GetKeycloakRole() *string {
 func (m OutlineMappingConfig) GetKeycloakUsernames() *[]string {
 	return m.KeycloakUsernames
 }
+func (m OutlineMappingConfig) GetKeycloakAttributes() map[string]string {
+	return m.KeycloakAttributes
+}
+func (m OutlineMappingConfig) GetKeycloakRealms() []string {
+	return m.KeycloakRealms
+}
 
 type GitLabConfig struct {
 	Url                       string                `yaml:"url" json:"url"`
 	ApiKeyEnvironmentVariable string                `yaml:"apiKeyEnvironmentVariable" json:"apiKeyEnvironmentVariable"`
 	Mappings                  []GitlabMappingConfig `yaml:"mappings" json:"mappings"`
+	// also block members of managed groups that belong to no source user when pruning. They may be administrators
+	// or users managed outside of broke, and blocking locks them out of the whole instance.
+	BlockUnknownUsers bool `yaml:"blockUnknownUsers,omitempty" json:"blockUnknownUsers,omitempty"`
 }
 
 type GitlabAccessLevel string
 
 const (
-	GitlabAccessLevelGuest    GitlabAccessLevel = "regular"
-	GitlabAccessLevelReporter GitlabAccessLevel = "administrator"
+	GitlabAccessLevelRegular       GitlabAccessLevel = "regular"
+	GitlabAccessLevelAdministrator GitlabAccessLevel = "administrator"
 )
 
 type GitlabGroupPermission string
@@ -126,6 +534,8 @@ type GitlabMappingConfig struct {
 	KeycloakGroup          *string                  `yaml:"group,omitempty" json:"group,omitempty"`
 	KeycloakRole           *string                  `yaml:"role,omitempty" json:"role,omitempty"`
 	KeycloakUsernames      *[]string                `yaml:"usernames,omitempty" json:"usernames,omitempty"`
+	KeycloakAttributes     map[string]string        `yaml:"attributes,omitempty" json:"attributes,omitempty" jsonschema_description:"users having any of the attribute values are selected"`
+	KeycloakRealms         []string                 `yaml:"realms,omitempty" json:"realms,omitempty"`
 	GitlabAccessLevel      *GitlabAccessLevel       `yaml:"gitlabAccessLevel,omitempty" json:"gitlabAccessLevel,omitempty"`
 	GitlabGroupAssignments *[]GitlabGroupAssignment `yaml:"gitlabGroupAssignments,omitempty" json:"gitlabGroupAssignments,omitempty"`
 }
@@ -139,6 +549,12 @@ func (m GitlabMappingConfig) GetKeycloakRole() *string {
 func (m GitlabMappingConfig) GetKeycloakUsernames() *[]string {
 	return m.KeycloakUsernames
 }
+func (m GitlabMappingConfig) GetKeycloakAttributes() map[string]string {
+	return m.KeycloakAttributes
+}
+func (m GitlabMappingConfig) GetKeycloakRealms() []string {
+	return m.KeycloakRealms
+}
 
 type GitlabGroupAssignment struct {
 	Group      string                `yaml:"group" json:"group"`
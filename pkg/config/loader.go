@@ -1,10 +1,15 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
@@ -31,14 +36,203 @@ func LoadConfig(options *LoadConfigOptions) (*BrokeConfig, error) {
 
 	var config BrokeConfig
 	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
+	err = decoder.Decode(&config)
+	if err != nil {
 		errorMessage := "Failed to parse configuration file: " + options.ConfigFile
 		log.Error().Err(err).Msg(errorMessage)
 		return nil, errors.New(errorMessage)
 	}
 
-	// TODO: make some validations:
-	// - User Sources and User Targets must have unique names
+	err = config.Validate()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid configuration file: " + options.ConfigFile)
+		return nil, err
+	}
 
 	return &config, nil
 }
+
+func (c *BrokeConfig) Validate() error {
+	names := map[string]bool{}
+	for _, userSource := range c.UserSources {
+		if names[userSource.Name] {
+			return fmt.Errorf("user source name '%s' is not unique", userSource.Name)
+		}
+		names[userSource.Name] = true
+
+		switch userSource.LoadConfig.GetType() {
+		case UserLoadTypeFull, UserLoadTypePartial:
+		default:
+			return fmt.Errorf("invalid load type '%s' on user source '%s'", userSource.LoadConfig.Type, userSource.Name)
+		}
+
+		filter := userSource.LoadConfig.Filter
+		for _, patterns := range [][]string{filter.IncludeUsernames, filter.ExcludeUsernames, filter.IncludeEmails, filter.ExcludeEmails} {
+			for _, pattern := range patterns {
+				if _, err := regexp.Compile(pattern); err != nil {
+					return fmt.Errorf("invalid filter pattern '%s' on user source '%s': %w", pattern, userSource.Name, err)
+				}
+			}
+		}
+
+		sourceTypes := 0
+		for _, configured := range []bool{userSource.Keycloak != nil, userSource.Ldap != nil, userSource.File != nil, userSource.Scim != nil, userSource.Authentik != nil} {
+			if configured {
+				sourceTypes++
+			}
+		}
+		if sourceTypes != 1 {
+			return fmt.Errorf("user source '%s' must configure exactly one of keycloak, ldap, file, scim and authentik", userSource.Name)
+		}
+
+		if incremental := userSource.LoadConfig.Incremental; incremental != nil {
+			if userSource.Keycloak == nil {
+				return fmt.Errorf("incremental loading on user source '%s' requires a keycloak source", userSource.Name)
+			}
+			if incremental.StateFile == "" {
+				return fmt.Errorf("incremental loading on user source '%s' requires a state file", userSource.Name)
+			}
+			if incremental.FullResyncInterval != "" {
+				if _, err := time.ParseDuration(incremental.FullResyncInterval); err != nil {
+					return fmt.Errorf("invalid full resync interval '%s' on user source '%s'", incremental.FullResyncInterval, userSource.Name)
+				}
+			}
+		}
+
+		if userSource.File != nil {
+			if userSource.File.Path == "" {
+				return fmt.Errorf("file user source '%s' requires a path", userSource.Name)
+			}
+			switch userSource.File.GetFormat() {
+			case FileFormatYaml, FileFormatCsv:
+			default:
+				return fmt.Errorf("invalid file format '%s' on user source '%s'", userSource.File.Format, userSource.Name)
+			}
+		}
+
+		if userSource.Authentik != nil {
+			if !strings.HasPrefix(userSource.Authentik.Url, "http://") && !strings.HasPrefix(userSource.Authentik.Url, "https://") {
+				return fmt.Errorf("authentik user source '%s' requires an http:// or https:// url", userSource.Name)
+			}
+			if userSource.Authentik.TokenEnvironmentVariable == "" {
+				return fmt.Errorf("authentik user source '%s' requires a token environment variable", userSource.Name)
+			}
+			if userSource.Authentik.PageSize < 0 {
+				return fmt.Errorf("authentik user source '%s' has a negative page size", userSource.Name)
+			}
+		}
+
+		if userSource.Scim != nil {
+			if userSource.Scim.StoreFile == "" {
+				return fmt.Errorf("scim user source '%s' requires a store file", userSource.Name)
+			}
+			if userSource.Scim.TokenEnvironmentVariable == "" {
+				return fmt.Errorf("scim user source '%s' requires a token environment variable", userSource.Name)
+			}
+		}
+
+		if userSource.Ldap != nil {
+			if !strings.HasPrefix(userSource.Ldap.Url, "ldap://") && !strings.HasPrefix(userSource.Ldap.Url, "ldaps://") {
+				return fmt.Errorf("ldap url '%s' on user source '%s' must start with ldap:// or ldaps://", userSource.Ldap.Url, userSource.Name)
+			}
+			if userSource.Ldap.StartTls && strings.HasPrefix(userSource.Ldap.Url, "ldaps://") {
+				return fmt.Errorf("ldap user source '%s' must not use StartTLS with ldaps://", userSource.Name)
+			}
+			if userSource.Ldap.BaseDn == "" {
+				return fmt.Errorf("ldap user source '%s' requires a base DN", userSource.Name)
+			}
+			switch userSource.Ldap.GetMembership() {
+			case LdapMembershipMemberOf, LdapMembershipMember:
+			default:
+				return fmt.Errorf("invalid ldap membership '%s' on user source '%s'", userSource.Ldap.Membership, userSource.Name)
+			}
+		}
+
+		if userSource.Keycloak != nil {
+			if userSource.Keycloak.Realm == "" && len(userSource.Keycloak.Realms) == 0 {
+				return fmt.Errorf("keycloak user source '%s' requires a realm", userSource.Name)
+			}
+			if userSource.Keycloak.Realm != "" && len(userSource.Keycloak.Realms) > 0 {
+				return fmt.Errorf("keycloak user source '%s' must not set both realm and realms", userSource.Name)
+			}
+
+			switch userSource.Keycloak.GetAuthType() {
+			case KeycloakAuthTypePassword, KeycloakAuthTypeClientCredentials, KeycloakAuthTypeClientJwt:
+			default:
+				return fmt.Errorf("invalid keycloak auth type '%s' on user source '%s'", userSource.Keycloak.AuthType, userSource.Name)
+			}
+		}
+	}
+
+	for _, userTarget := range c.UserTargets {
+		if names[userTarget.Name] {
+			return fmt.Errorf("user target name '%s' is not unique", userTarget.Name)
+		}
+		names[userTarget.Name] = true
+
+		switch userTarget.Prune {
+		case "", PrunePolicyOff, PrunePolicyDisable, PrunePolicyDelete:
+		default:
+			return fmt.Errorf("invalid prune policy '%s' on user target '%s'", userTarget.Prune, userTarget.Name)
+		}
+
+		if userTarget.Http != nil {
+			for _, duration := range []string{userTarget.Http.Timeout, userTarget.Http.RetryWaitMin, userTarget.Http.RetryWaitMax} {
+				if duration == "" {
+					continue
+				}
+				if _, err := time.ParseDuration(duration); err != nil {
+					return fmt.Errorf("invalid http duration '%s' on user target '%s'", duration, userTarget.Name)
+				}
+			}
+		}
+	}
+
+	if c.Correlation != nil {
+		return c.Correlation.validate(c.UserSources)
+	}
+
+	return nil
+}
+
+func (c *CorrelationConfig) validate(userSources []UserSourceConfig) error {
+	switch c.GetKey() {
+	case CorrelationKeyEmail, CorrelationKeyUsername:
+	case CorrelationKeyAttribute:
+		if c.Attribute == "" {
+			return fmt.Errorf("correlation by attribute requires an attribute name")
+		}
+	default:
+		return fmt.Errorf("invalid correlation key '%s'", c.Key)
+	}
+
+	switch c.GetMerge() {
+	case CorrelationMergeUnion, CorrelationMergePrecedence:
+	default:
+		return fmt.Errorf("invalid correlation merge policy '%s'", c.Merge)
+	}
+
+	for _, name := range c.Precedence {
+		if !slices.ContainsFunc(userSources, func(userSource UserSourceConfig) bool { return userSource.Name == name }) {
+			return fmt.Errorf("correlation precedence refers to unknown user source '%s'", name)
+		}
+	}
+
+	// merged users are only complete if all of their source users are loaded
+	for _, userSource := range userSources {
+		if userSource.LoadConfig.Incremental != nil {
+			return fmt.Errorf("incremental loading on user source '%s' cannot be combined with correlation", userSource.Name)
+		}
+	}
+	return nil
+}
+
+// GetConfigFileHash returns the hex encoded sha256 hash of the configuration file's content
+func GetConfigFileHash(configFile string) (string, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read configuration file '%s': %w", configFile, err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
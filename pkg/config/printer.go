@@ -2,36 +2,65 @@ package config
 
 import (
 	"fmt"
-	"os"
+	"io"
+	"strings"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 )
 
-func (c *BrokeConfig) Print() {
-	fmt.Println("Broke Configuration:")
+// Print renders the user sources and targets as tables to the writer
+func (c *BrokeConfig) Print(w io.Writer) {
+	fmt.Fprintln(w, "Broke Configuration:")
 
 	// Print User Sources
 	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"Name", "Keycloak URL", "Realm", "Load Type"})
+	t.SetOutputMirror(w)
+	t.AppendHeader(table.Row{"Name", "Type", "URL / Path", "Realms / Base DN", "Load Type"})
 	for _, source := range c.UserSources {
-		keycloakURL := ""
+		sourceType := ""
+		url := ""
 		realm := ""
 		if source.Keycloak != nil {
-			keycloakURL = source.Keycloak.Url
-			realm = source.Keycloak.Realm
+			sourceType = "keycloak"
+			url = source.Keycloak.Url
+			realm = strings.Join(source.Keycloak.GetRealms(), ", ")
 		}
-		t.AppendRow(table.Row{source.Name, keycloakURL, realm, source.LoadConfig.Type})
+		if source.Ldap != nil {
+			sourceType = "ldap"
+			url = source.Ldap.Url
+			realm = source.Ldap.BaseDn
+		}
+		if source.File != nil {
+			sourceType = "file"
+			url = source.File.Path
+		}
+		if source.Scim != nil {
+			sourceType = "scim"
+			url = source.Scim.StoreFile
+		}
+		if source.Authentik != nil {
+			sourceType = "authentik"
+			url = source.Authentik.Url
+		}
+		t.AppendRow(table.Row{source.Name, sourceType, url, realm, source.LoadConfig.GetType()})
 	}
 	t.Render()
 
+	if c.Correlation != nil {
+		key := string(c.Correlation.GetKey())
+		if c.Correlation.GetKey() == CorrelationKeyAttribute {
+			key += " " + c.Correlation.Attribute
+		}
+		fmt.Fprintf(w, "Correlation by %s, merge: %s, precedence: %s\n", key, c.Correlation.GetMerge(), strings.Join(c.Correlation.Precedence, ", "))
+	}
+
 	// Print User Targets
 	for _, target := range c.UserTargets {
-		fmt.Println("---")
+		fmt.Fprintln(w, "---")
 		if target.Mailcow != nil {
-			fmt.Printf("Target type: Mailcow\nName: %s\nURL: %s\n", target.Name, target.Mailcow.Url)
+			fmt.Fprintf(w, "Target type: Mailcow\nName: %s\nURL: %s\n", target.Name, target.Mailcow.Url)
 			mailcowTable := table.NewWriter()
-			mailcowTable.SetOutputMirror(os.Stdout)
+			mailcowTable.SetOutputMirror(w)
 			mailcowTable.AppendHeader(table.Row{"Keycloak Group", "Keycloak Role", "Keycloak Usernames"})
 			for _, mapping := range target.Mailcow.Mappings {
 				keycloakGroup := ""
@@ -52,9 +81,9 @@ func (c *BrokeConfig) Print() {
 		}
 
 		if target.Outline != nil {
-			fmt.Printf("Target type: Outline\nName: %s\nURL: %s\n", target.Name, target.Outline.Url)
+			fmt.Fprintf(w, "Target type: Outline\nName: %s\nURL: %s\n", target.Name, target.Outline.Url)
 			outlineTable := table.NewWriter()
-			outlineTable.SetOutputMirror(os.Stdout)
+			outlineTable.SetOutputMirror(w)
 			outlineTable.AppendHeader(table.Row{"Keycloak Group", "Keycloak Role", "Keycloak Usernames", "Outline Group", "Outline Role"})
 			for _, mapping := range target.Outline.Mappings {
 				keycloakGroup := ""
@@ -83,9 +112,9 @@ func (c *BrokeConfig) Print() {
 		}
 
 		if target.GitLab != nil {
-			fmt.Printf("Target type: Gitlab\nName: %s\nURL: %s\n", target.Name, target.GitLab.Url)
+			fmt.Fprintf(w, "Target type: Gitlab\nName: %s\nURL: %s\n", target.Name, target.GitLab.Url)
 			gitlabTable := table.NewWriter()
-			gitlabTable.SetOutputMirror(os.Stdout)
+			gitlabTable.SetOutputMirror(w)
 			gitlabTable.AppendHeader(table.Row{"Keycloak Group", "Keycloak Role", "Keycloak Usernames", "Gitlab Access Level", "Gitlab Group Assignment", "Permission"})
 			for _, mapping := range target.GitLab.Mappings {
 				keycloakGroup := ""